@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiClient is the HTTP client shared by the Mailchimp and Cratejoy fetchers.
+// It adds timeouts, retries with exponential backoff and jitter, Retry-After
+// handling and a token-bucket rate limiter per host.
+type apiClient struct {
+	httpClient  *http.Client
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+
+	defaultRate float64            // requests per second per host, 0 disables limiting
+	hostRates   map[string]float64 // per-host overrides of defaultRate
+
+	mu       sync.Mutex
+	limiters map[string]*tokenBucket
+}
+
+// APIStatusError is returned when a request still fails with a retryable status after all retries
+type APIStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIStatusError) Error() string {
+	return fmt.Sprintf("API error: %d - %s", e.StatusCode, e.Body)
+}
+
+// newAPIClient builds the shared client from the environment
+//
+// API_TIMEOUT (default 60s), API_MAX_RETRIES (default 5), API_BACKOFF_BASE
+// (default 500ms), API_BACKOFF_MAX (default 30s), API_RATE_LIMIT requests per
+// second per host (default 5, 0 disables) and API_RATE_LIMIT_HOSTS with
+// per-host overrides such as "api.cratejoy.com=2,us6.api.mailchimp.com=10".
+func newAPIClient() (*apiClient, error) {
+	timeout, err := envDuration("API_TIMEOUT", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries, err := envInt("API_MAX_RETRIES", 5)
+	if err != nil {
+		return nil, err
+	}
+	if maxRetries < 0 {
+		return nil, fmt.Errorf("invalid API_MAX_RETRIES %d, must not be negative", maxRetries)
+	}
+	baseBackoff, err := envDuration("API_BACKOFF_BASE", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := envDuration("API_BACKOFF_MAX", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defaultRate, err := envFloat("API_RATE_LIMIT", 5)
+	if err != nil {
+		return nil, err
+	}
+	hostRates, err := parseHostRates(envString("API_RATE_LIMIT_HOSTS", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	client := &apiClient{
+		httpClient:  &http.Client{Timeout: timeout},
+		maxRetries:  maxRetries,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		defaultRate: defaultRate,
+		hostRates:   hostRates,
+		limiters:    make(map[string]*tokenBucket),
+	}
+	return client, nil
+}
+
+// parseHostRates parses "host=rate,host=rate"
+func parseHostRates(value string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid API_RATE_LIMIT_HOSTS entry %q", pair)
+		}
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_RATE_LIMIT_HOSTS rate for %s: %w", host, err)
+		}
+		rates[strings.ToLower(host)] = parsed
+	}
+	return rates, nil
+}
+
+// Do sends a request, retrying network errors, 429s and 5xx responses.
+// Any other response, including 4xx, is returned to the caller as is. A
+// Retry-After longer than API_BACKOFF_MAX fails the request instead of
+// stalling the sync.
+// The whole exchange, retries included, is traced as one span.
+func (c *apiClient) Do(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), req.Method+" "+req.URL.Host,
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.path", req.URL.Path),
+	)
+	resp, err := c.send(ctx, req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// send is Do without the span
+func (c *apiClient) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			apiRetriesTotal.WithLabelValues(req.URL.Host).Inc()
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt)))
+			log.WithFields(logrus.Fields{
+				"host":    req.URL.Host,
+				"attempt": attempt,
+			}).Warn("Retrying API request")
+		}
+
+		if err := c.limiter(req.URL.Host).wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(req.Clone(ctx))
+		observeAPIRequest(req.URL.Host, resp)
+		if err != nil {
+			if ctx.Err() != nil || !isRetryableError(err) {
+				return nil, err
+			}
+			log.WithError(err).Warn("API request failed")
+			lastErr = err
+			if attempt == c.maxRetries {
+				break
+			}
+			if err := sleepContext(ctx, c.backoff(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		body, _ := io.ReadAll(resp.Body) // Ignore error here; we're already handling an error case
+		resp.Body.Close()
+		lastErr = &APIStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+
+		delay := c.backoff(attempt)
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if retryAfter > c.maxBackoff {
+				return nil, fmt.Errorf("request to %s asked to retry after %v, longer than the %v maximum backoff: %w", req.URL.Host, retryAfter, c.maxBackoff, lastErr)
+			}
+			delay = retryAfter
+		}
+		log.WithFields(logrus.Fields{
+			"host":        req.URL.Host,
+			"status_code": resp.StatusCode,
+			"delay":       delay,
+		}).Warn("API responded with a retryable status")
+		if attempt == c.maxRetries {
+			break
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("request to %s failed after %d retries: %w", req.URL.Host, c.maxRetries, lastErr)
+}
+
+// backoff returns the exponential delay for an attempt with jitter in [d/2, d)
+func (c *apiClient) backoff(attempt int) time.Duration {
+	delay := float64(c.baseBackoff) * math.Pow(2, float64(attempt))
+	if delay > float64(c.maxBackoff) {
+		delay = float64(c.maxBackoff)
+	}
+	half := delay / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// limiter returns the token bucket for a host
+func (c *apiClient) limiter(host string) *tokenBucket {
+	host = strings.ToLower(host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if bucket, ok := c.limiters[host]; ok {
+		return bucket
+	}
+	rate := c.defaultRate
+	if hostRate, ok := c.hostRates[host]; ok {
+		rate = hostRate
+	}
+	bucket := newTokenBucket(rate)
+	c.limiters[host] = bucket
+	return bucket
+}
+
+// isRetryableStatus reports whether a response status is worth retrying
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableError reports whether a transport error is likely transient.
+// Certificate problems, malformed requests and requests missing from replayed
+// fixtures will fail the same way again.
+func isRetryableError(err error) bool {
+	if errors.Is(err, errNoFixture) {
+		return false
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) {
+		return false
+	}
+	return !strings.Contains(err.Error(), "unsupported protocol scheme")
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestAPIClient(maxRetries int) *apiClient {
+	return &apiClient{
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		maxRetries:  maxRetries,
+		baseBackoff: time.Millisecond,
+		maxBackoff:  5 * time.Millisecond,
+		limiters:    make(map[string]*tokenBucket),
+	}
+}
+
+func TestAPIClientRetriesRetryableStatuses(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := newTestAPIClient(3).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("got status %d after %d calls, want 200 after 3", resp.StatusCode, calls)
+	}
+}
+
+func TestAPIClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := newTestAPIClient(3).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || calls != 1 {
+		t.Errorf("got status %d after %d calls, want 401 after 1", resp.StatusCode, calls)
+	}
+}
+
+func TestAPIClientGivesUpAfterMaxRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := newTestAPIClient(2).Do(req)
+	var statusErr *APIStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected APIStatusError 502, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestAPIClientDoesNotSleepAfterTheLastAttempt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	// Nothing listens on a closed server, so requests fail with a network error
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	client := newTestAPIClient(0)
+	client.baseBackoff, client.maxBackoff = time.Second, time.Second
+	for name, url := range map[string]string{"status": server.URL, "network": closed.URL} {
+		req, _ := http.NewRequest("GET", url, nil)
+		start := time.Now()
+		if _, err := client.Do(req); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		// A backoff would take at least half a second
+		if elapsed := time.Since(start); elapsed >= 250*time.Millisecond {
+			t.Errorf("%s: took %v, expected no backoff", name, elapsed)
+		}
+	}
+}
+
+func TestAPIClientFailsOnLongRetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := newTestAPIClient(3).Do(req)
+	var statusErr *APIStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected APIStatusError 429, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestNewAPIClientRejectsNegativeRetries(t *testing.T) {
+	t.Setenv("API_MAX_RETRIES", "-1")
+	if _, err := newAPIClient(); err == nil {
+		t.Error("expected an error for a negative API_MAX_RETRIES")
+	}
+}
+
+func TestTokenBucketLimitsRate(t *testing.T) {
+	bucket := newTokenBucket(20)
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		if err := bucket.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 20 burst tokens, then 10 more at 20/s
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("30 requests at 20/s took %v, expected at least 400ms", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d, ok := parseRetryAfter("7"); !ok || d != 7*time.Second {
+		t.Errorf("parseRetryAfter(7) = %v, %v", d, ok)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date); !ok || d <= 0 || d > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, %v", date, d, ok)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("expected invalid Retry-After to be ignored")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The raw archive keeps every fetched page body exactly as the API sent it,
+// gzipped, so fields the structs do not know about yet survive and history can
+// be reprocessed later. Pages are keyed by source, entity, the time the entity
+// sync started and the page number within that sync.
+
+// Layout of the sync timestamp in archive file paths
+const archiveTimeLayout = "20060102T150405.000Z"
+
+// archivedPage identifies one archived page body
+type archivedPage struct {
+	Source   string
+	Entity   string
+	SyncedAt time.Time
+	Page     int
+
+	key string // where the backend keeps the body, set by list
+}
+
+func (p archivedPage) String() string {
+	return fmt.Sprintf("%s/%s/%s/%d", p.Source, p.Entity, p.SyncedAt.UTC().Format(archiveTimeLayout), p.Page)
+}
+
+// archiveFilter selects archived pages; empty fields match everything
+type archiveFilter struct {
+	Source string
+	Entity string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f archiveFilter) matches(page archivedPage) bool {
+	return (f.Source == "" || page.Source == f.Source) &&
+		(f.Entity == "" || page.Entity == f.Entity) &&
+		(f.Since.IsZero() || !page.SyncedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || page.SyncedAt.Before(f.Until))
+}
+
+// pageArchive stores gzipped page bodies
+type pageArchive interface {
+	put(ctx context.Context, page archivedPage, gz []byte) error
+	// list returns the matching pages ordered by source, entity, sync time and page
+	list(ctx context.Context, filter archiveFilter) ([]archivedPage, error)
+	get(ctx context.Context, page archivedPage) ([]byte, error)
+}
+
+// configureArchive reads ARCHIVE, "off" (default), "file" to keep pages under
+// ARCHIVE_DIR (default archive) or "table" for the raw_pages table of store
+func configureArchive(store Store) (pageArchive, error) {
+	var archive pageArchive
+	switch mode := envString("ARCHIVE", "off"); mode {
+	case "off":
+		return nil, nil
+	case "file":
+		dir := envString("ARCHIVE_DIR", "archive")
+		archive = fileArchive{dir: dir}
+		log.WithField("dir", dir).Info("Archiving raw API pages to files")
+	case "table":
+		archive = tableArchive{db: store.DB(), dialect: store.Dialect()}
+		log.Info("Archiving raw API pages to the raw_pages table")
+	default:
+		return nil, fmt.Errorf("invalid ARCHIVE %q, expected off, file or table", mode)
+	}
+	return archive, nil
+}
+
+type pageArchiveKey struct{}
+
+// withPageArchive makes every fetch under ctx archive its pages
+func withPageArchive(ctx context.Context, archive pageArchive) context.Context {
+	return context.WithValue(ctx, pageArchiveKey{}, archive)
+}
+
+// pageArchiveFrom returns the archive of ctx, nil when pages are not archived
+func pageArchiveFrom(ctx context.Context) pageArchive {
+	archive, _ := ctx.Value(pageArchiveKey{}).(pageArchive)
+	return archive
+}
+
+// archiveSession numbers and archives the pages of one entity sync. A nil
+// session archives nothing.
+type archiveSession struct {
+	archive  pageArchive
+	source   string
+	entity   string
+	syncedAt time.Time
+	pages    int
+}
+
+// newArchiveSession starts archiving an entity sync, or returns nil when ctx
+// has no archive
+func newArchiveSession(ctx context.Context, source, entity string) *archiveSession {
+	archive := pageArchiveFrom(ctx)
+	if archive == nil {
+		return nil
+	}
+	return &archiveSession{
+		archive:  archive,
+		source:   source,
+		entity:   entity,
+		syncedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+// capture returns body with everything read from it also compressed, and the
+// function that archives the compressed copy once the page decoded cleanly.
+// Archive failures are logged; they never fail the sync.
+func (s *archiveSession) capture(body io.Reader) (io.Reader, func(ctx context.Context)) {
+	if s == nil {
+		return body, func(context.Context) {}
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	return io.TeeReader(body, zw), func(ctx context.Context) {
+		s.pages++
+		page := archivedPage{Source: s.source, Entity: s.entity, SyncedAt: s.syncedAt, Page: s.pages}
+		err := func() error {
+			// Keep whatever the decoder left unread, usually a trailing newline
+			if _, err := io.Copy(zw, body); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			return s.archive.put(ctx, page, buf.Bytes())
+		}()
+		if err != nil {
+			log.WithError(err).WithField("page", page.String()).Error("Failed to archive raw page")
+		}
+	}
+}
+
+// fileArchive keeps pages as <dir>/<source>/<entity>/<synced at>/page-00001.json.gz,
+// with the entity path escaped
+type fileArchive struct {
+	dir string
+}
+
+func (a fileArchive) path(page archivedPage) string {
+	return filepath.Join(a.dir, url.PathEscape(page.Source), url.QueryEscape(page.Entity),
+		page.SyncedAt.UTC().Format(archiveTimeLayout), fmt.Sprintf("page-%05d.json.gz", page.Page))
+}
+
+// put writes through a temporary file so a crash never leaves a truncated page
+func (a fileArchive) put(ctx context.Context, page archivedPage, gz []byte) error {
+	path := a.path(page)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, gz, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (a fileArchive) list(ctx context.Context, filter archiveFilter) ([]archivedPage, error) {
+	var pages []archivedPage
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == a.dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json.gz") {
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, path)
+		if err != nil {
+			return err
+		}
+		page, err := parseArchivePath(rel)
+		if err != nil {
+			log.WithError(err).Warnf("Skipping unexpected file %s in the archive", path)
+			return nil
+		}
+		if filter.matches(page) {
+			pages = append(pages, page)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortArchivedPages(pages)
+	return pages, nil
+}
+
+func (a fileArchive) get(ctx context.Context, page archivedPage) ([]byte, error) {
+	return os.ReadFile(filepath.Join(a.dir, page.key))
+}
+
+// parseArchivePath reads the key back from a path relative to the archive root
+func parseArchivePath(rel string) (archivedPage, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 4 {
+		return archivedPage{}, fmt.Errorf("expected source/entity/time/page, got %q", rel)
+	}
+	source, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return archivedPage{}, err
+	}
+	entity, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return archivedPage{}, err
+	}
+	syncedAt, err := time.Parse(archiveTimeLayout, parts[2])
+	if err != nil {
+		return archivedPage{}, err
+	}
+	number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(parts[3], "page-"), ".json.gz"))
+	if err != nil {
+		return archivedPage{}, fmt.Errorf("page number in %q: %w", rel, err)
+	}
+	return archivedPage{Source: source, Entity: entity, SyncedAt: syncedAt, Page: number, key: rel}, nil
+}
+
+func sortArchivedPages(pages []archivedPage) {
+	sort.Slice(pages, func(i, j int) bool {
+		a, b := pages[i], pages[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Entity != b.Entity {
+			return a.Entity < b.Entity
+		}
+		if !a.SyncedAt.Equal(b.SyncedAt) {
+			return a.SyncedAt.Before(b.SyncedAt)
+		}
+		return a.Page < b.Page
+	})
+}
+
+// Raw pages archived in the store database, created by Migrate on MySQL when
+// ARCHIVE=table
+const rawPagesSchema = `
+	CREATE TABLE IF NOT EXISTS raw_pages (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		source VARCHAR(32) NOT NULL,
+		entity VARCHAR(191) NOT NULL,
+		synced_at DATETIME(3) NOT NULL,
+		page INT NOT NULL,
+		body LONGBLOB NOT NULL,
+		PRIMARY KEY (id),
+		KEY raw_pages_entity (source, entity, synced_at, page)
+	)`
+
+// ensureRawPages creates the raw_pages table if it is missing
+func ensureRawPages(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, rawPagesSchema)
+	return err
+}
+
+// tableArchive keeps pages in the raw_pages table of the store
+type tableArchive struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (a tableArchive) put(ctx context.Context, page archivedPage, gz []byte) error {
+	_, err := a.db.ExecContext(ctx, a.dialect.rebind(
+		"INSERT INTO raw_pages (source, entity, synced_at, page, body) VALUES (?, ?, ?, ?, ?)"),
+		page.Source, page.Entity, page.SyncedAt.UTC(), page.Page, gz)
+	return err
+}
+
+func (a tableArchive) list(ctx context.Context, filter archiveFilter) ([]archivedPage, error) {
+	query := "SELECT id, source, entity, synced_at, page FROM raw_pages WHERE 1 = 1"
+	var args []interface{}
+	if filter.Source != "" {
+		query += " AND source = ?"
+		args = append(args, filter.Source)
+	}
+	if filter.Entity != "" {
+		query += " AND entity = ?"
+		args = append(args, filter.Entity)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND synced_at >= ?"
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND synced_at < ?"
+		args = append(args, filter.Until.UTC())
+	}
+	query += " ORDER BY source, entity, synced_at, page"
+
+	rows, err := a.db.QueryContext(ctx, a.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing raw_pages: %w", err)
+	}
+	defer rows.Close()
+
+	var pages []archivedPage
+	for rows.Next() {
+		var (
+			id       int64
+			page     archivedPage
+			syncedAt dbTime
+		)
+		if err := rows.Scan(&id, &page.Source, &page.Entity, &syncedAt, &page.Page); err != nil {
+			return nil, err
+		}
+		page.SyncedAt = syncedAt.Time.UTC()
+		page.key = strconv.FormatInt(id, 10)
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+func (a tableArchive) get(ctx context.Context, page archivedPage) ([]byte, error) {
+	var body []byte
+	err := a.db.QueryRowContext(ctx, a.dialect.rebind("SELECT body FROM raw_pages WHERE id = ?"), page.key).Scan(&body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", page, err)
+	}
+	return body, nil
+}
+
+// logDone logs how many pages an entity sync archived
+func (s *archiveSession) logDone() {
+	if s == nil || s.pages == 0 {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"source": s.source,
+		"entity": s.entity,
+		"pages":  s.pages,
+	}).Info("Archived raw pages")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"mailchimp/internal/fake"
+)
+
+func gzipBody(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveCapturesCratejoyPages(t *testing.T) {
+	c := fake.NewCratejoy("client", "secret")
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		c.AddOrders(Order{ID: int64(i), PlacedAt: "2024-01-01T00:00:00Z"})
+	}
+	c.FailNext(1, http.StatusServiceUnavailable)
+
+	archive := fileArchive{dir: t.TempDir()}
+	ctx := withPageArchive(context.Background(), archive)
+	var orders []Order
+	p := newMemoryPipeline(newTestAPIClient(3), c, "orders", &orders)
+	if result := p.run(ctx, p.baseURL+"?limit=2"); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	pages, err := archive.list(ctx, archiveFilter{Source: "cratejoy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 3 {
+		t.Fatalf("archived %d pages, want 3: %v", len(pages), pages)
+	}
+	for i, page := range pages {
+		if page.Entity != "orders" || page.Page != i+1 || !page.SyncedAt.Equal(pages[0].SyncedAt) {
+			t.Errorf("unexpected page %v", page)
+		}
+	}
+	gz, err := archive.get(ctx, pages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := decodeArchivedPage[Order](gz, "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 || archived[0].ID != 1 || archived[1].ID != 2 {
+		t.Errorf("first page holds %+v", archived)
+	}
+}
+
+func TestFileArchiveEscapesEntities(t *testing.T) {
+	archive := fileArchive{dir: t.TempDir()}
+	ctx := context.Background()
+	syncedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, page := range []archivedPage{
+		{Source: "mailchimp", Entity: "members:abc/1", SyncedAt: syncedAt, Page: 1},
+		{Source: "mailchimp", Entity: "members:abc/1", SyncedAt: syncedAt.Add(time.Hour), Page: 1},
+		{Source: "cratejoy", Entity: "orders", SyncedAt: syncedAt, Page: 2},
+	} {
+		if err := archive.put(ctx, page, gzipBody(t, "{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := archive.list(ctx, archiveFilter{Source: "mailchimp", Until: syncedAt.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].Entity != "members:abc/1" || !pages[0].SyncedAt.Equal(syncedAt) {
+		t.Errorf("pages = %v", pages)
+	}
+	if pages, err := (fileArchive{dir: archive.dir + "/missing"}).list(ctx, archiveFilter{}); err != nil || len(pages) != 0 {
+		t.Errorf("missing archive listed %v, %v", pages, err)
+	}
+}
+
+func TestReprocessFromArchive(t *testing.T) {
+	exactUpsertCounts(t)
+	for name, newArchive := range map[string]func(store Store) pageArchive{
+		"file":  func(Store) pageArchive { return fileArchive{dir: t.TempDir()} },
+		"table": func(store Store) pageArchive { return tableArchive{db: store.DB(), dialect: store.Dialect()} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestSQLiteStore(t)
+			archive := newArchive(store)
+			ctx := context.Background()
+			first := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			second := first.Add(24 * time.Hour)
+
+			for _, archived := range []struct {
+				page archivedPage
+				body string
+			}{
+				// The later sync saw order 1 refunded
+				{archivedPage{Source: "cratejoy", Entity: "orders", SyncedAt: second, Page: 1},
+					`{"count":1,"results":[{"id":1,"status":"refunded","placed_at":"2024-05-01T00:00:00Z","new_field":true}],"next":null}`},
+				{archivedPage{Source: "cratejoy", Entity: "orders", SyncedAt: first, Page: 1},
+					`{"count":2,"results":[{"id":1,"status":"paid","placed_at":"2024-05-01T00:00:00Z"}],"next":"?page=2"}`},
+				{archivedPage{Source: "cratejoy", Entity: "orders", SyncedAt: first, Page: 2},
+					`{"count":2,"results":[{"id":2,"status":"paid","placed_at":"2024-05-01T00:00:00Z"}],"next":null}`},
+				{archivedPage{Source: "mailchimp", Entity: "members:list1", SyncedAt: first, Page: 1},
+					`{"members":[{"contact_id":"c1","email_address":"a@example.com","status":"subscribed"}],"total_items":1}`},
+			} {
+				if err := archive.put(ctx, archived.page, gzipBody(t, archived.body)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pages, err := archive.list(ctx, archiveFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := reprocessPages(ctx, store, archive, pages)
+			if code := exitCode(results); code != exitOK || len(results) != 2 {
+				t.Fatalf("exit code %d: %+v", code, results)
+			}
+			orders := results[0]
+			if orders.Entity != "orders" || orders.Pages != 3 || orders.Written != 3 || orders.Inserted != 2 || orders.Updated != 1 {
+				t.Errorf("orders result %+v", orders)
+			}
+
+			db := store.DB()
+			var status string
+			if err := db.QueryRowContext(ctx, "SELECT status FROM cj_orders WHERE id = 1").Scan(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status != "refunded" {
+				t.Errorf("order 1 status = %q, want the newest archived state", status)
+			}
+			var email string
+			if err := db.QueryRowContext(ctx, "SELECT email FROM mailchimp WHERE list_id = 'list1' AND contact_id = 'c1'").Scan(&email); err != nil {
+				t.Fatal(err)
+			}
+			if email != "a@example.com" {
+				t.Errorf("member email = %q", email)
+			}
+
+			var out strings.Builder
+			printArchivedSyncs(&out, pages)
+			if got := strings.Count(out.String(), "\n"); got != 4 {
+				t.Errorf("expected a header and 3 syncs, got\n%s", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Unique suffix for reader handler names registered with the MySQL driver
+var bulkLoadSeq int64
+
+// bulkLoader streams rows into LOAD DATA LOCAL INFILE as comma separated
+// fields, with strings quoted and backslash escaped and NULL written as \N.
+//
+// Rows land in a temporary staging table copied from the target, and finish
+// merges the staging table into the target in one transaction. Everything runs
+// on a single connection because temporary tables are per connection. The
+// server must have local_infile enabled.
+type bulkLoader struct {
+	conn    *sql.Conn
+	table   string
+	stage   string
+	columns []string
+	replace bool // merge with REPLACE instead of INSERT ... ON DUPLICATE KEY UPDATE
+	handler string
+
+	pipe *io.PipeWriter
+	out  *bufio.Writer
+	line []byte // reused buffer for the row being encoded
+	done chan error
+	rows int
+	err  error
+}
+
+// startBulkLoad creates the staging table and starts the LOAD DATA statement.
+// columns[0] must be the primary key of table.
+func startBulkLoad(ctx context.Context, db *sql.DB, table string, columns []string, replace bool) (*bulkLoader, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// orders.cj_orders is staged as bulk_cj_orders in the default database
+	stage := "bulk_" + table[strings.LastIndex(table, ".")+1:]
+	for _, stmt := range []string{
+		"DROP TEMPORARY TABLE IF EXISTS " + stage,
+		"CREATE TEMPORARY TABLE " + stage + " LIKE " + table,
+	} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("preparing staging table for %s: %w", table, err)
+		}
+	}
+
+	reader, writer := io.Pipe()
+	l := &bulkLoader{
+		conn:    conn,
+		table:   table,
+		stage:   stage,
+		columns: columns,
+		replace: replace,
+		handler: fmt.Sprintf("%s_%d", stage, atomic.AddInt64(&bulkLoadSeq, 1)),
+		pipe:    writer,
+		out:     bufio.NewWriter(writer),
+		done:    make(chan error, 1),
+	}
+	mysql.RegisterReaderHandler(l.handler, func() io.Reader { return reader })
+
+	query := "LOAD DATA LOCAL INFILE 'Reader::" + l.handler + "' INTO TABLE " + stage +
+		` CHARACTER SET utf8mb4 FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"' ESCAPED BY '\\'` +
+		` LINES TERMINATED BY '\n' (` + strings.Join(columns, ", ") + ")"
+	go func() {
+		_, err := conn.ExecContext(ctx, query)
+		// Unblock the row writer if the server stopped reading early
+		reader.CloseWithError(err)
+		l.done <- err
+	}()
+
+	log.WithFields(logrus.Fields{
+		"table": table,
+		"stage": stage,
+	}).Info("Started bulk load")
+	return l, nil
+}
+
+// add streams one row to the server
+func (l *bulkLoader) add(values ...interface{}) error {
+	if l.err != nil {
+		return l.err
+	}
+	if len(values) != len(l.columns) {
+		return fmt.Errorf("bulk load into %s: got %d values for %d columns", l.table, len(values), len(l.columns))
+	}
+
+	l.line = l.line[:0]
+	for i, value := range values {
+		if i > 0 {
+			l.line = append(l.line, ',')
+		}
+		l.line = appendLoadValue(l.line, value)
+	}
+	l.line = append(l.line, '\n')
+	if _, err := l.out.Write(l.line); err != nil {
+		l.err = err
+		return err
+	}
+	l.rows++
+	return nil
+}
+
+// finish completes the load and merges the staged rows into the target table,
+// returning how many rows were inserted, updated or left unchanged
+func (l *bulkLoader) finish(ctx context.Context) (counts rowCounts, err error) {
+	defer l.close()
+	startTime := time.Now()
+
+	ctx, span := startSpan(ctx, "bulk load "+l.table,
+		attribute.String("db.sql.table", l.table),
+		attribute.Int("db.rows", l.rows),
+	)
+	defer func() {
+		span.SetAttributes(rowCountAttributes(counts)...)
+		endSpan(span, err)
+	}()
+
+	flushErr := l.out.Flush()
+	l.pipe.Close()
+	if err := <-l.done; err != nil {
+		return counts, fmt.Errorf("bulk load into %s: %w", l.stage, err)
+	}
+	if flushErr != nil {
+		return counts, flushErr
+	}
+
+	columns := strings.Join(l.columns, ", ")
+	var merge string
+	if l.replace {
+		merge = "REPLACE INTO " + l.table + " (" + columns + ") SELECT " + columns + " FROM " + l.stage
+	} else {
+		updates := make([]string, 0, len(l.columns)-1)
+		for _, column := range l.columns[1:] {
+			updates = append(updates, column+" = VALUES("+column+")")
+		}
+		merge = "INSERT INTO " + l.table + " (" + columns + ") SELECT " + columns + " FROM " + l.stage +
+			" ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+
+	// Rows with a key already in the target, for splitting the affected rows
+	count := "SELECT COUNT(*), 0 FROM " + l.stage
+	if !l.replace {
+		key := l.columns[0]
+		count = "SELECT COUNT(*), COUNT(t." + key + ") FROM " + l.stage + " s LEFT JOIN " + l.table +
+			" t ON t." + key + " = s." + key
+	}
+
+	tx, err := l.conn.BeginTx(ctx, &sql.TxOptions{Isolation: txIsolation})
+	if err != nil {
+		return counts, err
+	}
+	defer tx.Rollback()
+	var staged, existing int
+	if err := tx.QueryRowContext(ctx, count).Scan(&staged, &existing); err != nil {
+		return counts, fmt.Errorf("counting rows in %s: %w", l.stage, err)
+	}
+	result, err := tx.ExecContext(ctx, merge)
+	if err != nil {
+		return counts, fmt.Errorf("merging %s into %s: %w", l.stage, l.table, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return counts, err
+	}
+	if l.replace {
+		counts = replaceCounts(staged, rowsAffected(result))
+	} else {
+		counts = upsertCounts(staged, existing, rowsAffected(result))
+	}
+	observeRows(l.table, counts)
+
+	log.WithFields(logrus.Fields{
+		"table":     l.table,
+		"rows":      l.rows,
+		"inserted":  counts.Inserted,
+		"updated":   counts.Updated,
+		"unchanged": counts.Unchanged,
+		"duration":  time.Since(startTime),
+	}).Info("Finished bulk load")
+	return counts, nil
+}
+
+// abort stops the load without touching the target table
+func (l *bulkLoader) abort(err error) {
+	l.pipe.CloseWithError(err)
+	<-l.done
+	l.close()
+}
+
+// close drops the staging table and releases the connection
+func (l *bulkLoader) close() {
+	mysql.DeregisterReaderHandler(l.handler)
+	l.conn.ExecContext(context.Background(), "DROP TEMPORARY TABLE IF EXISTS "+l.stage)
+	l.conn.Close()
+}
+
+// appendLoadValue appends value as one LOAD DATA field. NULL is the bare \N
+// and strings are always quoted with backslash escapes, so no string, not even
+// "NULL" or "\N", can be read back as NULL.
+func appendLoadValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, `\N`...)
+	case string:
+		return appendLoadString(buf, v)
+	case bool:
+		if v {
+			return append(buf, '1')
+		}
+		return append(buf, '0')
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'f', -1, 64)
+	default:
+		return appendLoadString(buf, fmt.Sprint(v))
+	}
+}
+
+// appendLoadString appends s quoted, escaping what LOAD DATA would otherwise
+// read as a quote, an escape sequence or the end of the line
+func appendLoadString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case 0:
+			buf = append(buf, '\\', '0')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestAppendLoadValue(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, `\N`},
+		{"NULL", `"NULL"`},
+		{`\N`, `"\\N"`},
+		{true, "1"},
+		{false, "0"},
+		{int64(42), "42"},
+		{19.99, "19.99"},
+		{"2024-01-02 03:04:05", `"2024-01-02 03:04:05"`},
+		{"say \"hi\",\r\nbye", `"say \"hi\",\r\nbye"`},
+	}
+	for _, c := range cases {
+		if got := string(appendLoadValue(nil, c.in)); got != c.want {
+			t.Errorf("appendLoadValue(%#v) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+// TestBulkLoadRoundTrip loads awkward values through LOAD DATA and reads them
+// back. It needs SYNC_TEST_MYSQL_DSN and a server with local_infile enabled.
+func TestBulkLoadRoundTrip(t *testing.T) {
+	dsn := os.Getenv("SYNC_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SYNC_TEST_MYSQL_DSN is not set")
+	}
+	ctx := context.Background()
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE load_round_trip (id BIGINT PRIMARY KEY, note TEXT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.ExecContext(ctx, "DROP TABLE load_round_trip")
+
+	notes := []interface{}{nil, "NULL", `\N`, "", `back\slash`, "say \"hi\", then\nleave\r\n", "tab\there"}
+	loader, err := startBulkLoad(ctx, db, "load_round_trip", []string{"id", "note"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, note := range notes {
+		if err := loader.add(int64(id), note); err != nil {
+			loader.abort(err)
+			t.Fatal(err)
+		}
+	}
+	if _, err := loader.finish(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range notes {
+		var got sql.NullString
+		if err := db.QueryRowContext(ctx, "SELECT note FROM load_round_trip WHERE id = ?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			if got.Valid {
+				t.Errorf("row %d: expected NULL, got %q", id, got.String)
+			}
+		} else if !got.Valid || got.String != want {
+			t.Errorf("row %d: got %q (valid %v), want %q", id, got.String, got.Valid, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString returns an environment variable or a default when it is unset
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt parses an integer environment variable
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	return parsed, nil
+}
+
+// envFloat parses a floating point environment variable
+func envFloat(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	return parsed, nil
+}
+
+// envDuration parses a Go duration environment variable such as "30s"
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	return parsed, nil
+}
+
+// configureAPIURLs points the fetchers at MAILCHIMP_API_URL and
+// CRATEJOY_API_URL when set, for other data centers, proxies or fake servers
+func configureAPIURLs() error {
+	for _, setting := range []struct {
+		name string
+		url  *string
+	}{
+		{"MAILCHIMP_API_URL", &mailchimpAPIURL},
+		{"CRATEJOY_API_URL", &cratejoyAPIURL},
+	} {
+		value := strings.TrimRight(envString(setting.name, *setting.url), "/")
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("invalid %s %q, expected an absolute URL", setting.name, value)
+		}
+		*setting.url = value
+	}
+	return nil
+}
@@ -1,500 +1,170 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// run Cratejoy API
-func Cratejoy(db *sql.DB) {
-	// Fetch data from Cratejoy
-	username := os.Getenv("CRATEJOY_CLIENT")
-	password := os.Getenv("CRATEJOY_API_KEY")
+// Base URL of the Cratejoy API
+var cratejoyAPIURL = "https://api.cratejoy.com/v1"
+
+// run Cratejoy API, returning one result for orders and one for subscriptions
+func Cratejoy(ctx context.Context, store Store, client *apiClient, opts syncOptions) []syncResult {
 	//Fetch Orders
-	err := fetchCratejoyOrders(username, password, db)
-	if err != nil {
-		log.WithError(err).Error("Failed to fetch data from Cratejoy")
-		return
+	results := CratejoyOrders(ctx, store, client, opts)
+	if stopRequested(ctx) {
+		log.Warn("Skipping Cratejoy subscriptions, shutdown requested")
+		return append(results, failedResult(ctx, "cratejoy", "subscriptions", interruptedErr(ctx)))
 	}
 	//Fetch Subscriptions
-	err = fetchCratejoyData(username, password, db)
-	if err != nil {
-		log.WithError(err).Error("Failed to fetch data from Cratejoy")
-		return
-	}
+	return append(results, CratejoySubscriptions(ctx, store, client, opts)...)
 }
 
-// Insert orders into the Database
-func insertOrders(db *sql.DB, response CratejoyOrderResponse) error {
-	if len(response.Results) == 0 {
-		// No orders to insert
-		return nil
+// CratejoyOrders syncs Cratejoy orders on their own
+func CratejoyOrders(ctx context.Context, store Store, client *apiClient, opts syncOptions) []syncResult {
+	username := loadSecret("CRATEJOY_CLIENT")
+	password := loadSecret("CRATEJOY_API_KEY")
+	orders := syncLocked(ctx, store, "cratejoy", "orders", func(ctx context.Context) syncResult {
+		return fetchCratejoyOrders(ctx, client, username, password, store, opts)
+	})
+	if orders.Err != nil {
+		log.WithError(orders.Err).Error("Failed to fetch orders from Cratejoy")
 	}
+	return []syncResult{orders}
+}
 
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertOrders",
-	}).Info("Inserting orders into cj_orders table")
-
-	query := `
-		INSERT INTO orders.cj_orders (
-			id, card_refunded_amount, credit_applied, customer_id, financial_status, fulfillment_status, gift_card_discount,
-			gift_message, gift_renewal_notif, gross_shipping, is_gift, order_gift_info, is_renewal, is_test, note, 
-			placed_at, prorated_charge, refund_applied, refunded_amount, status, store_id, sub_total, total, total_app_fees, 
-			total_label_cost, total_pending_fees, total_price, total_shipping, total_tax, transaction_fees, 
-			transaction_fee_status, type, url) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		card_refunded_amount = VALUES(card_refunded_amount),
-		credit_applied = VALUES(credit_applied),
-		customer_id = VALUES(customer_id),
-		financial_status = VALUES(financial_status),
-		fulfillment_status = VALUES(fulfillment_status),
-		gift_card_discount = VALUES(gift_card_discount),
-		gift_message = VALUES(gift_message),
-		gift_renewal_notif = VALUES(gift_renewal_notif),
-		gross_shipping = VALUES(gross_shipping),
-		is_gift = VALUES(is_gift),
-		order_gift_info = VALUES(order_gift_info),
-		is_renewal = VALUES(is_renewal),
-		is_test = VALUES(is_test),
-		note = VALUES(note),
-		placed_at = VALUES(placed_at),
-		prorated_charge = VALUES(prorated_charge),
-		refund_applied = VALUES(refund_applied),
-		refunded_amount = VALUES(refunded_amount),
-		status = VALUES(status),
-		store_id = VALUES(store_id),
-		sub_total = VALUES(sub_total),
-		total = VALUES(total),
-		total_app_fees = VALUES(total_app_fees),
-		total_label_cost = VALUES(total_label_cost),
-		total_pending_fees = VALUES(total_pending_fees),
-		total_price = VALUES(total_price),
-		total_shipping = VALUES(total_shipping),
-		total_tax = VALUES(total_tax),
-		transaction_fees = VALUES(transaction_fees),
-		transaction_fee_status = VALUES(transaction_fee_status),
-		type = VALUES(type),
-		url = VALUES(url)`
-
-	recordCount := 0
-
-	for _, order := range response.Results {
-		orderGiftInfo, _ := json.Marshal(order.OrderGiftInfo)
-
-		// Convert the placed_at datetime to MySQL compatible format
-		placedAt, err := parseDate(order.PlacedAt)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"order_id": order.ID,
-				"error":    err,
-			}).Error("Failed to format placed_at date")
-			return err
-		}
-
-		_, err = db.Exec(query,
-			order.ID,
-			order.CardRefundedAmount,
-			order.CreditApplied,
-			order.CustomerID,
-			order.FinancialStatus,
-			order.FulfillmentStatus,
-			order.GiftCardDiscount,
-			order.GiftMessage,
-			order.GiftRenewalNotif,
-			order.GrossShipping,
-			order.IsGift,
-			string(orderGiftInfo),
-			order.IsRenewal,
-			order.IsTest,
-			order.Note,
-			placedAt,
-			order.ProratedCharge,
-			order.RefundApplied,
-			order.RefundedAmount,
-			order.Status,
-			order.StoreID,
-			order.SubTotal,
-			order.Total,
-			order.TotalAppFees,
-			order.TotalLabelCost,
-			order.TotalPendingFees,
-			order.TotalPrice,
-			order.TotalShipping,
-			order.TotalTax,
-			order.TransactionFees,
-			order.TransactionFeeStatus,
-			order.Type,
-			order.URL,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"order_id": order.ID,
-				"error":    err,
-			}).Error("Failed to insert or update order in cj_orders table")
-			return err
-		}
-		recordCount++
+// CratejoySubscriptions syncs Cratejoy subscriptions on their own
+func CratejoySubscriptions(ctx context.Context, store Store, client *apiClient, opts syncOptions) []syncResult {
+	username := loadSecret("CRATEJOY_CLIENT")
+	password := loadSecret("CRATEJOY_API_KEY")
+	subscriptions := syncLocked(ctx, store, "cratejoy", "subscriptions", func(ctx context.Context) syncResult {
+		return fetchCratejoyData(ctx, client, username, password, store)
+	})
+	if subscriptions.Err != nil {
+		log.WithError(subscriptions.Err).Error("Failed to fetch subscriptions from Cratejoy")
 	}
+	return []syncResult{subscriptions}
+}
 
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating orders in cj_orders table")
-
-	return nil
+// Columns of cj_orders, in the order orderRow returns them
+var orderColumns = []string{
+	"id", "card_refunded_amount", "credit_applied", "customer_id", "financial_status", "fulfillment_status", "gift_card_discount",
+	"gift_message", "gift_renewal_notif", "gross_shipping", "is_gift", "order_gift_info", "is_renewal", "is_test", "note",
+	"placed_at", "prorated_charge", "refund_applied", "refunded_amount", "status", "store_id", "sub_total", "total", "total_app_fees",
+	"total_label_cost", "total_pending_fees", "total_price", "total_shipping", "total_tax", "transaction_fees",
+	"transaction_fee_status", "type", "url",
 }
 
-// Helper Functions for Cratejoy
-// Function to insert into cj_addresses
-func insertAddresses(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertAddresses",
-	}).Info("Inserting addresses into cj_addresses table")
-
-	addressMap := make(map[int]int) // Original ID to new ID
-	query := `
-		INSERT INTO cj_addresses (id, city, company, country, icon, phone_number, state, status, status_message, street, to_name, type, unit, zip_code) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		city = VALUES(city),
-		company = VALUES(company),
-		country = VALUES(country),
-		icon = VALUES(icon),
-		phone_number = VALUES(phone_number),
-		state = VALUES(state),
-		status = VALUES(status),
-		status_message = VALUES(status_message),
-		street = VALUES(street),
-		to_name = VALUES(to_name),
-		type = VALUES(type),
-		unit = VALUES(unit),
-		zip_code = VALUES(zip_code)`
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		address := subscription.Address
-		_, err := db.Exec(query,
-			address.ID,
-			address.City,
-			address.Company,
-			address.Country,
-			address.Icon,
-			address.PhoneNumber,
-			address.State,
-			address.Status,
-			address.StatusMessage,
-			address.Street,
-			address.To,
-			address.Type,
-			address.Unit,
-			address.ZipCode,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"address_id": address.ID,
-				"error":      err,
-			}).Error("Failed to insert or update address in cj_addresses table")
-			return nil, err
-		}
-		addressMap[address.ID] = address.ID
-		recordCount++
-	}
+// orderRow flattens an order into cj_orders column values, converting its
+// date with ts
+func orderRow(ts timestamper, order Order) ([]interface{}, error) {
+	orderGiftInfo, _ := json.Marshal(order.OrderGiftInfo)
 
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
+	// Convert the placed_at datetime to the database's format
+	placedAt, err := ts.timestamp(order.PlacedAt)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"order_id": order.ID,
+			"error":    err,
+		}).Error("Failed to format placed_at date")
+		return nil, err
+	}
 
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating addresses in cj_addresses table")
+	return []interface{}{
+		order.ID,
+		order.CardRefundedAmount,
+		order.CreditApplied,
+		order.CustomerID,
+		order.FinancialStatus,
+		order.FulfillmentStatus,
+		order.GiftCardDiscount,
+		order.GiftMessage,
+		order.GiftRenewalNotif,
+		order.GrossShipping,
+		order.IsGift,
+		string(orderGiftInfo),
+		order.IsRenewal,
+		order.IsTest,
+		order.Note,
+		placedAt,
+		order.ProratedCharge,
+		order.RefundApplied,
+		order.RefundedAmount,
+		order.Status,
+		order.StoreID,
+		order.SubTotal,
+		order.Total,
+		order.TotalAppFees,
+		order.TotalLabelCost,
+		order.TotalPendingFees,
+		order.TotalPrice,
+		order.TotalShipping,
+		order.TotalTax,
+		order.TransactionFees,
+		order.TransactionFeeStatus,
+		order.Type,
+		order.URL,
+	}, nil
+}
 
-	return addressMap, nil
+// orderPage collects one page of orders for cj_orders
+type orderPage struct {
+	db    *sql.DB
+	batch *upsertBatch
 }
 
-// Function to insert into cj_billings
-func insertBillings(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertBillings",
-	}).Info("Inserting billings into cj_billings table")
-
-	billingMap := make(map[int]int)
-	query := `
-		INSERT INTO cj_billings (id, rebill_day, rebill_months, rebill_weeks, rebill_window, store_id, type) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		rebill_day = VALUES(rebill_day),
-		rebill_months = VALUES(rebill_months),
-		rebill_weeks = VALUES(rebill_weeks),
-		rebill_window = VALUES(rebill_window),
-		store_id = VALUES(store_id),
-		type = VALUES(type)`
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		billing := subscription.Billing
-		rebillWeeks, _ := json.Marshal(billing.RebillWeeks)
-
-		_, err := db.Exec(query,
-			billing.ID,
-			billing.RebillDay,
-			billing.RebillMonths,
-			string(rebillWeeks),
-			billing.RebillWindow,
-			billing.StoreID,
-			billing.Type,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"billing_id": billing.ID,
-				"error":      err,
-			}).Error("Failed to insert or update billing in cj_billings table")
-			return nil, err
-		}
-		billingMap[billing.ID] = billing.ID
-		recordCount++
+func newOrderPage(s *sqlStore) *orderPage {
+	return &orderPage{
+		db:    s.db,
+		batch: newUpsertBatch(s.dialect, s.ordersTable, orderColumns...),
 	}
-
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating billings in cj_billings table")
-
-	return billingMap, nil
 }
 
-// Function to insert into cj_customers
-func insertCustomers(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertCustomers",
-	}).Info("Inserting customers into cj_customers table")
-
-	customerMap := make(map[int]int)
-	query := `
-		INSERT INTO cj_customers (id, country, email, first_name, last_name, location, name, status, type) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		country = VALUES(country),
-		email = VALUES(email),
-		first_name = VALUES(first_name),
-		last_name = VALUES(last_name),
-		location = VALUES(location),
-		name = VALUES(name),
-		status = VALUES(status),
-		type = VALUES(type)`
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		customer := subscription.Customer
-		status, _ := json.Marshal(customer.Status)
-
-		_, err := db.Exec(query,
-			customer.ID,
-			customer.Country,
-			customer.Email,
-			customer.FirstName,
-			customer.LastName,
-			customer.Location,
-			customer.Name,
-			string(status),
-			customer.Type,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"customer_id": customer.ID,
-				"error":       err,
-			}).Error("Failed to insert or update customer in cj_customers table")
-			return nil, err
-		}
-		customerMap[customer.ID] = customer.ID
-		recordCount++
+// add queues an order as it is decoded
+func (p *orderPage) add(order Order) error {
+	row, err := orderRow(p.batch.dialect, order)
+	if err != nil {
+		return err
 	}
-
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating customers in cj_customers table")
-
-	return customerMap, nil
+	p.batch.add(row...)
+	return nil
 }
 
-// Function to insert into cj_products
-func insertProducts(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertProducts",
-	}).Info("Inserting products into cj_products table")
-
-	productMap := make(map[int]int)
-	query := `
-		INSERT INTO cj_products (id, deleted, description, display_order, flat_ship_price, gift_shipping, giftable, listed, max_subs, meta, mp_visible, name, product_billing_id, product_type, reviewable, ship_option, ship_weight, single_purchasable, sku, slug, store_id, subscribe_flow, subscribe_flow_data, visible) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		deleted = VALUES(deleted),
-		description = VALUES(description),
-		display_order = VALUES(display_order),
-		flat_ship_price = VALUES(flat_ship_price),
-		gift_shipping = VALUES(gift_shipping),
-		giftable = VALUES(giftable),
-		listed = VALUES(listed),
-		max_subs = VALUES(max_subs),
-		meta = VALUES(meta),
-		mp_visible = VALUES(mp_visible),
-		name = VALUES(name),
-		product_billing_id = VALUES(product_billing_id),
-		product_type = VALUES(product_type),
-		reviewable = VALUES(reviewable),
-		ship_option = VALUES(ship_option),
-		ship_weight = VALUES(ship_weight),
-		single_purchasable = VALUES(single_purchasable),
-		sku = VALUES(sku),
-		slug = VALUES(slug),
-		store_id = VALUES(store_id),
-		subscribe_flow = VALUES(subscribe_flow),
-		subscribe_flow_data = VALUES(subscribe_flow_data),
-		visible = VALUES(visible)`
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		product := subscription.Product
-		maxSubs, _ := json.Marshal(product.MaxSubs)
-		meta, _ := json.Marshal(product.Meta)
-		subscribeFlowData, _ := json.Marshal(product.SubscribeFlowData)
-
-		_, err := db.Exec(query,
-			product.ID,
-			product.Deleted,
-			product.Description,
-			product.DisplayOrder,
-			product.FlatShipPrice,
-			product.GiftShipping,
-			product.Giftable,
-			product.Listed,
-			string(maxSubs),
-			string(meta),
-			product.MpVisible,
-			product.Name,
-			product.ProductBillingID,
-			product.ProductType,
-			product.Reviewable,
-			product.ShipOption,
-			product.ShipWeight,
-			product.SinglePurchasable,
-			product.Sku,
-			product.Slug,
-			product.StoreID,
-			product.SubscribeFlow,
-			string(subscribeFlowData),
-			product.Visible,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"product_id": product.ID,
-				"error":      err,
-			}).Error("Failed to insert or update product in cj_products table")
-			return nil, err
-		}
-		productMap[product.ID] = product.ID
-		recordCount++
+// commit writes the page in one transaction
+func (p *orderPage) commit(ctx context.Context) (rowCounts, error) {
+	var counts rowCounts
+	if p.batch.len() == 0 {
+		// No orders to insert
+		return counts, nil
 	}
 
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating products in cj_products table")
-
-	return productMap, nil
-}
-
-// Function to insert into cj_product_instances
-func insertProductInstances(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
 	// Start time for the function
 	startTime := time.Now()
 	log.WithFields(logrus.Fields{
 		"start_time": startTime,
-		"operation":  "insertProductInstances",
-	}).Info("Inserting product instances into cj_product_instances table")
-
-	productInstanceMap := make(map[int]int)
-	query := `
-		INSERT INTO cj_product_instances (id, name, price, product_id, sku) 
-		VALUES (?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		name = VALUES(name),
-		price = VALUES(price),
-		product_id = VALUES(product_id),
-		sku = VALUES(sku)`
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		productInstance := subscription.ProductInstance
-
-		_, err := db.Exec(query,
-			productInstance.ID,
-			productInstance.Name,
-			productInstance.Price,
-			productInstance.ProductID,
-			productInstance.Sku,
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"product_instance_id": productInstance.ID,
-				"error":               err,
-			}).Error("Failed to insert or update product instance in cj_product_instances table")
-			return nil, err
-		}
-		productInstanceMap[productInstance.ID] = productInstance.ID
-		recordCount++
+		"operation":  "insertOrders",
+	}).Info("Inserting orders into cj_orders table")
+
+	// The whole page is written in one transaction
+	err := withTx(ctx, p.db, func(tx *sql.Tx) error {
+		var err error
+		counts, err = p.batch.exec(ctx, tx)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to insert or update orders in cj_orders table")
+		return counts, err
 	}
+	observeRows(p.batch.table, counts)
 
 	// End time and duration
 	endTime := time.Now()
@@ -503,326 +173,353 @@ func insertProductInstances(db *sql.DB, subscriptions []Subscription) (map[int]i
 	log.WithFields(logrus.Fields{
 		"end_time":     endTime,
 		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating product instances in cj_product_instances table")
+		"record_count": p.batch.len(),
+		"inserted":     counts.Inserted,
+		"updated":      counts.Updated,
+		"unchanged":    counts.Unchanged,
+	}).Info("Finished inserting or updating orders in cj_orders table")
 
-	return productInstanceMap, nil
+	return counts, nil
 }
 
-func insertTerms(db *sql.DB, subscriptions []Subscription) (map[int]int, error) {
-	termMap := make(map[int]int)
-	query := `
-		INSERT INTO cj_terms (id, description, enabled, name, num_cycles, type, images) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		description = VALUES(description),
-		enabled = VALUES(enabled),
-		name = VALUES(name),
-		num_cycles = VALUES(num_cycles),
-		type = VALUES(type),
-		images = VALUES(images)`
-
-	// Start time for the function
-	startTime := time.Now()
-	log.WithFields(logrus.Fields{
-		"start_time": startTime,
-		"operation":  "insertTerms",
-	}).Info("Inserting terms into cj_terms table")
-
-	recordCount := 0
-
-	for _, subscription := range subscriptions {
-		term := subscription.Term
-		images, _ := json.Marshal(term.Images)
-
-		_, err := db.Exec(query,
-			term.ID,
-			term.Description,
-			term.Enabled,
-			term.Name,
-			term.NumCycles,
-			term.Type,
-			string(images),
-		)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"term_id": term.ID,
-				"error":   err,
-			}).Error("Failed to insert or update term in cj_terms table")
-			return nil, err
-		}
+// Tables a subscription is split into, the ones it references first. Every
+// table is keyed by its id.
+var subscriptionTables = []struct {
+	name    string
+	columns []string
+}{
+	{"cj_addresses", []string{"id", "city", "company", "country", "icon", "phone_number", "state", "status", "status_message", "street", "to_name", "type", "unit", "zip_code"}},
+	{"cj_billings", []string{"id", "rebill_day", "rebill_months", "rebill_weeks", "rebill_window", "store_id", "type"}},
+	{"cj_customers", []string{"id", "country", "email", "first_name", "last_name", "location", "name", "status", "type"}},
+	{"cj_products", []string{"id", "deleted", "description", "display_order", "flat_ship_price", "gift_shipping", "giftable", "listed", "max_subs", "meta", "mp_visible", "name", "product_billing_id", "product_type", "reviewable", "ship_option", "ship_weight", "single_purchasable", "sku", "slug", "store_id", "subscribe_flow", "subscribe_flow_data", "visible"}},
+	{"cj_product_instances", []string{"id", "name", "price", "product_id", "sku"}},
+	{"cj_terms", []string{"id", "description", "enabled", "name", "num_cycles", "type", "images"}},
+	{"cj_subscriptions", []string{"id", "address_id", "billing_id", "customer_id", "product_id", "product_instance_id", "term_id", "autorenew", "billing_name", "credit", "end_date", "is_test", "note", "skipped_date", "source", "start_date", "status", "store_id", "type", "url"}},
+}
 
-		termMap[term.ID] = term.ID
-		recordCount++
+// subscriptionRows flattens a subscription into one row for each of
+// subscriptionTables, converting its dates with ts
+func subscriptionRows(ts timestamper, subscription Subscription) ([][]interface{}, error) {
+	startDate, err := ts.timestamp(subscription.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	endDate, err := ts.timestamp(subscription.EndDate)
+	if err != nil {
+		return nil, err
 	}
 
-	// End time and duration
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-
-	log.WithFields(logrus.Fields{
-		"end_time":     endTime,
-		"duration":     duration,
-		"record_count": recordCount,
-	}).Info("Finished inserting or updating terms in cj_terms table")
-
-	return termMap, nil
-}
-
-func insertSubscriptions(db *sql.DB, response CratejoyResponse) error {
-	if len(response.Results) == 0 {
-		// No subscriptions to insert
-		return nil
+	address := subscription.Address
+	addressRow := []interface{}{
+		address.ID,
+		address.City,
+		address.Company,
+		address.Country,
+		address.Icon,
+		address.PhoneNumber,
+		address.State,
+		address.Status,
+		address.StatusMessage,
+		address.Street,
+		address.To,
+		address.Type,
+		address.Unit,
+		address.ZipCode,
 	}
 
-	log.WithFields(logrus.Fields{
-		"records": len(response.Results),
-	}).Debug("Beginning Database Insert")
-	startTime := time.Now() // Start timing the operation
+	billing := subscription.Billing
+	rebillWeeks, _ := json.Marshal(billing.RebillWeeks)
+	billingRow := []interface{}{
+		billing.ID,
+		billing.RebillDay,
+		billing.RebillMonths,
+		string(rebillWeeks),
+		billing.RebillWindow,
+		billing.StoreID,
+		billing.Type,
+	}
 
-	// Insert into the dependent tables first
-	addressMap, err := insertAddresses(db, response.Results)
-	if err != nil {
-		return err
+	customer := subscription.Customer
+	status, _ := json.Marshal(customer.Status)
+	customerRow := []interface{}{
+		customer.ID,
+		customer.Country,
+		customer.Email,
+		customer.FirstName,
+		customer.LastName,
+		customer.Location,
+		customer.Name,
+		string(status),
+		customer.Type,
 	}
 
-	billingMap, err := insertBillings(db, response.Results)
-	if err != nil {
-		return err
+	product := subscription.Product
+	maxSubs, _ := json.Marshal(product.MaxSubs)
+	meta, _ := json.Marshal(product.Meta)
+	subscribeFlowData, _ := json.Marshal(product.SubscribeFlowData)
+	productRow := []interface{}{
+		product.ID,
+		product.Deleted,
+		product.Description,
+		product.DisplayOrder,
+		product.FlatShipPrice,
+		product.GiftShipping,
+		product.Giftable,
+		product.Listed,
+		string(maxSubs),
+		string(meta),
+		product.MpVisible,
+		product.Name,
+		product.ProductBillingID,
+		product.ProductType,
+		product.Reviewable,
+		product.ShipOption,
+		product.ShipWeight,
+		product.SinglePurchasable,
+		product.Sku,
+		product.Slug,
+		product.StoreID,
+		product.SubscribeFlow,
+		string(subscribeFlowData),
+		product.Visible,
 	}
 
-	customerMap, err := insertCustomers(db, response.Results)
-	if err != nil {
-		return err
+	productInstance := subscription.ProductInstance
+	productInstanceRow := []interface{}{
+		productInstance.ID,
+		productInstance.Name,
+		productInstance.Price,
+		productInstance.ProductID,
+		productInstance.Sku,
 	}
 
-	productMap, err := insertProducts(db, response.Results)
-	if err != nil {
-		return err
+	term := subscription.Term
+	images, _ := json.Marshal(term.Images)
+	termRow := []interface{}{
+		term.ID,
+		term.Description,
+		term.Enabled,
+		term.Name,
+		term.NumCycles,
+		term.Type,
+		string(images),
 	}
 
-	productInstanceMap, err := insertProductInstances(db, response.Results)
-	if err != nil {
-		return err
+	credit, _ := json.Marshal(subscription.Credit)
+	skippedDate, _ := json.Marshal(subscription.SkippedDate)
+	subscriptionRow := []interface{}{
+		subscription.ID,
+		address.ID,
+		billing.ID,
+		customer.ID,
+		product.ID,
+		productInstance.ID,
+		term.ID,
+		subscription.Autorenew,
+		subscription.BillingName,
+		string(credit),
+		endDate,
+		subscription.IsTest,
+		subscription.Note,
+		string(skippedDate),
+		subscription.Source,
+		startDate,
+		subscription.Status,
+		subscription.StoreID,
+		subscription.Type,
+		subscription.URL,
 	}
+	return [][]interface{}{addressRow, billingRow, customerRow, productRow, productInstanceRow, termRow, subscriptionRow}, nil
+}
 
-	termMap, err := insertTerms(db, response.Results)
-	if err != nil {
-		return err
+// subscriptionPage collects one page of subscriptions together with the
+// addresses, billings, customers, products, product instances and terms they
+// reference. Rows shared by many subscriptions are only written once.
+type subscriptionPage struct {
+	db      *sql.DB
+	dialect sqlDialect
+	// One batch per subscriptionTables entry, cj_subscriptions last
+	batches []*upsertBatch
+}
+
+func newSubscriptionPage(s *sqlStore) *subscriptionPage {
+	p := &subscriptionPage{db: s.db, dialect: s.dialect}
+	for _, table := range subscriptionTables {
+		p.batches = append(p.batches, newUpsertBatch(s.dialect, table.name, table.columns...))
 	}
+	return p
+}
 
-	// Now insert into cj_subscriptions
-	tx, err := db.Begin()
+// add queues a subscription and its dependent rows as it is decoded
+func (p *subscriptionPage) add(subscription Subscription) error {
+	rows, err := subscriptionRows(p.dialect, subscription)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	for i, row := range rows {
+		p.batches[i].add(row...)
+	}
+	return nil
+}
 
-	query := `REPLACE INTO cj_subscriptions 
-	          (id, address_id, billing_id, customer_id, product_id, product_instance_id, term_id, autorenew, billing_name, credit, end_date, is_test, note, skipped_date, source, start_date, status, store_id, type, url) 
-	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+// commit writes the page, every dependent table plus subscriptions, in one
+// transaction that is retried as a unit on deadlocks. cj_subscriptions is
+// upserted like the other tables instead of replaced, so columns the sync does
+// not write keep their values. The counts returned are those of
+// cj_subscriptions.
+func (p *subscriptionPage) commit(ctx context.Context) (rowCounts, error) {
+	var counts rowCounts
+	batches := p.batches
+	subscriptions := batches[len(batches)-1]
+	if subscriptions.len() == 0 {
+		// No subscriptions to insert
+		return counts, nil
+	}
 
-	for _, subscription := range response.Results {
-		startDate, err := parseDate(subscription.StartDate)
-		if err != nil {
-			return err
-		}
-		endDate, err := parseDate(subscription.EndDate)
-		if err != nil {
-			return err
-		}
+	log.WithFields(logrus.Fields{
+		"records": subscriptions.len(),
+	}).Debug("Beginning Database Insert")
+	startTime := time.Now() // Start timing the operation
 
-		credit, _ := json.Marshal(subscription.Credit)
-		skippedDate, _ := json.Marshal(subscription.SkippedDate)
-
-		_, err = tx.Exec(query,
-			subscription.ID,
-			addressMap[subscription.Address.ID],
-			billingMap[subscription.Billing.ID],
-			customerMap[subscription.Customer.ID],
-			productMap[subscription.Product.ID],
-			productInstanceMap[subscription.ProductInstance.ID],
-			termMap[subscription.Term.ID],
-			subscription.Autorenew,
-			subscription.BillingName,
-			string(credit),
-			endDate,
-			subscription.IsTest,
-			subscription.Note,
-			string(skippedDate),
-			subscription.Source,
-			startDate,
-			subscription.Status,
-			subscription.StoreID,
-			subscription.Type,
-			subscription.URL,
-		)
-		if err != nil {
-			return err
+	tableCounts := make([]rowCounts, len(batches))
+	err := withTx(ctx, p.db, func(tx *sql.Tx) error {
+		// Insert into the dependent tables first, then cj_subscriptions
+		for i, batch := range batches {
+			var err error
+			if tableCounts[i], err = execBatchLogged(ctx, tx, batch); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return counts, err
 	}
-
-	if err := tx.Commit(); err != nil {
-		return err
+	for i, batch := range batches {
+		observeRows(batch.table, tableCounts[i])
 	}
+	counts = tableCounts[len(batches)-1]
 
 	log.WithFields(logrus.Fields{
 		"duration": time.Since(startTime),
 	}).Debug("Database Insert Successful")
 
-	return nil
+	return counts, nil
 }
 
-// fetch Cratejoy API data
-func fetchCratejoyData(username, password string, db *sql.DB) error {
-	// Define the Cratejoy endpoint for fetching subscriptions
-	baseURL := "https://api.cratejoy.com/v1/subscriptions/"
-	url := baseURL + "?limit=500"
-
-	log.Info("Fetching data from Cratejoy API")
-
-	for {
-		log.Debug("Cratejoy API URL: ", url)
-		// Set up the HTTP request
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.WithError(err).Error("Failed to create new HTTP request")
-			return err
-		}
-
-		// Encode username and password for basic authentication
-		authStr := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-		req.Header.Add("Authorization", "Basic "+authStr)
-		log.Debug("Authorization header set for basic authentication")
-		log.Debug("Authorization Header: ", req.Header.Get("Authorization"))
-
-		// Send the API request
-		client := &http.Client{}
-		log.Info("Sending request to Cratejoy API")
-		resp, err := client.Do(req)
-		if err != nil {
-			log.WithError(err).Error("Failed to send API request")
-			return err
-		}
-		defer resp.Body.Close()
-
-		// Check for non-200 status code
-		if resp.StatusCode != http.StatusOK {
-			body, _ := ioutil.ReadAll(resp.Body) // Ignore error here; we're already handling an error case
-			log.WithFields(logrus.Fields{
-				"status_code": resp.StatusCode,
-				"response":    string(body),
-			}).Error("Cratejoy API responded with an error")
-			return fmt.Errorf("Cratejoy API error: %d - %s", resp.StatusCode, string(body))
-		}
+// execBatchLogged writes one table of a page with the usual timing logs
+func execBatchLogged(ctx context.Context, tx execer, batch *upsertBatch) (rowCounts, error) {
+	// Start time for the function
+	startTime := time.Now()
+	log.WithFields(logrus.Fields{
+		"start_time": startTime,
+		"table":      batch.table,
+	}).Infof("Inserting rows into %s table", batch.table)
 
-		log.Info("Received response from Cratejoy API")
-		log.Debugf("Status Code: %d", resp.StatusCode)
+	counts, err := batch.exec(ctx, tx)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to insert or update rows in %s table", batch.table)
+		return counts, err
+	}
 
-		// Read the API response
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.WithError(err).Error("Failed to read response body")
-			return err
-		}
+	// End time and duration
+	endTime := time.Now()
+	duration := endTime.Sub(startTime)
 
-		// log.Debug("Raw JSON response: ", string(body))
+	log.WithFields(logrus.Fields{
+		"end_time":     endTime,
+		"duration":     duration,
+		"record_count": batch.len(),
+		"inserted":     counts.Inserted,
+		"updated":      counts.Updated,
+		"unchanged":    counts.Unchanged,
+	}).Infof("Finished inserting or updating rows in %s table", batch.table)
 
-		// Parse the JSON response
-		var response CratejoyResponse
-		err = json.Unmarshal(body, &response)
-		if err != nil {
-			log.WithError(err).Error("Failed to unmarshal JSON response")
-			return err
-		}
+	return counts, nil
+}
 
-		log.Info("Successfully fetched and parsed Cratejoy API data")
-		// log.Debugf("CratejoyResponse: %+v", response)
+// fetch Cratejoy API data
+func fetchCratejoyData(ctx context.Context, client *apiClient, username, password string, store Store) syncResult {
+	// Define the Cratejoy endpoint for fetching subscriptions
+	baseURL := cratejoyAPIURL + "/subscriptions/"
+	url := baseURL + "?limit=500"
 
-		// Insert the subscription data into the database
-		err = insertSubscriptions(db, response)
-		if err != nil {
-			log.WithError(err).Error("Failed to insert subscriptions into the database")
-			return nil
-		}
+	// Resume from the last committed page of an interrupted run
+	cursor, err := store.LoadCheckpoint(ctx, "cratejoy", "subscriptions")
+	if err != nil {
+		log.WithError(err).Error("Failed to load subscriptions checkpoint")
+		return failedResult(ctx, "cratejoy", "subscriptions", err)
+	}
+	if cursor != "" {
+		url = cursor
+	}
 
-		// Check if there is a next page. If not, break the loop
-		if response.Next == "" {
-			break
-		}
+	log.Info("Fetching data from Cratejoy API")
 
-		// Update the URL to the next page URL
-		url = baseURL + response.Next
+	pipeline := &cratejoyPipeline[Subscription]{
+		client:   client,
+		store:    store,
+		entity:   "subscriptions",
+		baseURL:  baseURL,
+		username: username,
+		password: password,
+		newPage: func() pageWriter[Subscription] {
+			return newStorePage(store.UpsertSubscriptions)
+		},
 	}
-	return nil
+	return pipeline.run(ctx, url)
 }
 
-// sendCratejoyRequest handles the HTTP request with retry logic
-func sendCratejoyRequest(url, username, password string) (*http.Response, error) {
-	maxRetries := 5
-	var resp *http.Response
-	// var err error
-
-	for retry := 0; retry < maxRetries; retry++ {
-		log.Debug("Cratejoy API URL: ", url)
-
-		// Set up the HTTP request
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.WithError(err).Error("Failed to create new HTTP request")
-			return nil, err
-		}
+// sendCratejoyRequest sends an authenticated GET through the shared API client,
+// which takes care of timeouts, retries and rate limiting
+func sendCratejoyRequest(ctx context.Context, client *apiClient, url, username, password string) (*http.Response, error) {
+	log.Debug("Cratejoy API URL: ", url)
 
-		// Encode username and password for basic authentication
-		authStr := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-		req.Header.Add("Authorization", "Basic "+authStr)
-		log.Debug("Authorization header set for basic authentication")
+	// Set up the HTTP request
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		log.WithError(err).Error("Failed to create new HTTP request")
+		return nil, err
+	}
 
-		// Send the API request
-		client := &http.Client{
-			Timeout: time.Second * 60, // 60-second timeout
-		}
-		log.Info("Sending request to Cratejoy API")
-		resp, err = client.Do(req)
-		if err != nil {
-			log.WithError(err).Error("Failed to send API request")
-			if retry < maxRetries-1 {
-				log.Warnf("Retrying request, attempt %d/%d...", retry+1, maxRetries)
-				continue
-			}
-			return nil, err
-		}
+	// Encode username and password for basic authentication
+	authStr := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	req.Header.Add("Authorization", "Basic "+authStr)
+	log.Debug("Authorization header set for basic authentication")
 
-		// Check for non-200 status code
-		if resp.StatusCode != http.StatusOK {
-			body, _ := ioutil.ReadAll(resp.Body) // Ignore error here; we're already handling an error case
-			log.WithFields(logrus.Fields{
-				"status_code": resp.StatusCode,
-				"response":    string(body),
-			}).Error("Cratejoy API responded with an error")
-			if retry < maxRetries-1 {
-				log.Warnf("Retrying request, attempt %d/%d...", retry+1, maxRetries)
-				continue
-			}
-			return nil, fmt.Errorf("Cratejoy API error: %d - %s", resp.StatusCode, string(body))
-		}
+	// Send the API request
+	log.Info("Sending request to Cratejoy API")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.WithError(err).Error("Failed to send API request")
+		return nil, err
+	}
 
-		// If everything is successful, return the response
-		return resp, nil
+	// Check for non-200 status code
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body) // Ignore error here; we're already handling an error case
+		resp.Body.Close()
+		log.WithFields(logrus.Fields{
+			"status_code": resp.StatusCode,
+			"response":    string(body),
+		}).Error("Cratejoy API responded with an error")
+		return nil, fmt.Errorf("Cratejoy API error: %d - %s", resp.StatusCode, string(body))
 	}
 
-	return nil, fmt.Errorf("Failed to send request after %d retries", maxRetries)
+	return resp, nil
 }
 
 // fetchCratejoyOrders fetches order data from the Cratejoy API and processes it
-func fetchCratejoyOrders(username, password string, db *sql.DB) error {
+func fetchCratejoyOrders(ctx context.Context, client *apiClient, username, password string, store Store, opts syncOptions) syncResult {
+	if opts.BulkLoad {
+		return bulkLoadCratejoyOrders(ctx, client, username, password, store)
+	}
+
 	// Query the most recent placed_at date from the database
-	var mostRecentDate time.Time
-	query := "SELECT MAX(placed_at) FROM orders.cj_orders"
-	err := db.QueryRow(query).Scan(&mostRecentDate)
+	mostRecentDate, err := store.LatestOrderPlacedAt(ctx)
 	if err != nil {
 		log.WithError(err).Error("Failed to query the most recent placed_at date")
-		return err
+		return failedResult(ctx, "cratejoy", "orders", err)
 	}
 
 	// Subtract 5 days from the most recent date
@@ -830,63 +527,107 @@ func fetchCratejoyOrders(username, password string, db *sql.DB) error {
 	filterDateStr := filterDate.Format("2006-01-02T15:04:05Z") // Format to ISO 8601
 
 	// Define the Cratejoy endpoint for fetching orders with the filter
-	baseURL := "https://api.cratejoy.com/v1/orders/"
+	baseURL := cratejoyAPIURL + "/orders/"
 	url := fmt.Sprintf("%s?placed_at__gt=%s&limit=150", baseURL, filterDateStr)
+	if mostRecentDate.IsZero() {
+		// No orders stored yet, fetch them all
+		url = baseURL + "?limit=150"
+	}
 
-	log.Info("Fetching order data from Cratejoy API")
-
-	for {
-		resp, err := sendCratejoyRequest(url, username, password)
-		if err != nil {
-			return err
-		}
-
-		defer resp.Body.Close()
+	// Resume from the last committed page of an interrupted run
+	cursor, err := store.LoadCheckpoint(ctx, "cratejoy", "orders")
+	if err != nil {
+		log.WithError(err).Error("Failed to load orders checkpoint")
+		return failedResult(ctx, "cratejoy", "orders", err)
+	}
+	if cursor != "" {
+		url = cursor
+	}
 
-		// Check for non-200 status code
-		if resp.StatusCode != http.StatusOK {
-			body, _ := ioutil.ReadAll(resp.Body) // Ignore error here; we're already handling an error case
-			log.WithFields(logrus.Fields{
-				"status_code": resp.StatusCode,
-				"response":    string(body),
-			}).Error("Cratejoy API responded with an error")
-			return fmt.Errorf("Cratejoy API error: %d - %s", resp.StatusCode, string(body))
-		}
+	log.Info("Fetching order data from Cratejoy API")
 
-		log.Info("Received response from Cratejoy API")
-		log.Debugf("Status Code: %d", resp.StatusCode)
+	pipeline := &cratejoyPipeline[Order]{
+		client:   client,
+		store:    store,
+		entity:   "orders",
+		baseURL:  baseURL,
+		username: username,
+		password: password,
+		newPage: func() pageWriter[Order] {
+			return newStorePage(store.UpsertOrders)
+		},
+	}
+	return pipeline.run(ctx, url)
+}
 
-		// Read the API response
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.WithError(err).Error("Failed to read response body")
-			return err
-		}
+// bulkLoadCratejoyOrders backfills every order through LOAD DATA LOCAL INFILE.
+// Pages are streamed into a staging table that is merged once at the end, so a
+// bulk load always starts from the first page and does not use checkpoints.
+func bulkLoadCratejoyOrders(ctx context.Context, client *apiClient, username, password string, store Store) syncResult {
+	baseURL := cratejoyAPIURL + "/orders/"
+	url := baseURL + "?limit=150"
 
-		// Parse the JSON response
-		var response CratejoyOrderResponse
-		err = json.Unmarshal(body, &response)
-		if err != nil {
-			log.WithError(err).Error("Failed to unmarshal JSON response")
-			return err
-		}
+	mysql, ok := store.(*mysqlStore)
+	if !ok {
+		return failedResult(ctx, "cratejoy", "orders", errBulkLoadUnsupported)
+	}
+	loader, err := startBulkLoad(ctx, mysql.db, mysql.ordersTable, orderColumns, false)
+	if err != nil {
+		log.WithError(err).Error("Failed to start orders bulk load")
+		return failedResult(ctx, "cratejoy", "orders", err)
+	}
 
-		log.Info("Successfully fetched and parsed Cratejoy order data")
+	log.Info("Bulk loading order data from Cratejoy API")
+
+	pipeline := &cratejoyPipeline[Order]{
+		client:          client,
+		store:           store,
+		entity:          "orders",
+		baseURL:         baseURL,
+		username:        username,
+		password:        password,
+		skipCheckpoints: true,
+		newPage: func() pageWriter[Order] {
+			return bulkOrderPage{loader: loader}
+		},
+	}
+	// Pages only reach the table when the load is merged
+	result := pipeline.run(ctx, url)
+	result.Written = 0
+	// An interrupted load still merges the pages streamed so far
+	interrupted := errors.Is(result.Err, errInterrupted)
+	if result.Err != nil && !interrupted {
+		loader.abort(result.Err)
+		return result.finish(result.Err)
+	}
 
-		// Insert the order data into the database
-		err = insertOrders(db, response)
-		if err != nil {
-			log.WithError(err).Error("Failed to insert orders into the database")
-			return err
-		}
+	counts, err := loader.finish(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to bulk load orders")
+		return result.finish(err)
+	}
+	result.Written = result.Fetched
+	result.rowCounts = counts
+	log.WithField("rows", result.Written).Info("Bulk loaded Cratejoy orders")
+	if interrupted {
+		return result.finish(errInterrupted)
+	}
+	return result.finish(nil)
+}
 
-		// Check if there is a next page. If not, break the loop
-		if response.Next == "" {
-			break
-		}
+// bulkOrderPage streams orders into a bulk load, which commits once at the end
+type bulkOrderPage struct {
+	loader *bulkLoader
+}
 
-		// Update the URL to the next page URL
-		url = baseURL + response.Next
+func (p bulkOrderPage) add(order Order) error {
+	row, err := orderRow(mysqlDialect{}, order)
+	if err != nil {
+		return err
 	}
-	return nil
+	return p.loader.add(row...)
+}
+
+func (p bulkOrderPage) commit(ctx context.Context) (rowCounts, error) {
+	return rowCounts{}, nil
 }
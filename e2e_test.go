@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mailchimp/internal/fake"
+)
+
+// memoryPage collects a pipeline's records instead of writing them to MySQL
+type memoryPage[T any] struct {
+	pending   []T
+	committed *[]T
+}
+
+func (p *memoryPage[T]) add(record T) error {
+	p.pending = append(p.pending, record)
+	return nil
+}
+
+func (p *memoryPage[T]) commit(ctx context.Context) (rowCounts, error) {
+	*p.committed = append(*p.committed, p.pending...)
+	return rowCounts{Inserted: len(p.pending)}, nil
+}
+
+func newMemoryPipeline[T any](client *apiClient, c *fake.Cratejoy, entity string, committed *[]T) *cratejoyPipeline[T] {
+	return &cratejoyPipeline[T]{
+		client:          client,
+		entity:          entity,
+		baseURL:         c.APIURL() + "/" + entity + "/",
+		username:        c.Username,
+		password:        c.Password,
+		skipCheckpoints: true,
+		newPage: func() pageWriter[T] {
+			return &memoryPage[T]{committed: committed}
+		},
+	}
+}
+
+func fakeMembers(n int) []fake.Member {
+	members := make([]fake.Member, n)
+	for i := range members {
+		members[i] = fake.Member{
+			EmailAddress: fmt.Sprintf("member%d@example.com", i),
+			Status:       "subscribed",
+			FullName:     fmt.Sprintf("Member %d", i),
+			ContactID:    fmt.Sprintf("contact%d", i),
+		}
+	}
+	return members
+}
+
+func TestMailchimpFetchAgainstFakeRetriesRateLimits(t *testing.T) {
+	m := fake.NewMailchimp("test-key")
+	defer m.Close()
+	m.AddMembers("list1", fakeMembers(5)...)
+	m.FailNext(2, http.StatusTooManyRequests)
+
+	f := newTestMailchimpFetcher(m.APIURL(), 0)
+	f.client = newTestAPIClient(3)
+	members, err := collectMembers(t, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members != 5 {
+		t.Errorf("expected 5 members, got %d", members)
+	}
+	// 3 pages of 2 plus the 2 rate limited attempts
+	if m.Requests() != 5 {
+		t.Errorf("expected 5 requests, got %d", m.Requests())
+	}
+}
+
+func TestMailchimpFetchAgainstFakeRejectsBadKey(t *testing.T) {
+	m := fake.NewMailchimp("other-key")
+	defer m.Close()
+	m.AddMembers("list1", fakeMembers(1)...)
+
+	_, err := collectMembers(t, newTestMailchimpFetcher(m.APIURL(), 3))
+	var problem *MailchimpError
+	if !errors.As(err, &problem) || problem.Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 MailchimpError, got %v", err)
+	}
+	if m.Requests() != 1 {
+		t.Errorf("auth errors should not be retried, got %d requests", m.Requests())
+	}
+}
+
+func TestCratejoyPipelineAgainstFakeFollowsNextLinks(t *testing.T) {
+	c := fake.NewCratejoy("client", "secret")
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		c.AddOrders(Order{ID: int64(i), PlacedAt: "2024-01-01T00:00:00Z"})
+	}
+	c.FailNext(2, http.StatusServiceUnavailable)
+
+	var orders []Order
+	p := newMemoryPipeline(newTestAPIClient(3), c, "orders", &orders)
+	result := p.run(context.Background(), p.baseURL+"?limit=2")
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if result.Pages != 3 || result.Fetched != 5 || result.Written != 5 || result.Inserted != 5 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	for i, order := range orders {
+		if order.ID != int64(i+1) {
+			t.Fatalf("orders out of order: %+v", orders)
+		}
+	}
+}
+
+func TestCratejoyPipelineAgainstFakeFailsOnPersistentErrors(t *testing.T) {
+	c := fake.NewCratejoy("client", "secret")
+	defer c.Close()
+	for i := 1; i <= 3; i++ {
+		c.AddSubscriptions(Subscription{ID: i})
+	}
+
+	var subscriptions []Subscription
+	p := newMemoryPipeline(newTestAPIClient(1), c, "subscriptions", &subscriptions)
+	url := p.baseURL + "?limit=2"
+	first := p.run(context.Background(), url)
+	if first.Err != nil || first.Written != 3 {
+		t.Fatalf("expected a clean run first, got %+v", first)
+	}
+
+	// One retry is allowed, so two 500s in a row fail the first page
+	c.FailNext(2, http.StatusInternalServerError)
+	result := p.run(context.Background(), url)
+	if result.Err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if result.Written != 0 {
+		t.Errorf("expected nothing written, got %d", result.Written)
+	}
+}
+
+// testStores returns a migrated SQLite store, plus a MySQL store when
+// SYNC_TEST_MYSQL_DSN points at a disposable database with the customers
+// schema, including orders.cj_orders and the Cratejoy subscription tables, and
+// a PostgreSQL store when SYNC_TEST_POSTGRES_DSN points at an empty database
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	ctx := context.Background()
+	stores := make(map[string]Store)
+
+	sqlite, err := openSQLiteStore(ctx, filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores["sqlite"] = sqlite
+
+	if dsn := os.Getenv("SYNC_TEST_MYSQL_DSN"); dsn != "" {
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores["mysql"] = newMySQLStore(ctx, db)
+	}
+	if dsn := os.Getenv("SYNC_TEST_POSTGRES_DSN"); dsn != "" {
+		postgres, err := openPostgresStore(ctx, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores["postgres"] = postgres
+	}
+
+	for name, store := range stores {
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("migrating %s: %v", name, err)
+		}
+		t.Cleanup(func() { store.Close() })
+	}
+	return stores
+}
+
+// TestFullSyncAgainstFakes runs both syncs end to end, from the fake APIs into
+// every test store
+func TestFullSyncAgainstFakes(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testFullSync(t, store)
+		})
+	}
+}
+
+func testFullSync(t *testing.T, store Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	m := fake.NewMailchimp("test-key")
+	defer m.Close()
+	m.AddMembers("list1", fakeMembers(25)...)
+	m.FailNext(1, http.StatusTooManyRequests)
+
+	c := fake.NewCratejoy("client", "secret")
+	defer c.Close()
+	placedAt := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	for i := 1; i <= 7; i++ {
+		c.AddOrders(Order{ID: int64(900000000 + i), PlacedAt: placedAt})
+		c.AddSubscriptions(Subscription{ID: 900000000 + i, StartDate: placedAt, EndDate: placedAt})
+	}
+	c.FailNext(1, http.StatusBadGateway)
+
+	t.Setenv("MAILCHIMP_API_URL", m.APIURL())
+	t.Setenv("CRATEJOY_API_URL", c.APIURL())
+	t.Setenv("apiKey", m.APIKey)
+	t.Setenv("listID", "list1")
+	t.Setenv("CRATEJOY_CLIENT", c.Username)
+	t.Setenv("CRATEJOY_API_KEY", c.Password)
+	defer func(mailchimp, cratejoy string) {
+		mailchimpAPIURL, cratejoyAPIURL = mailchimp, cratejoy
+	}(mailchimpAPIURL, cratejoyAPIURL)
+	if err := configureAPIURLs(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestAPIClient(3)
+	results := MailChimp(ctx, store, client, syncOptions{})
+	results = append(results, Cratejoy(ctx, store, client, syncOptions{})...)
+	if code := exitCode(results); code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %+v", exitOK, code, results)
+	}
+	for _, result := range results {
+		if result.Failed != 0 {
+			t.Errorf("%s %s: %d records failed", result.Source, result.Entity, result.Failed)
+		}
+	}
+
+	db := store.DB()
+	var members, subscriptions int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM mailchimp WHERE list_id = ?", "list1").Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if members != 25 {
+		t.Errorf("expected 25 members, got %d", members)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM cj_subscriptions WHERE id > ?", 900000000).Scan(&subscriptions); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions != 7 {
+		t.Errorf("expected 7 subscriptions, got %d", subscriptions)
+	}
+	if latest, err := store.LatestOrderPlacedAt(ctx); err != nil || latest.IsZero() {
+		t.Errorf("expected a latest order, got %v, %v", latest, err)
+	}
+
+	// Syncing the same data again leaves the Cratejoy rows as they are
+	for _, result := range Cratejoy(ctx, store, client, syncOptions{}) {
+		if result.Err != nil || result.Inserted != 0 || result.Updated != 0 || result.Unchanged != 7 {
+			t.Errorf("%s resync: %+v", result.Entity, result)
+		}
+	}
+}
+
+func TestMailchimpResumesFromCheckpointAgainstFake(t *testing.T) {
+	m := fake.NewMailchimp("test-key")
+	defer m.Close()
+	m.AddMembers("list1", fakeMembers(5)...)
+	store := newTestSQLiteStore(t)
+	f := newTestMailchimpFetcher(m.APIURL(), 0)
+
+	// Stop already requested: the first page is committed, then the run ends
+	stop := make(chan struct{})
+	close(stop)
+	stopped := processList(context.WithValue(context.Background(), stopKey{}, stop), store, f, "list1")
+	if !errors.Is(stopped.Err, errInterrupted) || stopped.Written != 2 {
+		t.Fatalf("expected an interrupted run with 2 members, got %+v", stopped)
+	}
+	ctx := context.Background()
+	if cursor, err := store.LoadCheckpoint(ctx, "mailchimp", "members:list1"); err != nil || cursor != "2" {
+		t.Fatalf("expected checkpoint 2, got %q, %v", cursor, err)
+	}
+
+	// The next run picks up at offset 2 and clears the checkpoint once done
+	resumed := processList(ctx, store, f, "list1")
+	if resumed.Err != nil || resumed.Fetched != 3 || resumed.Pages != 2 {
+		t.Fatalf("expected the remaining 3 members in 2 pages, got %+v", resumed)
+	}
+	if cursor, err := store.LoadCheckpoint(ctx, "mailchimp", "members:list1"); err != nil || cursor != "" {
+		t.Errorf("expected the checkpoint cleared, got %q, %v", cursor, err)
+	}
+	var members int
+	if err := store.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM mailchimp WHERE list_id = ?", "list1").Scan(&members); err != nil {
+		t.Fatal(err)
+	}
+	if members != 5 {
+		t.Errorf("expected 5 members stored, got %d", members)
+	}
+}
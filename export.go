@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/sirupsen/logrus"
+)
+
+// exporter writes what every run syncs to files under dir, one snapshot
+// directory per run:
+//
+//	<dir>/snapshot=20240501T120000Z-1a2b3c4d/
+//		manifest.json
+//		cj_orders/part-00000.parquet
+//		mailchimp/list_id=abc123/part-00000.parquet
+//
+// Only Mailchimp members are partitioned, by list_id; the Cratejoy tables are
+// written whole. The manifest is written last, so a snapshot without one is
+// incomplete.
+type exporter struct {
+	dir      string
+	format   exportFormat
+	partRows int  // rows per part file before starting the next one
+	only     bool // export instead of writing entities to the store
+}
+
+// configureExport reads EXPORT_DIR, where snapshots go (unset disables
+// exports), EXPORT_FORMAT (jsonl, csv or parquet; default jsonl),
+// EXPORT_MODE, "alongside" the store (default) or "only" to skip the entity
+// writes, and EXPORT_PART_ROWS (default 100000). Checkpoints, locks and run
+// history still need a store either way; in only mode the newest exported
+// order date is kept there too, since cj_orders is never written. Bulk loads
+// go straight to MySQL and cannot be exported.
+func configureExport() (*exporter, error) {
+	dir := envString("EXPORT_DIR", "")
+	if dir == "" {
+		return nil, nil
+	}
+	name := envString("EXPORT_FORMAT", "jsonl")
+	format, ok := exportFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid EXPORT_FORMAT %q, expected jsonl, csv or parquet", name)
+	}
+	partRows, err := envInt("EXPORT_PART_ROWS", 100000)
+	if err != nil {
+		return nil, err
+	}
+	if partRows <= 0 {
+		return nil, fmt.Errorf("EXPORT_PART_ROWS must be positive, got %d", partRows)
+	}
+	e := &exporter{dir: dir, format: format, partRows: partRows}
+	switch mode := envString("EXPORT_MODE", "alongside"); mode {
+	case "alongside":
+	case "only":
+		e.only = true
+	default:
+		return nil, fmt.Errorf("invalid EXPORT_MODE %q, expected alongside or only", mode)
+	}
+
+	log.WithFields(logrus.Fields{
+		"dir":    dir,
+		"format": name,
+		"only":   e.only,
+	}).Info("Exporting synced entities to files")
+	return e, nil
+}
+
+// wrap returns store with every upserted page also exported
+func (e *exporter) wrap(store Store) Store {
+	return &exportStore{Store: store, only: e.only}
+}
+
+// begin starts the snapshot of a run; nothing is created on disk until the
+// first rows are exported
+func (e *exporter) begin(runID string, startedAt time.Time) *exportSnapshot {
+	name := "snapshot=" + startedAt.UTC().Format("20060102T150405Z")
+	if len(runID) >= 8 {
+		name += "-" + runID[:8]
+	}
+	return &exportSnapshot{
+		exporter:  e,
+		runID:     runID,
+		dir:       filepath.Join(e.dir, name),
+		startedAt: startedAt,
+		tables:    make(map[string]*exportedTable),
+	}
+}
+
+type exportSnapshotKey struct{}
+
+// withExportSnapshot makes every page written under ctx part of snapshot
+func withExportSnapshot(ctx context.Context, snapshot *exportSnapshot) context.Context {
+	return context.WithValue(ctx, exportSnapshotKey{}, snapshot)
+}
+
+// exportSnapshotFrom returns the snapshot of ctx, nil when nothing is exported
+func exportSnapshotFrom(ctx context.Context) *exportSnapshot {
+	snapshot, _ := ctx.Value(exportSnapshotKey{}).(*exportSnapshot)
+	return snapshot
+}
+
+// exportStore writes pages to the store and then to the run's snapshot, or
+// only to the snapshot when exports replace the entity writes
+type exportStore struct {
+	Store
+	only bool
+}
+
+func (s *exportStore) UpsertMembers(ctx context.Context, listID string, members []Member) (rowCounts, error) {
+	counts, err := s.upsert(len(members), func() (rowCounts, error) {
+		return s.Store.UpsertMembers(ctx, listID, members)
+	})
+	if err != nil {
+		return counts, err
+	}
+	rows := make([][]interface{}, len(members))
+	for i, member := range members {
+		rows[i] = memberRow(listID, member)
+	}
+	table := exportTable{name: "mailchimp", columns: memberColumns}
+	return counts, exportSnapshotFrom(ctx).write(table, "list_id="+url.PathEscape(listID), rows)
+}
+
+func (s *exportStore) UpsertOrders(ctx context.Context, orders []Order) (rowCounts, error) {
+	counts, err := s.upsert(len(orders), func() (rowCounts, error) {
+		return s.Store.UpsertOrders(ctx, orders)
+	})
+	if err != nil {
+		return counts, err
+	}
+	rows := make([][]interface{}, len(orders))
+	for i, order := range orders {
+		if rows[i], err = orderRow(exportTimestamps{}, order); err != nil {
+			return counts, err
+		}
+	}
+	table := exportTable{name: "cj_orders", columns: orderColumns, distinct: true}
+	if err := exportSnapshotFrom(ctx).write(table, "", rows); err != nil {
+		return counts, err
+	}
+	if s.only {
+		return counts, s.advanceOrdersCursor(ctx, orders)
+	}
+	return counts, nil
+}
+
+// Checkpoint holding the newest exported placed_at, which stands in for
+// cj_orders when exports replace the entity writes
+const (
+	exportCursorSource = "export"
+	exportCursorOrders = "cratejoy:orders:placed_at"
+)
+
+// LatestOrderPlacedAt reads cj_orders, or in only mode the newest placed_at
+// exported so far, so incremental order fetches keep moving forward
+func (s *exportStore) LatestOrderPlacedAt(ctx context.Context) (time.Time, error) {
+	if !s.only {
+		return s.Store.LatestOrderPlacedAt(ctx)
+	}
+	cursor, err := s.LoadCheckpoint(ctx, exportCursorSource, exportCursorOrders)
+	if err != nil || cursor == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, cursor)
+}
+
+// advanceOrdersCursor moves the only mode placed_at cursor past orders
+func (s *exportStore) advanceOrdersCursor(ctx context.Context, orders []Order) error {
+	latest, err := s.LatestOrderPlacedAt(ctx)
+	if err != nil {
+		return err
+	}
+	advanced := false
+	for _, order := range orders {
+		placedAt, err := time.Parse(time.RFC3339, order.PlacedAt)
+		if err != nil {
+			return err
+		}
+		if placedAt.After(latest) {
+			latest, advanced = placedAt, true
+		}
+	}
+	if !advanced {
+		return nil
+	}
+	return s.SaveCheckpoint(ctx, exportCursorSource, exportCursorOrders, latest.UTC().Format(time.RFC3339))
+}
+
+func (s *exportStore) UpsertSubscriptions(ctx context.Context, subscriptions []Subscription) (rowCounts, error) {
+	counts, err := s.upsert(len(subscriptions), func() (rowCounts, error) {
+		return s.Store.UpsertSubscriptions(ctx, subscriptions)
+	})
+	if err != nil {
+		return counts, err
+	}
+	tableRows := make([][][]interface{}, len(subscriptionTables))
+	for _, subscription := range subscriptions {
+		rows, err := subscriptionRows(exportTimestamps{}, subscription)
+		if err != nil {
+			return counts, err
+		}
+		for i, row := range rows {
+			tableRows[i] = append(tableRows[i], row)
+		}
+	}
+	// Addresses, products and the like are shared by many subscriptions, each
+	// is exported once per snapshot
+	snapshot := exportSnapshotFrom(ctx)
+	for i, table := range subscriptionTables {
+		if err := snapshot.write(exportTable{name: table.name, columns: table.columns, distinct: true}, "", tableRows[i]); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// upsert runs the store write unless exports replace it, in which case every
+// record counts as inserted
+func (s *exportStore) upsert(records int, write func() (rowCounts, error)) (rowCounts, error) {
+	if s.only {
+		return rowCounts{Inserted: records}, nil
+	}
+	return write()
+}
+
+// exportTimestamps converts API dates into UTC times for the exported files
+type exportTimestamps struct{}
+
+func (exportTimestamps) timestamp(value string) (interface{}, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return t.UTC(), nil
+}
+
+// exportTable is one table of a snapshot
+type exportTable struct {
+	name    string
+	columns []string
+	// distinct exports only the last row seen for each id. Such tables are
+	// held in memory and written when the snapshot finishes.
+	distinct bool
+}
+
+// exportColumn is a column of an exported table. Its type is one of boolean,
+// int64, double, string or timestamp, widened from int64 to double and from
+// anything else to string when rows disagree. A streamed table that widens
+// starts new part files, and the manifest lists the columns of the earlier
+// ones with them.
+type exportColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// exportSnapshot collects the files of one run
+type exportSnapshot struct {
+	*exporter
+	runID     string
+	dir       string
+	startedAt time.Time
+
+	mu     sync.Mutex
+	tables map[string]*exportedTable
+}
+
+// exportedTable is the state of one table within a snapshot
+type exportedTable struct {
+	names   []string
+	columns []exportColumn
+	pending []exportRow            // rows of a distinct table, written on finish
+	index   map[interface{}]int    // position of each id in pending
+	parts   map[string]*exportPart // the open part of each partition
+	next    map[string]int         // the number of each partition's next part
+	files   []exportFile
+	rows    int
+}
+
+// write appends rows to table in partition, "" for none. It does nothing on
+// a nil snapshot, so runs without exports can call it unconditionally.
+func (s *exportSnapshot) write(table exportTable, partition string, rows [][]interface{}) error {
+	if s == nil || len(rows) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.tables[table.name]
+	if !ok {
+		state = &exportedTable{
+			names: table.columns,
+			index: make(map[interface{}]int),
+			parts: make(map[string]*exportPart),
+			next:  make(map[string]int),
+		}
+		s.tables[table.name] = state
+	}
+
+	if table.distinct {
+		for _, row := range rows {
+			id := exportValue(row[0])
+			if i, ok := state.index[id]; ok {
+				state.pending[i] = exportRow{partition: partition, values: row}
+				continue
+			}
+			state.index[id] = len(state.pending)
+			state.pending = append(state.pending, exportRow{partition: partition, values: row})
+		}
+		return nil
+	}
+
+	if state.columns == nil {
+		state.columns = inferExportColumns(table.columns, rows)
+	} else if widened, changed := widenExportColumns(state.columns, rows); changed {
+		// Earlier parts keep their columns; later rows go to new parts
+		for partition := range state.parts {
+			if err := s.closePart(state, partition); err != nil {
+				return err
+			}
+		}
+		state.columns = widened
+	}
+	for _, row := range rows {
+		if err := s.writeRow(table.name, state, partition, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportRow is a row waiting to be written to partition
+type exportRow struct {
+	partition string
+	values    []interface{}
+}
+
+// writeRow appends row to the open part of partition, starting a new part
+// when there is none and closing it once it is full
+func (s *exportSnapshot) writeRow(table string, state *exportedTable, partition string, row []interface{}) error {
+	part := state.parts[partition]
+	if part == nil {
+		var err error
+		if part, err = s.openPart(table, partition, state); err != nil {
+			return err
+		}
+	}
+	if err := part.write(state.columns, row); err != nil {
+		return fmt.Errorf("exporting %s: %w", table, err)
+	}
+	state.rows++
+	if part.rows >= s.partRows {
+		return s.closePart(state, partition)
+	}
+	return nil
+}
+
+// flushPending writes the rows a distinct table held back, typed after all
+// of them
+func (s *exportSnapshot) flushPending(table string, state *exportedTable) error {
+	if len(state.pending) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, len(state.pending))
+	for i, row := range state.pending {
+		rows[i] = row.values
+	}
+	state.columns = inferExportColumns(state.names, rows)
+	for _, row := range state.pending {
+		if err := s.writeRow(table, state, row.partition, row.values); err != nil {
+			return err
+		}
+	}
+	state.pending, state.index = nil, nil
+	return nil
+}
+
+// openPart starts the next part file of a table's partition
+func (s *exportSnapshot) openPart(table, partition string, state *exportedTable) (*exportPart, error) {
+	name := fmt.Sprintf("part-%05d.%s", state.next[partition], s.format.ext)
+	path := filepath.Join(table, partition, name)
+	full := filepath.Join(s.dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(full)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &exportPart{file: file, hash: sha256.New(), path: filepath.ToSlash(path), partition: partition, columns: state.columns}
+	if part.writer, err = s.format.open(part, state.columns); err != nil {
+		file.Close()
+		return nil, err
+	}
+	state.parts[partition] = part
+	state.next[partition]++
+	return part, nil
+}
+
+// closePart finishes the open part of a partition and adds it to the manifest
+func (s *exportSnapshot) closePart(state *exportedTable, partition string) error {
+	part := state.parts[partition]
+	delete(state.parts, partition)
+	if err := part.close(); err != nil {
+		return fmt.Errorf("closing %s: %w", part.path, err)
+	}
+	state.files = append(state.files, exportFile{
+		Path:      part.path,
+		Partition: part.partition,
+		Rows:      part.rows,
+		Bytes:     part.size,
+		SHA256:    hex.EncodeToString(part.hash.Sum(nil)),
+		Columns:   part.columns,
+	})
+	return nil
+}
+
+// exportManifest describes a finished snapshot
+type exportManifest struct {
+	RunID      string                `json:"run_id"`
+	Format     string                `json:"format"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	Entities   []exportEntity        `json:"entities"`
+	Tables     map[string]exportInfo `json:"tables"`
+}
+
+// exportEntity is how one entity of the run ended; a failed entity's tables
+// may be missing rows
+type exportEntity struct {
+	Source string `json:"source"`
+	Entity string `json:"entity"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type exportInfo struct {
+	Columns []exportColumn `json:"columns"`
+	Rows    int            `json:"rows"`
+	Files   []exportFile   `json:"files"`
+}
+
+type exportFile struct {
+	Path      string `json:"path"`
+	Partition string `json:"partition,omitempty"`
+	Rows      int    `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+	SHA256    string `json:"sha256"`
+	// Columns is set when the file has other columns than its table
+	Columns []exportColumn `json:"columns,omitempty"`
+}
+
+// finish closes every open part and writes the manifest. A run that exported
+// nothing leaves no snapshot behind.
+func (s *exportSnapshot) finish(results []syncResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tables) == 0 {
+		return nil
+	}
+
+	manifest := exportManifest{
+		RunID:      s.runID,
+		Format:     s.format.name,
+		StartedAt:  s.startedAt.UTC(),
+		FinishedAt: time.Now().UTC(),
+		Tables:     make(map[string]exportInfo),
+	}
+	for _, result := range results {
+		entity := exportEntity{Source: result.Source, Entity: result.Entity, Status: "ok"}
+		switch {
+		case result.Skipped:
+			entity.Status = "skipped"
+		case result.Err != nil:
+			entity.Status, entity.Error = "failed", redact(result.Err.Error())
+		}
+		manifest.Entities = append(manifest.Entities, entity)
+	}
+	for name, state := range s.tables {
+		if err := s.flushPending(name, state); err != nil {
+			return err
+		}
+		for partition := range state.parts {
+			if err := s.closePart(state, partition); err != nil {
+				return err
+			}
+		}
+		for i, file := range state.files {
+			if !widenedExportColumns(file.Columns, state.columns) {
+				state.files[i].Columns = nil
+			}
+		}
+		manifest.Tables[name] = exportInfo{Columns: state.columns, Rows: state.rows, Files: state.files}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Rename into place so readers never see half a manifest
+	tmp := filepath.Join(s.dir, "manifest.json.tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "manifest.json")); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"dir":    s.dir,
+		"tables": len(manifest.Tables),
+	}).Info("Finished export snapshot")
+	return nil
+}
+
+// exportPart is one open part file. Everything written to it is hashed and
+// counted for the manifest.
+type exportPart struct {
+	file      *os.File
+	hash      hash.Hash
+	size      int64
+	writer    rowWriter
+	path      string
+	partition string
+	columns   []exportColumn
+	rows      int
+}
+
+func (p *exportPart) Write(data []byte) (int, error) {
+	n, err := p.file.Write(data)
+	p.hash.Write(data[:n])
+	p.size += int64(n)
+	return n, err
+}
+
+func (p *exportPart) write(columns []exportColumn, row []interface{}) error {
+	values := make([]interface{}, len(row))
+	for i, value := range row {
+		var err error
+		if values[i], err = coerceExportValue(columns[i], value); err != nil {
+			return err
+		}
+	}
+	if err := p.writer.write(values); err != nil {
+		return err
+	}
+	p.rows++
+	return nil
+}
+
+func (p *exportPart) close() error {
+	if err := p.writer.close(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// inferExportColumns types each column after all its non-null values in
+// rows. Columns that are always null are strings.
+func inferExportColumns(names []string, rows [][]interface{}) []exportColumn {
+	columns := make([]exportColumn, len(names))
+	for i, name := range names {
+		kind := ""
+		for _, row := range rows {
+			kind = widenExportType(kind, exportType(exportValue(row[i])))
+		}
+		if kind == "" {
+			kind = "string"
+		}
+		columns[i] = exportColumn{Name: name, Type: kind}
+	}
+	return columns
+}
+
+// widenExportType is the narrowest type holding values of both a and b, ""
+// standing for null
+func widenExportType(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	case (a == "int64" && b == "double") || (a == "double" && b == "int64"):
+		return "double"
+	}
+	return "string"
+}
+
+// widenExportColumns widens columns to also hold the values of rows,
+// reporting whether any type changed. Columns inferred from nulls alone are
+// strings and take anything, so they never change.
+func widenExportColumns(columns []exportColumn, rows [][]interface{}) ([]exportColumn, bool) {
+	widened := append([]exportColumn(nil), columns...)
+	changed := false
+	for i := range widened {
+		for _, row := range rows {
+			if kind := widenExportType(widened[i].Type, exportType(exportValue(row[i]))); kind != widened[i].Type {
+				widened[i].Type = kind
+				changed = true
+			}
+		}
+	}
+	return widened, changed
+}
+
+// widenedExportColumns reports whether a file's columns differ from the final
+// columns of its table
+func widenedExportColumns(file, table []exportColumn) bool {
+	for i := range file {
+		if file[i].Type != table[i].Type {
+			return true
+		}
+	}
+	return false
+}
+
+// exportValue normalizes a row value to nil, bool, int64, float64, string or
+// a UTC time; anything else becomes its JSON text
+func exportValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int64, float64, string:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.UTC()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// exportType is the column type of a normalized value, "" for null
+func exportType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "boolean"
+	case int64:
+		return "int64"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case time.Time:
+		return "timestamp"
+	}
+	return ""
+}
+
+// coerceExportValue converts a row value to the type of its column
+func coerceExportValue(column exportColumn, value interface{}) (interface{}, error) {
+	value = exportValue(value)
+	kind := exportType(value)
+	switch {
+	case kind == "" || kind == column.Type:
+		return value, nil
+	case column.Type == "double" && kind == "int64":
+		return float64(value.(int64)), nil
+	case column.Type == "string":
+		return formatExportValue(value), nil
+	}
+	return nil, fmt.Errorf("column %s is %s, got %s", column.Name, column.Type, kind)
+}
+
+// formatExportValue renders a normalized value as text, "" for null
+func formatExportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// rowWriter encodes the rows of one part file
+type rowWriter interface {
+	write(row []interface{}) error
+	// close flushes the encoding; the file is closed by the caller
+	close() error
+}
+
+// exportFormat is a file format rows can be exported in
+type exportFormat struct {
+	name string
+	ext  string
+	open func(w io.Writer, columns []exportColumn) (rowWriter, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"jsonl":   {name: "jsonl", ext: "jsonl", open: newJSONLWriter},
+	"csv":     {name: "csv", ext: "csv", open: newCSVWriter},
+	"parquet": {name: "parquet", ext: "parquet", open: newParquetWriter},
+}
+
+// jsonlWriter writes one JSON object per line, keys in column order
+type jsonlWriter struct {
+	w       *bufio.Writer
+	columns []exportColumn
+}
+
+func newJSONLWriter(w io.Writer, columns []exportColumn) (rowWriter, error) {
+	return &jsonlWriter{w: bufio.NewWriter(w), columns: columns}, nil
+}
+
+func (j *jsonlWriter) write(row []interface{}) error {
+	j.w.WriteByte('{')
+	for i, value := range row {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		name, _ := json.Marshal(j.columns[i].Name)
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		j.w.Write(name)
+		j.w.WriteByte(':')
+		j.w.Write(data)
+	}
+	_, err := j.w.WriteString("}\n")
+	return err
+}
+
+func (j *jsonlWriter) close() error {
+	return j.w.Flush()
+}
+
+// csvWriter writes a header row and then one record per row, nulls empty
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer, columns []exportColumn) (rowWriter, error) {
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	c := &csvWriter{w: csv.NewWriter(w)}
+	return c, c.w.Write(header)
+}
+
+func (c *csvWriter) write(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, value := range row {
+		record[i] = formatExportValue(value)
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// parquetWriter writes Snappy compressed Parquet with every column optional
+type parquetWriter struct {
+	w      *parquet.Writer
+	leaves []int // schema column index of each exported column
+}
+
+func newParquetWriter(w io.Writer, columns []exportColumn) (rowWriter, error) {
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		var node parquet.Node
+		switch column.Type {
+		case "boolean":
+			node = parquet.Leaf(parquet.BooleanType)
+		case "int64":
+			node = parquet.Int(64)
+		case "double":
+			node = parquet.Leaf(parquet.DoubleType)
+		case "timestamp":
+			node = parquet.Timestamp(parquet.Microsecond)
+		default:
+			node = parquet.String()
+		}
+		group[column.Name] = parquet.Optional(node)
+	}
+	schema := parquet.NewSchema("row", group)
+
+	// The schema orders its columns by name
+	index := make(map[string]int)
+	for i, field := range schema.Fields() {
+		index[field.Name()] = i
+	}
+	leaves := make([]int, len(columns))
+	for i, column := range columns {
+		leaves[i] = index[column.Name]
+	}
+	return &parquetWriter{
+		w:      parquet.NewWriter(w, schema, parquet.Compression(&parquet.Snappy)),
+		leaves: leaves,
+	}, nil
+}
+
+func (p *parquetWriter) write(row []interface{}) error {
+	values := make(parquet.Row, len(row))
+	for i, value := range row {
+		leaf := p.leaves[i]
+		var v parquet.Value
+		switch value := value.(type) {
+		case nil:
+			values[leaf] = parquet.NullValue().Level(0, 0, leaf)
+			continue
+		case bool:
+			v = parquet.BooleanValue(value)
+		case int64:
+			v = parquet.Int64Value(value)
+		case float64:
+			v = parquet.DoubleValue(value)
+		case time.Time:
+			v = parquet.Int64Value(value.UnixMicro())
+		default:
+			v = parquet.ByteArrayValue([]byte(formatExportValue(value)))
+		}
+		values[leaf] = v.Level(0, 1, leaf)
+	}
+	_, err := p.w.WriteRows([]parquet.Row{values})
+	return err
+}
+
+func (p *parquetWriter) close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readManifest loads the manifest of the only snapshot under dir
+func readManifest(t *testing.T, dir string) (string, exportManifest) {
+	t.Helper()
+	snapshots, err := filepath.Glob(filepath.Join(dir, "snapshot=*"))
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("expected one snapshot, got %v, %v", snapshots, err)
+	}
+	data, err := os.ReadFile(filepath.Join(snapshots[0], "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest exportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return snapshots[0], manifest
+}
+
+func TestExportFormats(t *testing.T) {
+	placedAt := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	table := exportTable{name: "cj_orders", columns: []string{"id", "is_gift", "total", "note", "placed_at", "price"}}
+	rows := [][]interface{}{
+		{int64(1), true, 1500, "first", placedAt, 9.5},
+		{int64(2), false, 0, nil, nil, 10},
+	}
+
+	for name, format := range exportFormats {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			snapshot := (&exporter{dir: dir, format: format, partRows: 100}).begin("0123456789abcdef", placedAt)
+			if err := snapshot.write(table, "", rows); err != nil {
+				t.Fatal(err)
+			}
+			if err := snapshot.finish(nil); err != nil {
+				t.Fatal(err)
+			}
+			root, manifest := readManifest(t, dir)
+			info := manifest.Tables["cj_orders"]
+			wantColumns := []exportColumn{
+				{"id", "int64"}, {"is_gift", "boolean"}, {"total", "int64"},
+				{"note", "string"}, {"placed_at", "timestamp"}, {"price", "double"},
+			}
+			if !reflect.DeepEqual(info.Columns, wantColumns) {
+				t.Errorf("columns = %v", info.Columns)
+			}
+			if info.Rows != 2 || len(info.Files) != 1 {
+				t.Fatalf("unexpected manifest %+v", info)
+			}
+			path := filepath.Join(root, info.Files[0].Path)
+
+			switch name {
+			case "jsonl":
+				file, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				scanner := bufio.NewScanner(file)
+				var lines []string
+				for scanner.Scan() {
+					lines = append(lines, scanner.Text())
+				}
+				want := []string{
+					`{"id":1,"is_gift":true,"total":1500,"note":"first","placed_at":"2024-03-04T05:06:07Z","price":9.5}`,
+					`{"id":2,"is_gift":false,"total":0,"note":null,"placed_at":null,"price":10}`,
+				}
+				if !reflect.DeepEqual(lines, want) {
+					t.Errorf("lines = %q", lines)
+				}
+			case "csv":
+				file, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				records, err := csv.NewReader(file).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := [][]string{
+					{"id", "is_gift", "total", "note", "placed_at", "price"},
+					{"1", "true", "1500", "first", "2024-03-04T05:06:07Z", "9.5"},
+					{"2", "false", "0", "", "", "10"},
+				}
+				if !reflect.DeepEqual(records, want) {
+					t.Errorf("records = %q", records)
+				}
+			case "parquet":
+				file, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				reader := parquet.NewReader(file)
+				defer reader.Close()
+				if reader.NumRows() != 2 {
+					t.Fatalf("got %d rows", reader.NumRows())
+				}
+				read := make([]parquet.Row, 2)
+				if n, _ := reader.ReadRows(read); n != 2 {
+					t.Fatalf("read %d rows", n)
+				}
+				index := make(map[string]int)
+				for i, field := range reader.Schema().Fields() {
+					index[field.Name()] = i
+				}
+				first, second := read[0], read[1]
+				if first[index["total"]].Int64() != 1500 || first[index["price"]].Double() != 9.5 {
+					t.Errorf("first row = %v", first)
+				}
+				if got := first[index["placed_at"]].Int64(); got != placedAt.UnixMicro() {
+					t.Errorf("placed_at = %d", got)
+				}
+				if !second[index["note"]].IsNull() || second[index["price"]].Double() != 10 {
+					t.Errorf("second row = %v", second)
+				}
+			}
+		})
+	}
+}
+
+func TestExportPartsAndManifest(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := (&exporter{dir: dir, format: exportFormats["jsonl"], partRows: 2}).begin("0123456789abcdef", time.Now())
+	table := exportTable{name: "cj_products", columns: []string{"id", "name"}, distinct: true}
+	for _, page := range [][][]interface{}{
+		{{1, "box"}, {2, "crate"}, {1, "box"}},
+		{{3, "bag"}, {2, "crate"}, {4, "tin"}, {5, "jar"}},
+	} {
+		if err := snapshot.write(table, "", page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := exportTable{name: "mailchimp", columns: memberColumns}
+	if err := snapshot.write(members, "list_id=abc", [][]interface{}{memberRow("abc", Member{ContactID: "c1"})}); err != nil {
+		t.Fatal(err)
+	}
+	results := []syncResult{{Source: "cratejoy", Entity: "subscriptions"}, {Source: "mailchimp", Entity: "abc", Err: errLockHeld}}
+	if err := snapshot.finish(results); err != nil {
+		t.Fatal(err)
+	}
+
+	root, manifest := readManifest(t, dir)
+	if manifest.RunID != "0123456789abcdef" || manifest.Format != "jsonl" {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	if len(manifest.Entities) != 2 || manifest.Entities[1].Status != "failed" {
+		t.Errorf("entities = %+v", manifest.Entities)
+	}
+
+	products := manifest.Tables["cj_products"]
+	if products.Rows != 5 || len(products.Files) != 3 {
+		t.Fatalf("products = %+v", products)
+	}
+	for i, file := range products.Files {
+		data, err := os.ReadFile(filepath.Join(root, file.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if file.SHA256 != hex.EncodeToString(sum[:]) || file.Bytes != int64(len(data)) {
+			t.Errorf("file %d does not match its manifest entry", i)
+		}
+	}
+	if got := manifest.Tables["mailchimp"].Files[0].Path; got != "mailchimp/list_id=abc/part-00000.jsonl" {
+		t.Errorf("member file = %q", got)
+	}
+}
+
+// readJSONL decodes every line of an exported jsonl file
+func readJSONL(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestExportWidensColumnsAndKeepsLastRow(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := (&exporter{dir: dir, format: exportFormats["jsonl"], partRows: 100}).begin("0123456789abcdef", time.Now())
+	products := exportTable{name: "cj_products", columns: []string{"id", "price"}, distinct: true}
+	for _, page := range [][][]interface{}{
+		{{1, 5}, {2, 7}},
+		{{1, 4.5}},
+	} {
+		if err := snapshot.write(products, "", page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notes := exportTable{name: "notes", columns: []string{"id", "value"}}
+	for _, page := range [][][]interface{}{
+		{{1, 10}, {2, nil}},
+		{{3, "eleven"}},
+	} {
+		if err := snapshot.write(notes, "", page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := snapshot.finish(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	root, manifest := readManifest(t, dir)
+	exported := manifest.Tables["cj_products"]
+	if exported.Rows != 2 || exported.Columns[1].Type != "double" {
+		t.Fatalf("products = %+v", exported)
+	}
+	rows := readJSONL(t, filepath.Join(root, exported.Files[0].Path))
+	if len(rows) != 2 || rows[0]["price"] != 4.5 || rows[1]["price"] != 7.0 {
+		t.Errorf("expected the last price of product 1, got %v", rows)
+	}
+
+	// The streamed table widens to string and starts a new part
+	exported = manifest.Tables["notes"]
+	if exported.Rows != 3 || exported.Columns[1].Type != "string" || len(exported.Files) != 2 {
+		t.Fatalf("notes = %+v", exported)
+	}
+	if first := exported.Files[0].Columns; len(first) != 2 || first[1].Type != "int64" {
+		t.Errorf("expected the first part to keep its int64 column, got %+v", first)
+	}
+	if exported.Files[1].Columns != nil {
+		t.Errorf("expected the second part to have the table's columns, got %+v", exported.Files[1].Columns)
+	}
+}
+
+func TestExportStoreOnly(t *testing.T) {
+	sqlite := newTestSQLiteStore(t)
+	dir := t.TempDir()
+	exports := &exporter{dir: dir, format: exportFormats["csv"], partRows: 100, only: true}
+	store := exports.wrap(sqlite)
+	snapshot := exports.begin("0123456789abcdef", time.Now())
+	ctx := withExportSnapshot(context.Background(), snapshot)
+
+	product := Product{ID: 7, Name: "Monthly box"}
+	subscriptions := []Subscription{
+		{ID: 1, Product: product, StartDate: "2024-01-01T00:00:00Z", EndDate: "2024-02-01T00:00:00Z"},
+		{ID: 2, Product: product, StartDate: "2024-01-05T00:00:00-05:00", EndDate: "2024-02-05T00:00:00Z"},
+	}
+	counts, err := store.UpsertSubscriptions(ctx, subscriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (rowCounts{Inserted: 2}) {
+		t.Errorf("counts = %+v", counts)
+	}
+	if err := snapshot.finish(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, manifest := readManifest(t, dir)
+	if got := manifest.Tables["cj_subscriptions"].Rows; got != 2 {
+		t.Errorf("exported %d subscriptions", got)
+	}
+	if got := manifest.Tables["cj_products"].Rows; got != 1 {
+		t.Errorf("exported %d products, want the shared product once", got)
+	}
+
+	var stored int
+	if err := sqlite.DB().QueryRow("SELECT COUNT(*) FROM cj_subscriptions").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("export only mode wrote %d subscriptions to the store", stored)
+	}
+}
+
+func TestCoerceExportValue(t *testing.T) {
+	if got, err := coerceExportValue(exportColumn{"status", "string"}, 3); err != nil || got != "3" {
+		t.Errorf("int into string = %v, %v", got, err)
+	}
+	if got, err := coerceExportValue(exportColumn{"price", "double"}, 3); err != nil || got != 3.0 {
+		t.Errorf("int into double = %v, %v", got, err)
+	}
+	if got, err := coerceExportValue(exportColumn{"tags", "string"}, []string{"a"}); err != nil || got != `["a"]` {
+		t.Errorf("slice into string = %v, %v", got, err)
+	}
+	if _, err := coerceExportValue(exportColumn{"total", "int64"}, "many"); err == nil {
+		t.Error("expected an error for text in an integer column")
+	}
+}
+
+func TestExportOnlyKeepsOrdersCursor(t *testing.T) {
+	sqlite := newTestSQLiteStore(t)
+	exports := &exporter{dir: t.TempDir(), format: exportFormats["jsonl"], partRows: 100, only: true}
+	store := exports.wrap(sqlite)
+	ctx := withExportSnapshot(context.Background(), exports.begin("0123456789abcdef", time.Now()))
+
+	if latest, err := store.LatestOrderPlacedAt(ctx); err != nil || !latest.IsZero() {
+		t.Fatalf("latest before any export = %v, %v", latest, err)
+	}
+	for _, orders := range [][]Order{
+		{{ID: 1, PlacedAt: "2024-03-01T10:00:00Z"}, {ID: 2, PlacedAt: "2024-03-02T10:00:00-05:00"}},
+		{{ID: 3, PlacedAt: "2024-02-01T00:00:00Z"}},
+	} {
+		if _, err := store.UpsertOrders(ctx, orders); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	latest, err := store.LatestOrderPlacedAt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC); !latest.Equal(want) {
+		t.Errorf("latest = %v, want %v", latest, want)
+	}
+	if latest, err := sqlite.LatestOrderPlacedAt(ctx); err != nil || !latest.IsZero() {
+		t.Errorf("cj_orders was written: %v, %v", latest, err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errNoFixture is returned when replaying a request that was never recorded
+var errNoFixture = errors.New("no recorded response")
+
+// fixture is one recorded request/response pair, stored as a JSON file
+type fixture struct {
+	Request  fixtureRequest  `json:"request"`
+	Response fixtureResponse `json:"response"`
+}
+
+type fixtureRequest struct {
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	URL    string      `json:"url"` // path and query, the host is not matched on replay
+	Header http.Header `json:"header,omitempty"`
+}
+
+type fixtureResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+}
+
+// recordingTransport writes every request/response pair that passes through
+// it to dir as a numbered fixture, scrubbed of credentials and personal data.
+// Retries are separate round trips, so rate-limited and failed attempts are
+// recorded too and replay the same way.
+type recordingTransport struct {
+	next  http.RoundTripper
+	dir   string
+	scrub *scrubber
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newRecordingTransport(next http.RoundTripper, dir string) (*recordingTransport, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	scrub, err := newScrubber()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTransport{next: next, dir: dir, scrub: scrub}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Buffer the body to record it, handing the caller an unscrubbed copy
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	f := fixture{
+		Request: fixtureRequest{
+			Method: req.Method,
+			Host:   req.URL.Host,
+			URL:    t.scrub.text(req.URL.RequestURI()),
+			Header: t.scrub.header(req.Header),
+		},
+		Response: fixtureResponse{
+			Status: resp.StatusCode,
+			Header: t.scrub.header(resp.Header),
+			Body:   t.scrub.body(body),
+		},
+	}
+	if err := t.write(f); err != nil {
+		log.WithError(err).Warn("Failed to write HTTP fixture")
+	}
+	return resp, nil
+}
+
+// write saves a fixture under the next sequence number so replay order
+// follows recording order
+func (t *recordingTransport) write(f fixture) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.seq++
+	name := fmt.Sprintf("%05d-%s.json", t.seq, fixtureSlug(f.Request))
+	t.mu.Unlock()
+
+	return os.WriteFile(filepath.Join(t.dir, name), append(data, '\n'), 0o644)
+}
+
+// fixtureSlug turns "GET /v1/orders/?limit=150" into "get-v1-orders"
+func fixtureSlug(req fixtureRequest) string {
+	path, _, _ := strings.Cut(req.URL, "?")
+	slug := strings.ToLower(req.Method) + "-" + strings.Trim(nonSlug.ReplaceAllString(path, "-"), "-")
+	if len(slug) > 80 {
+		slug = slug[:80]
+	}
+	return slug
+}
+
+var nonSlug = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// replayTransport serves recorded fixtures without touching the network.
+//
+// A request gets the first unused fixture with the same method, path and
+// query, so repeated requests such as retries get their responses in
+// recording order. When none is left it falls back to the first unused
+// fixture with the same method and path, which covers queries that depend on
+// the database, like Cratejoy's placed_at__gt filter. Anything else fails
+// with errNoFixture.
+type replayTransport struct {
+	mu       sync.Mutex
+	fixtures []fixture
+	used     []bool
+}
+
+// loadFixtures reads every fixture in dir in file name order
+func loadFixtures(dir string) (*replayTransport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no fixtures in %s", dir)
+	}
+	sort.Strings(paths)
+
+	t := &replayTransport{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("reading fixture %s: %w", path, err)
+		}
+		t.fixtures = append(t.fixtures, f)
+	}
+	t.used = make([]bool, len(t.fixtures))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	f, ok := t.next(req.Method, req.URL.RequestURI())
+	if !ok {
+		return nil, fmt.Errorf("%w for %s %s", errNoFixture, req.Method, req.URL.RequestURI())
+	}
+
+	header := f.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Response.Status, http.StatusText(f.Response.Status)),
+		StatusCode:    f.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(f.Response.Body)),
+		ContentLength: int64(len(f.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// next claims the fixture for a request, see replayTransport
+func (t *replayTransport) next(method, uri string) (fixture, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path, _, _ := strings.Cut(uri, "?")
+	fallback := -1
+	for i, f := range t.fixtures {
+		if t.used[i] || f.Request.Method != method {
+			continue
+		}
+		if f.Request.URL == uri {
+			t.used[i] = true
+			return f, true
+		}
+		if recorded, _, _ := strings.Cut(f.Request.URL, "?"); fallback < 0 && recorded == path {
+			fallback = i
+		}
+	}
+	if fallback < 0 {
+		return fixture{}, false
+	}
+	t.used[fallback] = true
+	return t.fixtures[fallback], true
+}
+
+// configureFixtures records the shared client's traffic to opts.Record or
+// replays it from opts.Replay. Replays skip rate limiting, there is no API
+// to protect.
+func configureFixtures(client *apiClient, opts syncOptions) error {
+	switch {
+	case opts.Record != "" && opts.Replay != "":
+		return errors.New("-record and -replay cannot be combined")
+	case opts.Record != "":
+		recorder, err := newRecordingTransport(client.httpClient.Transport, opts.Record)
+		if err != nil {
+			return err
+		}
+		client.httpClient.Transport = recorder
+		log.WithField("dir", opts.Record).Info("Recording API fixtures")
+	case opts.Replay != "":
+		replayer, err := loadFixtures(opts.Replay)
+		if err != nil {
+			return err
+		}
+		client.httpClient.Transport = replayer
+		client.defaultRate = 0
+		client.hostRates = nil
+		log.WithFields(logrus.Fields{
+			"dir":      opts.Replay,
+			"fixtures": len(replayer.fixtures),
+		}).Info("Replaying API fixtures")
+	}
+	return nil
+}
+
+// scrubber replaces credentials and personal data in fixtures. Pseudonyms are
+// an HMAC of the original under a random key made for each recording and
+// never saved, so a customer keeps one pseudonym throughout a recording while
+// nobody can recover names or emails by hashing candidates.
+type scrubber struct {
+	key []byte
+}
+
+func newScrubber() (*scrubber, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &scrubber{key: key}, nil
+}
+
+// Headers that carry credentials or session state
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+// Headers dropped from fixtures, they change from run to run or no longer
+// match the scrubbed body
+var volatileHeaders = []string{"Content-Length", "Date", "Age", "X-Request-Id", "Cf-Ray"}
+
+// header copies a header without credentials or volatile values
+func (s *scrubber) header(header http.Header) http.Header {
+	scrubbed := header.Clone()
+	for _, name := range volatileHeaders {
+		scrubbed.Del(name)
+	}
+	for _, name := range sensitiveHeaders {
+		if scrubbed.Get(name) != "" {
+			scrubbed.Set(name, redactedText)
+		}
+	}
+	for name, values := range scrubbed {
+		for i, value := range values {
+			values[i] = s.text(value)
+		}
+		scrubbed[name] = values
+	}
+	if len(scrubbed) == 0 {
+		return nil
+	}
+	return scrubbed
+}
+
+// Fields holding names, addresses, free text and network details about a
+// person. Values are replaced with a pseudonym derived from the original, so
+// the same customer gets the same pseudonym in every record of a recording.
+var personalFields = map[string]string{
+	"full_name":           "name",
+	"first_name":          "name",
+	"last_name":           "name",
+	"billing_name":        "name",
+	"gift_recipient_name": "name",
+	"to":                  "name",
+	"company":             "company",
+	"street":              "street",
+	"unit":                "unit",
+	"phone_number":        "phone",
+	"zip_code":            "zip",
+	"gift_message":        "message",
+	"note":                "note",
+	"location":            "location",
+	"unique_email_id":     "email-id",
+	"ip_signup":           "ip",
+	"ip_opt":              "ip",
+}
+
+// Objects whose fields are all personal: Mailchimp merge fields are free-form
+// and may hold a whole address, and a member's location pins them on a map.
+// Numbers in them are zeroed.
+var personalObjects = map[string]string{
+	"merge_fields": "merge",
+	"ADDRESS":      "address",
+	"location":     "location",
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// Mailchimp addresses members by the MD5 of their lowercased email, in member
+// ids and in /members/{hash} URLs
+var memberHashPattern = regexp.MustCompile(`(?i)(/members/)([0-9a-f]{32})\b`)
+
+// body scrubs a JSON body field by field, and any other body as text
+func (s *scrubber) body(body []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return s.text(string(body))
+	}
+
+	scrubbed, err := json.Marshal(s.value("", "", value))
+	if err != nil {
+		return s.text(string(body))
+	}
+	return string(scrubbed)
+}
+
+// value scrubs a decoded JSON value found under key in the object parent
+func (s *scrubber) value(parent, key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, item := range v {
+			v[field] = s.value(key, field, item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = s.value(parent, key, item)
+		}
+		return v
+	case string:
+		if kind, ok := personalObjects[parent]; ok {
+			return s.pseudonym(kind, v)
+		}
+		if kind, ok := personalFields[key]; ok {
+			return s.pseudonym(kind, v)
+		}
+		// A customer's name is a person, a product's is not
+		if parent == "customer" && key == "name" {
+			return s.pseudonym("name", v)
+		}
+		// A member's id is the hash of their email, scrubbed like in URLs
+		if parent == "members" && key == "id" {
+			return s.memberHash(v)
+		}
+		return s.text(v)
+	case json.Number:
+		if _, ok := personalObjects[parent]; ok {
+			return json.Number("0")
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// text replaces email addresses and member hashes with pseudonyms and
+// redacts secrets
+func (s *scrubber) text(text string) string {
+	text = emailPattern.ReplaceAllStringFunc(text, func(email string) string {
+		return s.pseudonym("user", strings.ToLower(email)) + "@example.com"
+	})
+	text = memberHashPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := memberHashPattern.FindStringSubmatch(match)
+		return parts[1] + s.memberHash(parts[2])
+	})
+	return redact(text)
+}
+
+// memberHash pseudonymises a Mailchimp member hash, the same way in bodies
+// and URLs so recorded links still point at the recorded member
+func (s *scrubber) memberHash(hash string) string {
+	return s.pseudonym("member", strings.ToLower(hash))
+}
+
+// pseudonym derives a placeholder such as "name-1a2b3c4d5e6f7a8b" from value
+func (s *scrubber) pseudonym(kind, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mailchimp/internal/fake"
+)
+
+func TestScrubBody(t *testing.T) {
+	body := `{"results":[{"id":12345678901234,"billing_name":"Ada Lovelace","note":"call ada@example.org",` +
+		`"customer":{"name":"Ada Lovelace","email":"Ada@Example.org","first_name":"Ada","country":"GB"},` +
+		`"address":{"street":"12 St James's Square","city":"London","zip_code":"SW1Y 4JH"},` +
+		`"product":{"name":"Monthly Box","flat_ship_price":4.5}}],` +
+		`"members":[{"email_address":"ada@example.org","merge_fields":{"FNAME":"Ada","ADDRESS":{"addr1":"12 St James's Square"}}}]}`
+
+	var scrubbed struct {
+		Results []Subscription `json:"results"`
+		Members []struct {
+			Email       string `json:"email_address"`
+			MergeFields struct {
+				FName   string            `json:"FNAME"`
+				Address map[string]string `json:"ADDRESS"`
+			} `json:"merge_fields"`
+		} `json:"members"`
+	}
+	out := (&scrubber{key: []byte("test key")}).body([]byte(body))
+	if err := json.Unmarshal([]byte(out), &scrubbed); err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"Ada", "Lovelace", "ada@", "James", "SW1Y"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("scrubbed body still contains %q: %s", leaked, out)
+		}
+	}
+
+	s := scrubbed.Results[0]
+	if s.Customer.Email != scrubbed.Members[0].Email || !strings.HasSuffix(s.Customer.Email, "@example.com") {
+		t.Errorf("expected the same pseudonymous email everywhere, got %q and %q", s.Customer.Email, scrubbed.Members[0].Email)
+	}
+	if s.BillingName != s.Customer.Name || !strings.HasPrefix(s.BillingName, "name-") {
+		t.Errorf("expected matching name pseudonyms, got %q and %q", s.BillingName, s.Customer.Name)
+	}
+	if s.Product.Name != "Monthly Box" || s.Product.FlatShipPrice != 4.5 || s.Address.City != "London" || s.Customer.Country != "GB" {
+		t.Errorf("non-personal fields changed: %+v", s)
+	}
+	if !strings.Contains(out, "12345678901234") {
+		t.Errorf("large ids must survive scrubbing: %s", out)
+	}
+	if scrubbed.Members[0].MergeFields.FName == "" || scrubbed.Members[0].MergeFields.Address["addr1"] == "" {
+		t.Errorf("merge fields should be pseudonymised, not dropped: %+v", scrubbed.Members[0])
+	}
+}
+
+func TestScrubMailchimpMember(t *testing.T) {
+	// Stands in for the MD5 of a member's email, as ids and URLs carry it
+	const hash = "6a4a4ba6e1e3e1a1b6a8d5a4e2b5c2d1"
+	body := `{"members":[{"id":"` + hash + `","unique_email_id":"a1b2c3d4e5","ip_signup":"203.0.113.7",` +
+		`"ip_opt":"203.0.113.8","location":{"latitude":51.5072,"longitude":-0.1276,"country_code":"GB","timezone":"Europe/London"},` +
+		`"_links":[{"href":"https://us6.api.mailchimp.com/3.0/lists/abc/members/` + hash + `"}]}]}`
+
+	scrub := &scrubber{key: []byte("test key")}
+	out := scrub.body([]byte(body))
+	for _, leaked := range []string{hash, "a1b2c3d4e5", "203.0.113", "51.5072", "0.1276", "Europe/London"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("scrubbed body still contains %q: %s", leaked, out)
+		}
+	}
+	url := scrub.text("/3.0/lists/abc/members/" + strings.ToUpper(hash) + "/notes")
+	if want := "/3.0/lists/abc/members/" + scrub.memberHash(hash) + "/notes"; url != want {
+		t.Errorf("url = %q, want %q", url, want)
+	}
+	if !strings.Contains(out, `"id":"`+scrub.memberHash(hash)+`"`) {
+		t.Errorf("member id and URL should get the same pseudonym: %s", out)
+	}
+
+	// Without the recording's key a pseudonym cannot be matched to a candidate
+	other := &scrubber{key: []byte("another key")}
+	if other.pseudonym("name", "Ada Lovelace") == scrub.pseudonym("name", "Ada Lovelace") {
+		t.Error("pseudonyms must depend on the key")
+	}
+}
+
+func TestScrubHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	header.Set("Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+	header.Set("Content-Type", "application/json")
+
+	scrubbed := (&scrubber{key: []byte("test key")}).header(header)
+	if scrubbed.Get("Authorization") != redactedText || scrubbed.Get("Date") != "" || scrubbed.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected header %v", scrubbed)
+	}
+	if header.Get("Authorization") == redactedText {
+		t.Error("the original header must not be modified")
+	}
+}
+
+func TestRecordAndReplayCratejoy(t *testing.T) {
+	dir := t.TempDir()
+	c := fake.NewCratejoy("client", "secret-password")
+	for i := 1; i <= 3; i++ {
+		c.AddSubscriptions(Subscription{
+			ID:       i,
+			Customer: Customer{Name: "Grace Hopper", Email: "grace@example.net"},
+		})
+	}
+	c.FailNext(1, http.StatusServiceUnavailable)
+
+	recorder, err := newRecordingTransport(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestAPIClient(2)
+	client.httpClient.Transport = recorder
+
+	var recorded []Subscription
+	p := newMemoryPipeline(client, c, "subscriptions", &recorded)
+	url := p.baseURL + "?limit=2"
+	if result := p.run(context.Background(), url); result.Err != nil || result.Written != 3 {
+		t.Fatalf("recording run failed: %+v", result)
+	}
+	c.Close()
+
+	// The failed attempt is recorded alongside the two pages
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 3 {
+		t.Fatalf("expected 3 fixtures, got %d", len(files))
+	}
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, leaked := range []string{"grace@", "Grace Hopper", "secret-password"} {
+			if strings.Contains(string(data), leaked) {
+				t.Errorf("%s contains %q", file, leaked)
+			}
+		}
+	}
+
+	replayer, err := loadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = newTestAPIClient(2)
+	client.httpClient.Transport = replayer
+	var replayed []Subscription
+	p = newMemoryPipeline(client, c, "subscriptions", &replayed)
+	result := p.run(context.Background(), url)
+	if result.Err != nil || result.Pages != 2 || result.Written != 3 {
+		t.Fatalf("unexpected replay result %+v", result)
+	}
+	if replayed[0].Customer.Email == "grace@example.net" || !strings.HasSuffix(replayed[0].Customer.Email, "@example.com") {
+		t.Errorf("expected a scrubbed email, got %q", replayed[0].Customer.Email)
+	}
+
+	// Every fixture is used up, so another run has nothing to replay
+	result = p.run(context.Background(), url)
+	if !errors.Is(result.Err, errNoFixture) {
+		t.Errorf("expected errNoFixture, got %v", result.Err)
+	}
+}
+
+func TestReplayFallsBackToPath(t *testing.T) {
+	replayer := &replayTransport{
+		fixtures: []fixture{
+			{Request: fixtureRequest{Method: "GET", URL: "/v1/orders/?placed_at__gt=2024-01-01T00:00:00Z&limit=150"}, Response: fixtureResponse{Status: 200}},
+			{Request: fixtureRequest{Method: "GET", URL: "/v1/orders/?limit=150&page=2"}, Response: fixtureResponse{Status: 200}},
+		},
+		used: make([]bool, 2),
+	}
+
+	if _, ok := replayer.next("GET", "/v1/orders/?limit=150&page=2"); !ok || !replayer.used[1] {
+		t.Error("expected the exact match to win")
+	}
+	if _, ok := replayer.next("GET", "/v1/orders/?placed_at__gt=2024-06-01T00:00:00Z&limit=150"); !ok || !replayer.used[0] {
+		t.Error("expected a fallback to the same path")
+	}
+	if _, ok := replayer.next("GET", "/v1/orders/?limit=150"); ok {
+		t.Error("expected no fixture left")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheck is one named probe. Cached checks, the ones that call an
+// external API, reuse their last result for the handler's TTL so frequent
+// probes do not eat into API rate limits.
+type healthCheck struct {
+	name   string
+	cached bool
+	check  func(ctx context.Context) error
+}
+
+// checkResult is the JSON detail of one check
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+
+	checkedAt time.Time
+}
+
+// healthReport is the JSON body of /healthz and /readyz
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthHandler runs its checks concurrently and answers 200 when all pass,
+// 503 otherwise
+type healthHandler struct {
+	checks  []healthCheck
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]checkResult
+}
+
+func newHealthHandler(timeout, ttl time.Duration, checks ...healthCheck) *healthHandler {
+	return &healthHandler{
+		checks:  checks,
+		timeout: timeout,
+		ttl:     ttl,
+		cache:   make(map[string]checkResult),
+	}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult, len(h.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			result := h.run(r.Context(), check)
+			mu.Lock()
+			report.Checks[check.name] = result
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range report.Checks {
+		if result.Status != "ok" {
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// run executes a check, or returns its cached result while still fresh
+func (h *healthHandler) run(ctx context.Context, check healthCheck) checkResult {
+	if check.cached {
+		h.mu.Lock()
+		result, ok := h.cache[check.name]
+		h.mu.Unlock()
+		if ok && time.Since(result.checkedAt) < h.ttl {
+			return result
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	startTime := time.Now()
+	err := check.check(ctx)
+
+	result := checkResult{
+		Status:    "ok",
+		Duration:  time.Since(startTime).Round(time.Millisecond).String(),
+		checkedAt: startTime,
+	}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = redact(err.Error())
+		log.WithField("check", check.name).WithError(err).Warn("Health check failed")
+	}
+
+	if check.cached {
+		h.mu.Lock()
+		h.cache[check.name] = result
+		h.mu.Unlock()
+	}
+	return result
+}
+
+// newHealthHandlers builds /healthz and /readyz for serve.
+//
+// /healthz only needs the process and a database ping. /readyz also checks the
+// Mailchimp and Cratejoy credentials and that none of the scheduled entities,
+// named as in sync_runs, has a last successful sync older than
+// READY_MAX_STALENESS (default 6h, 0 disables). Checks time out after
+// HEALTH_TIMEOUT (default 5s) and API checks are cached for HEALTH_CACHE_TTL
+// (default 1m).
+func newHealthHandlers(env *syncEnv, scheduled []string) (healthz, readyz http.Handler, err error) {
+	timeout, err := envDuration("HEALTH_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	ttl, err := envDuration("HEALTH_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, nil, err
+	}
+	maxStaleness, err := envDuration("READY_MAX_STALENESS", 6*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	database := healthCheck{name: "database", check: env.store.DB().PingContext}
+	healthz = newHealthHandler(timeout, ttl, database)
+
+	started := time.Now()
+	readyz = newHealthHandler(timeout, ttl,
+		database,
+		healthCheck{name: "mailchimp", cached: true, check: func(ctx context.Context) error {
+			return pingMailchimp(ctx, env.client, mailchimpAPIURL, loadSecret("apiKey"))
+		}},
+		healthCheck{name: "cratejoy", cached: true, check: func(ctx context.Context) error {
+			return pingCratejoy(ctx, env.client, cratejoyAPIURL, loadSecret("CRATEJOY_CLIENT"), loadSecret("CRATEJOY_API_KEY"))
+		}},
+		healthCheck{name: "freshness", check: func(ctx context.Context) error {
+			if maxStaleness <= 0 {
+				return nil
+			}
+			return checkFreshness(ctx, env.store.DB(), scheduled, started, maxStaleness)
+		}},
+	)
+	return healthz, readyz, nil
+}
+
+// pingMailchimp validates the API key against Mailchimp's /ping
+func pingMailchimp(ctx context.Context, client *apiClient, baseURL, apiKey string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("username", apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return parseMailchimpError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// pingCratejoy validates the credentials with the smallest possible order page
+func pingCratejoy(ctx context.Context, client *apiClient, baseURL, username, password string) error {
+	resp, err := sendCratejoyRequest(ctx, client, baseURL+"/orders/?limit=1", username, password)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkFreshness fails when one of entities, "source entity" names as in
+// sync_runs, has not synced successfully within maxStaleness. Entities that
+// never succeeded are measured from started, the process start, so a fresh
+// deployment gets a chance to run first. Other entities in sync_runs, such as
+// deleted lists or unscheduled entities, are ignored. Only rows without an
+// error count as successes; entities skipped for a busy lock are never
+// recorded, so a skip cannot pass for a sync.
+func checkFreshness(ctx context.Context, db *sql.DB, entities []string, started time.Time, maxStaleness time.Duration) error {
+	lastSuccess := make(map[string]time.Time, len(entities))
+	for _, entity := range entities {
+		lastSuccess[entity] = time.Time{}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT source, entity, MAX(CASE WHEN error IS NULL THEN finished_at END)
+		FROM sync_runs
+		GROUP BY source, entity`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var source, entity string
+		var finishedAt dbTime
+		if err := rows.Scan(&source, &entity, &finishedAt); err != nil {
+			return err
+		}
+		if _, ok := lastSuccess[source+" "+entity]; ok {
+			lastSuccess[source+" "+entity] = finishedAt.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if stale := staleEntities(lastSuccess, started, time.Now(), maxStaleness); len(stale) > 0 {
+		return fmt.Errorf("no successful sync within %s: %s", maxStaleness, strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// staleEntities lists the entities whose last success, or started for those
+// that never succeeded, is more than maxStaleness before now
+func staleEntities(lastSuccess map[string]time.Time, started, now time.Time, maxStaleness time.Duration) []string {
+	var stale []string
+	for entity, at := range lastSuccess {
+		if at.IsZero() {
+			at = started
+		}
+		if now.Sub(at) > maxStaleness {
+			stale = append(stale, entity)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
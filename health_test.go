@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, handler http.Handler) (int, healthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var report healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestHealthHandlerReportsFailures(t *testing.T) {
+	ok := healthCheck{name: "database", check: func(ctx context.Context) error { return nil }}
+	failing := healthCheck{name: "mailchimp", check: func(ctx context.Context) error {
+		return errors.New("API Key Invalid")
+	}}
+
+	code, report := getHealth(t, newHealthHandler(time.Second, time.Minute, ok))
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("healthy handler = %d %q", code, report.Status)
+	}
+
+	code, report = getHealth(t, newHealthHandler(time.Second, time.Minute, ok, failing))
+	if code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Errorf("failing handler = %d %q", code, report.Status)
+	}
+	if report.Checks["mailchimp"].Error != "API Key Invalid" || report.Checks["database"].Status != "ok" {
+		t.Errorf("unexpected checks %+v", report.Checks)
+	}
+}
+
+func TestHealthHandlerCachesAPIChecks(t *testing.T) {
+	var calls int32
+	check := healthCheck{name: "cratejoy", cached: true, check: func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}}
+	handler := newHealthHandler(time.Second, time.Minute, check)
+	getHealth(t, handler)
+	getHealth(t, handler)
+	if calls != 1 {
+		t.Errorf("cached check ran %d times, want 1", calls)
+	}
+}
+
+func TestPingMailchimp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, key, _ := r.BasicAuth(); key != "good-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"title":"API Key Invalid","status":401,"detail":"Your API key may be invalid."}`))
+			return
+		}
+		w.Write([]byte(`{"health_status":"Everything's Chimpy!"}`))
+	}))
+	defer server.Close()
+
+	client := newTestAPIClient(0)
+	if err := pingMailchimp(context.Background(), client, server.URL, "good-key"); err != nil {
+		t.Errorf("valid key: %v", err)
+	}
+	var problem *MailchimpError
+	if err := pingMailchimp(context.Background(), client, server.URL, "bad-key"); !errors.As(err, &problem) || problem.Status != 401 {
+		t.Errorf("invalid key: %v", err)
+	}
+}
+
+func TestStaleEntities(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	started := now.Add(-time.Hour)
+	lastSuccess := map[string]time.Time{
+		"cratejoy orders":        now.Add(-30 * time.Minute),
+		"cratejoy subscriptions": now.Add(-3 * time.Hour),
+		"mailchimp members:abc":  {}, // never succeeded, measured from the process start
+	}
+
+	got := staleEntities(lastSuccess, started, now, 2*time.Hour)
+	if want := []string{"cratejoy subscriptions"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("staleEntities = %v, want %v", got, want)
+	}
+}
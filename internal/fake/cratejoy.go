@@ -0,0 +1,185 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cratejoy emulates the Cratejoy orders and subscriptions endpoints:
+// GET /v1/orders/ and GET /v1/subscriptions/ with limit/page pagination, a
+// relative next link and placed_at__gt filtering of orders. Requests must use
+// HTTP basic auth with Username and Password.
+//
+// Records are stored as given and served as JSON, so tests can pass the
+// sync's own Order and Subscription values.
+type Cratejoy struct {
+	*httptest.Server
+	Username string
+	Password string
+
+	mu            sync.Mutex
+	orders        []json.RawMessage
+	subscriptions []json.RawMessage
+	failures      []failure
+	requests      int
+}
+
+// NewCratejoy starts a fake Cratejoy API accepting username and password
+func NewCratejoy(username, password string) *Cratejoy {
+	c := &Cratejoy{Username: username, Password: password}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	return c
+}
+
+// APIURL is the base URL to configure in place of https://api.cratejoy.com/v1
+func (c *Cratejoy) APIURL() string {
+	return c.URL + "/v1"
+}
+
+// AddOrders appends orders; each must marshal to an object with placed_at
+func (c *Cratejoy) AddOrders(orders ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orders = append(c.orders, mustMarshal(orders)...)
+}
+
+// AddSubscriptions appends subscriptions
+func (c *Cratejoy) AddSubscriptions(subscriptions ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = append(c.subscriptions, mustMarshal(subscriptions)...)
+}
+
+// FailNext makes the next n requests fail with status, typically a 5xx
+func (c *Cratejoy) FailNext(n, status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < n; i++ {
+		c.failures = append(c.failures, failure{status: status})
+	}
+}
+
+// Requests returns how many requests the server has received
+func (c *Cratejoy) Requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+func (c *Cratejoy) serve(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+
+	if len(c.failures) > 0 {
+		f := c.failures[0]
+		c.failures = c.failures[1:]
+		http.Error(w, http.StatusText(f.status), f.status)
+		return
+	}
+	if username, password, ok := r.BasicAuth(); !ok || username != c.Username || password != c.Password {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":["Invalid credentials"]}`))
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/orders/":
+		c.servePage(w, r, filterPlacedAfter(c.orders, r.URL.Query().Get("placed_at__gt")))
+	case "/v1/subscriptions/":
+		c.servePage(w, r, c.subscriptions)
+	default:
+		http.Error(w, `{"errors":["Not found"]}`, http.StatusNotFound)
+	}
+}
+
+// servePage writes one page of records with a next link relative to the endpoint
+func (c *Cratejoy) servePage(w http.ResponseWriter, r *http.Request, records []json.RawMessage) {
+	limit := queryInt(r, "limit", 20)
+	if limit < 1 {
+		limit = 20
+	}
+	page := queryInt(r, "page", 1)
+	if page < 1 {
+		page = 1
+	}
+
+	start := (page - 1) * limit
+	end := start + limit
+	if start > len(records) {
+		start = len(records)
+	}
+	if end > len(records) {
+		end = len(records)
+	}
+
+	next := ""
+	if end < len(records) {
+		query := r.URL.Query()
+		query.Set("page", fmt.Sprint(page+1))
+		next = "?" + query.Encode()
+	}
+	var prev interface{}
+	if page > 1 {
+		query := r.URL.Query()
+		query.Set("page", fmt.Sprint(page-1))
+		prev = "?" + query.Encode()
+	}
+
+	results := records[start:end]
+	if results == nil {
+		results = []json.RawMessage{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"count":   len(records),
+		"next":    next,
+		"prev":    prev,
+		"results": results,
+	})
+}
+
+// filterPlacedAfter keeps the orders placed strictly after an RFC 3339 time
+func filterPlacedAfter(orders []json.RawMessage, after string) []json.RawMessage {
+	if after == "" {
+		return orders
+	}
+	cutoff, err := time.Parse(time.RFC3339, strings.Replace(after, " ", "+", 1))
+	if err != nil {
+		return orders
+	}
+
+	var kept []json.RawMessage
+	for _, raw := range orders {
+		var order struct {
+			PlacedAt string `json:"placed_at"`
+		}
+		json.Unmarshal(raw, &order)
+		placedAt, err := time.Parse(time.RFC3339, order.PlacedAt)
+		if err != nil || placedAt.After(cutoff) {
+			kept = append(kept, raw)
+		}
+	}
+	return kept
+}
+
+func mustMarshal(records []interface{}) []json.RawMessage {
+	raw := make([]json.RawMessage, len(records))
+	for i, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			panic(fmt.Sprintf("fake: cannot marshal %T: %v", record, err))
+		}
+		raw[i] = data
+	}
+	return raw
+}
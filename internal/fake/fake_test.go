@@ -0,0 +1,126 @@
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func getJSON(t *testing.T, url, username, password string, body interface{}) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth(username, password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body != nil {
+		if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func TestMailchimpPaginatesMembers(t *testing.T) {
+	m := NewMailchimp("key")
+	defer m.Close()
+	m.AddMembers("list1",
+		Member{EmailAddress: "a@example.com"},
+		Member{EmailAddress: "b@example.com"},
+		Member{EmailAddress: "c@example.com"},
+	)
+
+	var page struct {
+		Members    []Member `json:"members"`
+		TotalItems int      `json:"total_items"`
+	}
+	getJSON(t, m.APIURL()+"/lists/list1/members?count=2&offset=2", "user", "key", &page)
+	if page.TotalItems != 3 || len(page.Members) != 1 || page.Members[0].EmailAddress != "c@example.com" {
+		t.Errorf("unexpected page %+v", page)
+	}
+}
+
+func TestMailchimpErrors(t *testing.T) {
+	m := NewMailchimp("key")
+	defer m.Close()
+	m.AddMembers("list1")
+
+	var problem struct {
+		Status int    `json:"status"`
+		Title  string `json:"title"`
+	}
+	if resp := getJSON(t, m.APIURL()+"/lists/list1/members", "user", "wrong", &problem); resp.StatusCode != http.StatusUnauthorized || problem.Title != "API Key Invalid" {
+		t.Errorf("expected 401 problem, got %d %+v", resp.StatusCode, problem)
+	}
+
+	m.FailNext(1, http.StatusTooManyRequests)
+	resp := getJSON(t, m.APIURL()+"/lists/list1/members", "user", "key", &problem)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "0" || problem.Status != 429 {
+		t.Errorf("expected 429 with Retry-After, got %d %+v", resp.StatusCode, problem)
+	}
+	if resp := getJSON(t, m.APIURL()+"/lists/missing/members", "user", "key", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown list, got %d", resp.StatusCode)
+	}
+	if m.Requests() != 3 {
+		t.Errorf("expected 3 requests, got %d", m.Requests())
+	}
+}
+
+func TestCratejoyFollowsNextLinks(t *testing.T) {
+	c := NewCratejoy("user", "pass")
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		c.AddSubscriptions(map[string]int{"id": i})
+	}
+
+	var ids []int
+	url := c.APIURL() + "/subscriptions/?limit=2"
+	for pages := 0; url != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		var page struct {
+			Count   int              `json:"count"`
+			Next    string           `json:"next"`
+			Results []map[string]int `json:"results"`
+		}
+		getJSON(t, url, "user", "pass", &page)
+		for _, result := range page.Results {
+			ids = append(ids, result["id"])
+		}
+		url = ""
+		if page.Next != "" {
+			url = c.APIURL() + "/subscriptions/" + page.Next
+		}
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Errorf("unexpected ids %v", ids)
+	}
+}
+
+func TestCratejoyFiltersOrdersAndFails(t *testing.T) {
+	c := NewCratejoy("user", "pass")
+	defer c.Close()
+	c.AddOrders(
+		map[string]interface{}{"id": 1, "placed_at": "2024-01-01T00:00:00Z"},
+		map[string]interface{}{"id": 2, "placed_at": "2024-03-01T00:00:00Z"},
+	)
+
+	var page struct {
+		Count int `json:"count"`
+	}
+	getJSON(t, c.APIURL()+"/orders/?placed_at__gt=2024-02-01T00:00:00Z", "user", "pass", &page)
+	if page.Count != 1 {
+		t.Errorf("expected 1 order after the filter, got %d", page.Count)
+	}
+
+	if resp := getJSON(t, c.APIURL()+"/orders/", "user", "wrong", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+	c.FailNext(1, http.StatusBadGateway)
+	if resp := getJSON(t, c.APIURL()+"/orders/", "user", "pass", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", resp.StatusCode)
+	}
+}
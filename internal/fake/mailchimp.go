@@ -0,0 +1,187 @@
+// Package fake provides in-process stand-ins for the Mailchimp and Cratejoy
+// APIs, built on httptest, so syncs can be tested without network access or
+// real credentials.
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Member is a list member as returned by the Mailchimp members endpoint
+type Member struct {
+	EmailAddress string `json:"email_address"`
+	Status       string `json:"status"`
+	FullName     string `json:"full_name"`
+	ContactID    string `json:"contact_id"`
+}
+
+// Mailchimp emulates the parts of the Mailchimp Marketing API the sync uses:
+// GET /3.0/ping, GET /3.0/lists and GET /3.0/lists/{id}/members with
+// count/offset pagination and total_items. Requests must use HTTP basic auth
+// with APIKey as the password, like the real API.
+type Mailchimp struct {
+	*httptest.Server
+	APIKey string
+
+	mu       sync.Mutex
+	lists    map[string][]Member
+	failures []failure
+	requests int
+}
+
+// failure is a canned error response served instead of the next request
+type failure struct {
+	status     int
+	retryAfter string
+}
+
+// NewMailchimp starts a fake Mailchimp API accepting apiKey
+func NewMailchimp(apiKey string) *Mailchimp {
+	m := &Mailchimp{APIKey: apiKey, lists: make(map[string][]Member)}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	return m
+}
+
+// APIURL is the base URL to configure in place of https://<dc>.api.mailchimp.com/3.0
+func (m *Mailchimp) APIURL() string {
+	return m.URL + "/3.0"
+}
+
+// AddMembers appends members to a list, creating the list if needed
+func (m *Mailchimp) AddMembers(listID string, members ...Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists[listID] = append(m.lists[listID], members...)
+}
+
+// FailNext makes the next n requests fail with status. 429 responses carry
+// Retry-After: 0 so clients retry immediately.
+func (m *Mailchimp) FailNext(n, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 0; i < n; i++ {
+		f := failure{status: status}
+		if status == http.StatusTooManyRequests {
+			f.retryAfter = "0"
+		}
+		m.failures = append(m.failures, f)
+	}
+}
+
+// Requests returns how many requests the server has received
+func (m *Mailchimp) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+func (m *Mailchimp) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+
+	if len(m.failures) > 0 {
+		f := m.failures[0]
+		m.failures = m.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeProblem(w, f.status, http.StatusText(f.status), "Injected failure")
+		return
+	}
+	if _, key, ok := r.BasicAuth(); !ok || key != m.APIKey {
+		writeProblem(w, http.StatusUnauthorized, "API Key Invalid", "Your API key may be invalid, or you've attempted to access the wrong datacenter.")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeProblem(w, http.StatusMethodNotAllowed, "Method Not Allowed", "Only GET is emulated.")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/3.0"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "ping":
+		writeJSON(w, map[string]string{"health_status": "Everything's Chimpy!"})
+	case path == "lists":
+		m.serveLists(w)
+	case len(parts) == 3 && parts[0] == "lists" && parts[2] == "members":
+		m.serveMembers(w, r, parts[1])
+	default:
+		writeProblem(w, http.StatusNotFound, "Resource Not Found", "The requested resource could not be found.")
+	}
+}
+
+func (m *Mailchimp) serveLists(w http.ResponseWriter) {
+	type list struct {
+		ID    string `json:"id"`
+		Stats struct {
+			MemberCount int `json:"member_count"`
+		} `json:"stats"`
+	}
+	lists := make([]list, 0, len(m.lists))
+	for id, members := range m.lists {
+		l := list{ID: id}
+		l.Stats.MemberCount = len(members)
+		lists = append(lists, l)
+	}
+	writeJSON(w, map[string]interface{}{"lists": lists, "total_items": len(lists)})
+}
+
+func (m *Mailchimp) serveMembers(w http.ResponseWriter, r *http.Request, listID string) {
+	members, ok := m.lists[listID]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "Resource Not Found", "The requested resource could not be found.")
+		return
+	}
+
+	count := queryInt(r, "count", 10)
+	offset := queryInt(r, "offset", 0)
+	if count > 1000 {
+		count = 1000
+	}
+	start, end := offset, offset+count
+	if start > len(members) {
+		start = len(members)
+	}
+	if end > len(members) {
+		end = len(members)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"members":     members[start:end],
+		"total_items": len(members),
+	})
+}
+
+// writeProblem writes an RFC 7807 problem document like Mailchimp's errors
+func writeProblem(w http.ResponseWriter, status int, title, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "https://mailchimp.com/developer/marketing/docs/errors/",
+		"title":    title,
+		"status":   status,
+		"detail":   detail,
+		"instance": "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, name string, fallback int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errLockHeld means another instance is syncing the same entity
+var errLockHeld = errors.New("lock held by another instance")
+
+// MySQL lock names are limited to 64 characters
+const maxLockName = 64
+
+// Lock settings shared by every entity
+var (
+	lockWait     time.Duration // how long to wait for a busy lock, 0 gives up at once
+	lockBusySkip = true        // skip a busy entity instead of failing it
+)
+
+// configureLocks reads LOCK_WAIT (default 0, don't wait) and LOCK_BUSY, what
+// to do when the lock is still held after waiting: "skip" the entity
+// (default) or "fail" it
+func configureLocks() error {
+	wait, err := envDuration("LOCK_WAIT", 0)
+	if err != nil {
+		return err
+	}
+	if wait < 0 {
+		// GET_LOCK waits forever on a negative timeout
+		return fmt.Errorf("invalid LOCK_WAIT %v, must not be negative", wait)
+	}
+	switch busy := envString("LOCK_BUSY", "skip"); busy {
+	case "skip":
+		lockBusySkip = true
+	case "fail":
+		lockBusySkip = false
+	default:
+		return fmt.Errorf("invalid LOCK_BUSY %q, expected skip or fail", busy)
+	}
+	lockWait = wait
+	return nil
+}
+
+// entityLock is a MySQL named lock held on its own connection. GET_LOCK locks
+// belong to the session, so the lock is released when the connection closes
+// even if the process dies without calling release.
+type entityLock struct {
+	conn *sql.Conn
+	name string
+}
+
+// lockName derives the lock name for a source/entity, hashing names that
+// would not fit
+func lockName(source, entity string) string {
+	name := "sync:" + source + ":" + entity
+	if len(name) <= maxLockName {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	return name[:maxLockName-17] + ":" + hex.EncodeToString(sum[:8])
+}
+
+// acquireEntityLock takes the lock for source/entity, waiting up to wait.
+// It returns errLockHeld when another session still holds it.
+func acquireEntityLock(ctx context.Context, db *sql.DB, source, entity string, wait time.Duration) (*entityLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := lockName(source, entity)
+	var acquired sql.NullInt64
+	seconds := int(math.Ceil(wait.Seconds()))
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, seconds).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("acquiring lock %s: %w", name, err)
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		return nil, errLockHeld
+	}
+	return &entityLock{conn: conn, name: name}, nil
+}
+
+// release frees the lock and its connection
+func (l *entityLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := l.conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", l.name); err != nil {
+		log.WithError(err).Warnf("Failed to release lock %s", l.name)
+	}
+	l.conn.Close()
+}
+
+// syncLocked runs sync while holding the lock for source/entity, so only one
+// instance writes an entity at a time. A busy entity is skipped or failed as
+// configured by LOCK_BUSY. Skipped entities are not recorded in sync_runs, so
+// they never count as fresh.
+func syncLocked(ctx context.Context, store Store, source, entity string, sync func(ctx context.Context) syncResult) syncResult {
+	unlock, err := store.Lock(ctx, source, entity, lockWait)
+	if errors.Is(err, errLockHeld) && lockBusySkip {
+		log.WithFields(logrus.Fields{
+			"source": source,
+			"entity": entity,
+			"waited": lockWait,
+		}).Warn("Skipping entity, another instance is syncing it")
+		return syncResult{Source: source, Entity: entity, Skipped: true}
+	}
+	if err != nil {
+		return failedResult(ctx, source, entity, err)
+	}
+	defer unlock()
+
+	log.WithFields(logrus.Fields{
+		"source": source,
+		"entity": entity,
+		"lock":   lockName(source, entity),
+	}).Debug("Acquired sync lock")
+	return sync(ctx)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockName(t *testing.T) {
+	if got := lockName("cratejoy", "orders"); got != "sync:cratejoy:orders" {
+		t.Errorf("lockName = %q", got)
+	}
+
+	long := lockName("mailchimp", "members:"+strings.Repeat("x", 80))
+	if len(long) != maxLockName {
+		t.Errorf("long lock name has %d characters, want %d", len(long), maxLockName)
+	}
+	other := lockName("mailchimp", "members:"+strings.Repeat("x", 79)+"y")
+	if long == other {
+		t.Error("long names that differ only at the end should not collide")
+	}
+}
+
+func TestConfigureLocks(t *testing.T) {
+	defer func() { lockWait, lockBusySkip = 0, true }()
+
+	t.Setenv("LOCK_WAIT", "30s")
+	t.Setenv("LOCK_BUSY", "fail")
+	if err := configureLocks(); err != nil {
+		t.Fatal(err)
+	}
+	if lockWait != 30*time.Second || lockBusySkip {
+		t.Errorf("got wait %v, skip %v", lockWait, lockBusySkip)
+	}
+
+	t.Setenv("LOCK_BUSY", "queue")
+	if err := configureLocks(); err == nil {
+		t.Error("expected an error for an unknown LOCK_BUSY")
+	}
+
+	t.Setenv("LOCK_BUSY", "skip")
+	t.Setenv("LOCK_WAIT", "-1s")
+	if err := configureLocks(); err == nil {
+		t.Error("expected an error for a negative LOCK_WAIT")
+	}
+}
+
+func TestSyncLockedBusyEntity(t *testing.T) {
+	defer func() { lockWait, lockBusySkip = 0, true }()
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	synced := 0
+	sync := func(ctx context.Context) syncResult {
+		synced++
+		return syncResult{Source: "cratejoy", Entity: "orders"}
+	}
+
+	unlock, err := store.Lock(ctx, "cratejoy", "orders", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockWait, lockBusySkip = 10*time.Millisecond, true
+	if result := syncLocked(ctx, store, "cratejoy", "orders", sync); !result.Skipped || result.Err != nil {
+		t.Errorf("skip mode returned %+v", result)
+	}
+	if code := exitCode([]syncResult{syncLocked(ctx, store, "cratejoy", "orders", sync)}); code != exitOK {
+		t.Errorf("a skipped entity exited with %d", code)
+	}
+
+	lockBusySkip = false
+	result := syncLocked(ctx, store, "cratejoy", "orders", sync)
+	if result.Skipped || !errors.Is(result.Err, errLockHeld) {
+		t.Errorf("fail mode returned %+v", result)
+	}
+	if code := exitCode([]syncResult{result}); code == exitOK {
+		t.Error("a busy entity in fail mode should not exit OK")
+	}
+	if synced != 0 {
+		t.Fatalf("sync ran %d times while the lock was held", synced)
+	}
+
+	unlock()
+	if result := syncLocked(ctx, store, "cratejoy", "orders", sync); result.Err != nil || synced != 1 {
+		t.Errorf("free entity returned %+v after %d syncs", result, synced)
+	}
+	if result := syncLocked(ctx, store, "cratejoy", "orders", sync); result.Err != nil || synced != 2 {
+		t.Errorf("the lock was not released after the sync: %+v", result)
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Mailchimp structs
@@ -23,87 +31,502 @@ type Response struct {
 	TotalItems int      `json:"total_items"`
 }
 
+// Base URL of the Mailchimp Marketing API for our data center
+var mailchimpAPIURL = "https://us6.api.mailchimp.com/3.0"
+
+// mailchimpFetcher fetches pages of list members through the shared API client
+type mailchimpFetcher struct {
+	client      *apiClient
+	baseURL     string
+	apiKey      string
+	count       int
+	chunk       int           // members written per statement, also the read-ahead buffer
+	pageRetries int           // attempts per page on top of the client's own retries
+	conns       chan struct{} // global limit on concurrent Mailchimp connections
+}
+
+// Pause before re-fetching a failed page, multiplied by the attempt number
+var mailchimpPageRetryDelay = time.Second
+
+// MailchimpError is an RFC 7807 problem document returned by the Mailchimp API
+type MailchimpError struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+}
+
+func (e *MailchimpError) Error() string {
+	return fmt.Sprintf("Mailchimp API error %d %s: %s", e.Status, e.Title, e.Detail)
+}
+
+// Temporary reports whether retrying the request could succeed
+func (e *MailchimpError) Temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// parseMailchimpError decodes a problem document, falling back to the raw body
+func parseMailchimpError(status int, body []byte) *MailchimpError {
+	problem := &MailchimpError{}
+	if err := json.Unmarshal(body, problem); err != nil || problem.Title == "" {
+		problem = &MailchimpError{Title: http.StatusText(status), Detail: strings.TrimSpace(string(body))}
+	}
+	if problem.Status == 0 {
+		problem.Status = status
+	}
+	return problem
+}
+
+// memberItem is a decoded member, the end of a page, or the error that stopped fetching
+type memberItem struct {
+	member  Member
+	pageEnd bool
+	next    int // offset of the following page
+	total   int // total_items reported with the page
+	err     error
+}
+
 // run Mailchimp API
-func MailChimp(db *sql.DB) {
-	apiKey := os.Getenv("apiKey")
+//
+// Lists are synced in parallel by MAILCHIMP_WORKERS workers (default 3) while
+// MAILCHIMP_MAX_CONNECTIONS (default 10, Mailchimp's own limit) caps the number
+// of requests in flight across all of them. Members are decoded as they arrive
+// and written MAILCHIMP_WRITE_CHUNK (default 500) at a time. One result is
+// returned per list.
+func MailChimp(ctx context.Context, store Store, client *apiClient, opts syncOptions) []syncResult {
+	apiKey := loadSecret("apiKey")
 	listIDs := strings.Split(os.Getenv("listID"), ",")
-	count := "1000"
 
-	for _, listID := range listIDs {
-		processList(db, apiKey, listID, count)
+	workers, err := envInt("MAILCHIMP_WORKERS", 3)
+	if err != nil {
+		return []syncResult{failedResult(ctx, "mailchimp", "lists", err)}
+	}
+	maxConns, err := envInt("MAILCHIMP_MAX_CONNECTIONS", 10)
+	if err != nil {
+		return []syncResult{failedResult(ctx, "mailchimp", "lists", err)}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if maxConns < 1 {
+		maxConns = 1
 	}
-}
 
-func processList(db *sql.DB, apiKey, listID, count string) {
-	client := &http.Client{}
-	offset := 0
-	totalCount := 1 // Initialize to force entry into the loop
+	chunk, err := envInt("MAILCHIMP_WRITE_CHUNK", 500)
+	if err != nil {
+		return []syncResult{failedResult(ctx, "mailchimp", "lists", err)}
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	pageRetries, err := envInt("MAILCHIMP_PAGE_RETRIES", 3)
+	if err != nil {
+		return []syncResult{failedResult(ctx, "mailchimp", "lists", err)}
+	}
 
-	for offset < totalCount {
-		url := "https://us6.api.mailchimp.com/3.0/lists/" + listID + "/members?fields=members.email_address,members.status,members.full_name,merge_fields.Subscription+Status,members.contact_id,total_items&count=" + count + "&offset=" + strconv.Itoa(offset)
-		log.Printf("Making API request to URL: %s", url) // Log the URL of the API request
+	fetcher := &mailchimpFetcher{
+		client:      client,
+		baseURL:     mailchimpAPIURL,
+		apiKey:      apiKey,
+		count:       1000,
+		chunk:       chunk,
+		pageRetries: pageRetries,
+		conns:       make(chan struct{}, maxConns),
+	}
 
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.Printf("Failed to create HTTP request: %v", err)
+	jobs := make(chan string)
+	results := make(chan syncResult, len(listIDs))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for listID := range jobs {
+				results <- syncList(ctx, store, fetcher, listID, opts)
+			}
+		}()
+	}
+
+	for i, listID := range listIDs {
+		if stopRequested(ctx) {
+			log.Warn("Skipping remaining Mailchimp lists, shutdown requested")
+			for _, skipped := range listIDs[i:] {
+				results <- failedResult(ctx, "mailchimp", "members:"+skipped, interruptedErr(ctx))
+			}
+			break
+		}
+		jobs <- listID
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	return logListSummary(results)
+}
+
+// logListSummary logs the outcome of every list and the totals, and collects
+// the results
+func logListSummary(results <-chan syncResult) []syncResult {
+	var collected []syncResult
+	total, failed := 0, 0
+	for result := range results {
+		collected = append(collected, result)
+		fields := logrus.Fields{
+			"list_id":  strings.TrimPrefix(result.Entity, "members:"),
+			"members":  result.Written,
+			"duration": result.Duration,
+		}
+		if result.Err != nil {
+			failed++
+			log.WithFields(fields).WithError(result.Err).Error("Mailchimp list sync failed")
 			continue
 		}
-		req.SetBasicAuth("username", apiKey) // Assuming 'username' is a placeholder
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Failed to send HTTP request: %v", err)
+		if result.Skipped {
+			log.WithFields(fields).Warn("Mailchimp list skipped")
 			continue
 		}
+		total += result.Written
+		log.WithFields(fields).Info("Mailchimp list synced")
+	}
+	log.WithFields(logrus.Fields{
+		"members":      total,
+		"failed_lists": failed,
+	}).Info("Mailchimp sync finished")
+	return collected
+}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Failed to read response body: %v", err)
-			resp.Body.Close()
-			continue
+// syncList syncs one list inside its own span
+func syncList(ctx context.Context, store Store, fetcher *mailchimpFetcher, listID string, opts syncOptions) syncResult {
+	ctx, span := startSpan(ctx, "mailchimp list",
+		attribute.String("list_id", listID),
+		attribute.Bool("bulk_load", opts.BulkLoad),
+	)
+	result := syncLocked(ctx, store, "mailchimp", "members:"+listID, func(ctx context.Context) syncResult {
+		if opts.BulkLoad {
+			return bulkLoadList(ctx, store, fetcher, listID)
+		}
+		return processList(ctx, store, fetcher, listID)
+	})
+	span.SetAttributes(attribute.Int("pages", result.Pages), attribute.Int("records", result.Written))
+	endSpan(span, result.Err)
+	return result
+}
+
+// processList syncs one list, streaming members into the database while the
+// rest of the page, and the next page, are still being fetched
+func processList(ctx context.Context, store Store, fetcher *mailchimpFetcher, listID string) syncResult {
+	entity := "members:" + listID
+	result := newSyncResult(ctx, "mailchimp", entity)
+	offset := 0
+
+	// Resume from the last committed page of an interrupted run
+	cursor, err := store.LoadCheckpoint(ctx, "mailchimp", entity)
+	if err != nil {
+		log.Printf("Failed to load checkpoint for list ID %s: %v", listID, err)
+	} else if cursor != "" {
+		if offset, err = strconv.Atoi(cursor); err != nil {
+			log.Printf("Ignoring invalid checkpoint %q for list ID %s", cursor, listID)
+			offset = 0
 		}
-		resp.Body.Close() // It's good practice to close the body right after reading
+	}
 
-		// log.Printf("API Response received: %s", string(body)) // Log raw response body
+	// The fetcher runs up to one chunk ahead of the writer
+	fetchCtx, cancelFetch := context.WithCancel(ctx)
+	defer cancelFetch()
+	items := make(chan memberItem, fetcher.chunk)
+	go fetcher.fetchPages(fetchCtx, listID, offset, items)
 
-		var response Response
-		if err = json.Unmarshal(body, &response); err != nil {
-			log.Printf("Failed to unmarshal JSON: %v", err)
-			continue
+	pageStart := time.Now()
+	members := make([]Member, 0, fetcher.chunk)
+	for item := range items {
+		if item.err != nil {
+			return result.finish(item.err)
+		}
+		if !item.pageEnd {
+			result.Fetched++
+			members = append(members, item.member)
+			if len(members) < fetcher.chunk {
+				continue
+			}
 		}
 
-		log.Printf("Processing %d members from list ID: %s", len(response.Members), listID) // Log number of members being processed
+		log.Printf("Processing %d members from list ID: %s", len(members), listID) // Log number of members being processed
 
-		if err = insertMembers(db, listID, response); err != nil {
+		counts, err := store.UpsertMembers(ctx, listID, members)
+		if err != nil {
 			log.Printf("Failed to insert members into database: %v", err)
+			return result.finish(err)
+		}
+		result.rowCounts.add(counts)
+		result.Written += len(members)
+		members = members[:0]
+		if !item.pageEnd {
 			continue
 		}
+		result.Pages++
+		pageDurationSeconds.WithLabelValues("mailchimp", entity).Observe(time.Since(pageStart).Seconds())
+		pageStart = time.Now()
 
 		log.Printf("Inserted members successfully, continuing to next batch") // Log successful insertion
 
-		offset += len(response.Members)
-		totalCount = response.TotalItems
-		log.Printf("Updated offset: %d, Total members: %d", offset, totalCount) // Log progress of member retrieval
+		offset = item.next
+		log.Printf("Updated offset: %d, Total members: %d", offset, item.total) // Log progress of member retrieval
+
+		if err = store.SaveCheckpoint(ctx, "mailchimp", entity, strconv.Itoa(offset)); err != nil {
+			log.Printf("Failed to save checkpoint for list ID %s: %v", listID, err)
+		}
+
+		// Stop between pages so the committed data stays consistent
+		if stopRequested(ctx) {
+			log.Printf("Shutdown requested, stopping list %s at offset %d", listID, offset)
+			return result.finish(interruptedErr(ctx))
+		}
 	}
 
+	if err = store.ClearCheckpoint(ctx, "mailchimp", entity); err != nil {
+		log.Printf("Failed to clear checkpoint for list ID %s: %v", listID, err)
+	}
 	log.Printf("Completed processing all members for list ID: %s", listID) // Log completion of processing for a list
+	return result.finish(nil)
+}
+
+// bulkLoadList backfills one list through LOAD DATA LOCAL INFILE.
+// Every page is streamed into a staging table that is merged once at the end,
+// so bulk loads always start from offset 0 and do not use checkpoints.
+func bulkLoadList(ctx context.Context, store Store, fetcher *mailchimpFetcher, listID string) syncResult {
+	result := newSyncResult(ctx, "mailchimp", "members:"+listID)
+	mysql, ok := store.(*mysqlStore)
+	if !ok {
+		return result.finish(errBulkLoadUnsupported)
+	}
+
+	loader, err := startBulkLoad(ctx, mysql.db, "mailchimp", memberColumns, true)
+	if err != nil {
+		return result.finish(err)
+	}
+
+	fetchCtx, cancelFetch := context.WithCancel(ctx)
+	defer cancelFetch()
+	items := make(chan memberItem, fetcher.chunk)
+	go fetcher.fetchPages(fetchCtx, listID, 0, items)
+
+	interrupted := false
+	for item := range items {
+		if item.err == nil && !item.pageEnd {
+			result.Fetched++
+			item.err = loader.add(memberRow(listID, item.member)...)
+		}
+		if item.err != nil {
+			loader.abort(item.err)
+			return result.finish(item.err)
+		}
+		if !item.pageEnd {
+			continue
+		}
+		result.Pages++
+		log.Printf("Streamed members from list ID %s up to offset %d", listID, item.next)
+
+		// Merge what has been streamed so far when a shutdown is requested
+		if stopRequested(ctx) {
+			log.Printf("Shutdown requested, stopping bulk load of list %s", listID)
+			interrupted = true
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		loader.abort(ctx.Err())
+		return result.finish(ctx.Err())
+	}
+	counts, err := loader.finish(ctx)
+	if err != nil {
+		return result.finish(err)
+	}
+	result.Written = result.Fetched
+	result.rowCounts = counts
+	if interrupted {
+		return result.finish(errInterrupted)
+	}
+	return result.finish(nil)
 }
 
-func insertMembers(db *sql.DB, listID string, response Response) error {
+// fetchPages fetches pages from offset until the list is exhausted, sending the
+// members of each page on items once the page has decoded cleanly, followed by a
+// page-end marker. It closes items when done; a fetch error is sent as the last
+// item.
+func (f *mailchimpFetcher) fetchPages(ctx context.Context, listID string, offset int, items chan<- memberItem) {
+	defer close(items)
+
+	send := func(item memberItem) error {
+		select {
+		case items <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	archive := newArchiveSession(ctx, "mailchimp", "members:"+listID)
+	defer archive.logDone()
+
+	totalCount := offset + 1 // Initialize to force entry into the loop
+	for offset < totalCount {
+		var page []Member
+		var total int
+		var err error
+		for attempt := 0; ; attempt++ {
+			// Hold the page back until it decodes, so a failed attempt sends nothing
+			page = page[:0]
+			total, err = f.fetchPage(ctx, listID, offset, archive, func(member Member) error {
+				page = append(page, member)
+				return nil
+			})
+			if err == nil || !isRetryablePageError(ctx, err) || attempt >= f.pageRetries {
+				break
+			}
+			log.WithFields(logrus.Fields{
+				"list_id": listID,
+				"offset":  offset,
+				"attempt": attempt + 1,
+			}).WithError(err).Warn("Retrying Mailchimp page")
+			if sleepContext(ctx, mailchimpPageRetryDelay*time.Duration(attempt+1)) != nil {
+				break
+			}
+		}
+		if err != nil {
+			send(memberItem{err: fmt.Errorf("list %s at offset %d: %w", listID, offset, err)})
+			return
+		}
+
+		for _, member := range page {
+			if send(memberItem{member: member}) != nil {
+				return
+			}
+		}
+		count := len(page)
+		next := offset + count
+		if send(memberItem{pageEnd: true, next: next, total: total}) != nil {
+			return
+		}
+
+		if count == 0 {
+			break
+		}
+		offset = next
+		totalCount = total
+	}
+}
+
+// isRetryablePageError reports whether a failed page is worth fetching again.
+// Client errors such as a bad API key or unknown list will not fix themselves.
+func isRetryablePageError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var problem *MailchimpError
+	if errors.As(err, &problem) {
+		return problem.Temporary()
+	}
+	return true
+}
+
+// fetchPage requests a single page of members, holding one of the global connection
+// slots while the body is streamed. Each member is passed to yield as it is decoded
+// and total_items is returned. The raw body goes to archive once decoded.
+func (f *mailchimpFetcher) fetchPage(ctx context.Context, listID string, offset int, archive *archiveSession, yield func(Member) error) (total int, err error) {
+	ctx, span := startSpan(ctx, "mailchimp.fetch_page",
+		attribute.String("list_id", listID),
+		attribute.Int("offset", offset),
+	)
+	defer func() { endSpan(span, err) }()
+
+	url := f.baseURL + "/lists/" + listID + "/members?fields=members.email_address,members.status,members.full_name,merge_fields.Subscription+Status,members.contact_id,total_items&count=" + strconv.Itoa(f.count) + "&offset=" + strconv.Itoa(offset)
+	log.Printf("Making API request to URL: %s", url) // Log the URL of the API request
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		log.Printf("Failed to create HTTP request: %v", err)
+		return 0, err
+	}
+	req.SetBasicAuth("username", f.apiKey) // Assuming 'username' is a placeholder
+
+	select {
+	case f.conns <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-f.conns }()
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Retries were exhausted on a 429 or 5xx, surface Mailchimp's problem document
+		var statusErr *APIStatusError
+		if errors.As(err, &statusErr) {
+			err = parseMailchimpError(statusErr.StatusCode, []byte(statusErr.Body))
+		}
+		log.Printf("Failed to send HTTP request: %v", err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Error responses carry a problem document instead of members
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)) // Ignore error here; we're already handling an error case
+		problem := parseMailchimpError(resp.StatusCode, body)
+		log.Printf("Mailchimp API responded with an error: %v", problem)
+		return 0, problem
+	}
+
+	var response Response
+	body, save := archive.capture(resp.Body)
+	if err = streamPage(body, "members", &response, yield); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to decode JSON: %v", err)
+		}
+		return 0, err
+	}
+	save(ctx)
+	return response.TotalItems, nil
+}
+
+// Columns of the mailchimp table, in the order memberRow returns them
+var memberColumns = []string{"list_id", "contact_id", "email", "status", "full_name"}
+
+func memberRow(listID string, member Member) []interface{} {
+	return []interface{}{listID, member.ContactID, member.Email, member.Status, member.FullName}
+}
+
+// insertMembers replaces a chunk of members, returning how many were new and
+// how many replaced an existing row
+func insertMembers(ctx context.Context, db *sql.DB, listID string, members []Member) (counts rowCounts, err error) {
 	valueStrings := []string{}
 	valueArgs := []interface{}{}
-	for _, member := range response.Members {
+	for _, member := range members {
 		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?)")
-		valueArgs = append(valueArgs, listID, member.ContactID, member.Email, member.Status, member.FullName)
+		valueArgs = append(valueArgs, memberRow(listID, member)...)
 	}
 
 	if len(valueStrings) == 0 {
-		return nil
+		return rowCounts{}, nil
 	}
 
-	stmt := "REPLACE INTO mailchimp (list_id, contact_id, email, status, full_name) VALUES " + strings.Join(valueStrings, ",")
-	if _, err := db.Exec(stmt, valueArgs...); err != nil {
-		return err
+	ctx, span := startSpan(ctx, "replace mailchimp",
+		attribute.String("db.sql.table", "mailchimp"),
+		attribute.Int("db.rows", len(members)),
+	)
+	defer func() {
+		span.SetAttributes(rowCountAttributes(counts)...)
+		endSpan(span, err)
+	}()
+
+	stmt := "REPLACE INTO mailchimp (" + strings.Join(memberColumns, ", ") + ") VALUES " + strings.Join(valueStrings, ",")
+	result, err := db.ExecContext(ctx, stmt, valueArgs...)
+	if err != nil {
+		return rowCounts{}, err
 	}
 
-	return nil
+	counts = replaceCounts(len(members), rowsAffected(result))
+	observeRows("mailchimp", counts)
+	return counts, nil
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestMailchimpFetcher(baseURL string, pageRetries int) *mailchimpFetcher {
+	return &mailchimpFetcher{
+		client:      newTestAPIClient(0),
+		baseURL:     baseURL,
+		apiKey:      "test-key",
+		count:       2,
+		chunk:       10,
+		pageRetries: pageRetries,
+		conns:       make(chan struct{}, 1),
+	}
+}
+
+// noPageRetryDelay retries failed pages at once for the rest of the test
+func noPageRetryDelay(t *testing.T) {
+	saved := mailchimpPageRetryDelay
+	mailchimpPageRetryDelay = 0
+	t.Cleanup(func() { mailchimpPageRetryDelay = saved })
+}
+
+func collectMembers(t *testing.T, f *mailchimpFetcher) (int, error) {
+	t.Helper()
+	items := make(chan memberItem, 100)
+	go f.fetchPages(context.Background(), "list1", 0, items)
+	members := 0
+	for item := range items {
+		if item.err != nil {
+			return members, item.err
+		}
+		if !item.pageEnd {
+			members++
+		}
+	}
+	return members, nil
+}
+
+func TestMailchimpProblemDocumentIsNotRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"type":"https://mailchimp.com/developer/marketing/docs/errors/","title":"API Key Invalid","status":401,"detail":"Your API key may be invalid.","instance":"abc"}`))
+	}))
+	defer server.Close()
+
+	_, err := collectMembers(t, newTestMailchimpFetcher(server.URL, 3))
+	var problem *MailchimpError
+	if !errors.As(err, &problem) {
+		t.Fatalf("expected *MailchimpError, got %v", err)
+	}
+	if problem.Status != 401 || problem.Title != "API Key Invalid" || problem.Instance != "abc" {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 request, got %d", calls)
+	}
+}
+
+func TestMailchimpPageRetriesAreBounded(t *testing.T) {
+	noPageRetryDelay(t)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("upstream unavailable"))
+	}))
+	defer server.Close()
+
+	_, err := collectMembers(t, newTestMailchimpFetcher(server.URL, 2))
+	var problem *MailchimpError
+	if !errors.As(err, &problem) || problem.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 MailchimpError, got %v", err)
+	}
+	if problem.Detail != "upstream unavailable" {
+		t.Errorf("expected body as detail, got %q", problem.Detail)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 requests, got %d", calls)
+	}
+}
+
+func TestMailchimpPageRetrySucceeds(t *testing.T) {
+	noPageRetryDelay(t)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if strings.Contains(r.URL.RawQuery, "offset=0") {
+			w.Write([]byte(`{"members":[{"email_address":"a@example.com"},{"email_address":"b@example.com"}],"total_items":3}`))
+			return
+		}
+		w.Write([]byte(`{"members":[{"email_address":"c@example.com"}],"total_items":3}`))
+	}))
+	defer server.Close()
+
+	members, err := collectMembers(t, newTestMailchimpFetcher(server.URL, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members != 3 {
+		t.Errorf("expected 3 members, got %d", members)
+	}
+}
+
+func TestMailchimpFailedAttemptSendsNoMembers(t *testing.T) {
+	noPageRetryDelay(t)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"members":[{"email_address":"a@example.com"},{"email_address":"b@example.com"}],"total_items":2}`
+		// The first attempt is cut off after one member has decoded
+		if atomic.AddInt32(&calls, 1) == 1 {
+			body = body[:strings.Index(body, `{"email_address":"b`)+5]
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	members, err := collectMembers(t, newTestMailchimpFetcher(server.URL, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members != 2 || calls != 2 {
+		t.Errorf("expected 2 members from 2 requests, got %d from %d", members, calls)
+	}
+}
+
+func TestMailChimpFailedListDoesNotStopTheOthers(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if n <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, n) {
+				break
+			}
+		}
+		// Hold the connection so the workers overlap
+		time.Sleep(20 * time.Millisecond)
+
+		listID := strings.Split(strings.TrimPrefix(r.URL.Path, "/lists/"), "/")[0]
+		if listID == "missing" {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"title":"Resource Not Found","status":404}`))
+			return
+		}
+		fmt.Fprintf(w, `{"members":[{"contact_id":"%s-a","email_address":"a@example.com"},{"contact_id":"%s-b","email_address":"b@example.com"}],"total_items":2}`, listID, listID)
+	}))
+	defer server.Close()
+
+	defer func(saved string) { mailchimpAPIURL = saved }(mailchimpAPIURL)
+	mailchimpAPIURL = server.URL
+	t.Setenv("apiKey", "test-key")
+	t.Setenv("listID", "list1,missing,list2,list3,list4")
+	t.Setenv("MAILCHIMP_WORKERS", "5")
+	t.Setenv("MAILCHIMP_MAX_CONNECTIONS", "2")
+
+	results := MailChimp(context.Background(), newTestSQLiteStore(t), newTestAPIClient(0), syncOptions{})
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %+v", results)
+	}
+	for _, result := range results {
+		var problem *MailchimpError
+		switch {
+		case result.Entity == "members:missing":
+			if !errors.As(result.Err, &problem) || problem.Status != http.StatusNotFound {
+				t.Errorf("expected a 404 for the missing list, got %v", result.Err)
+			}
+		case result.Err != nil || result.Written != 2:
+			t.Errorf("%s: expected 2 members, got %+v", result.Entity, result)
+		}
+	}
+	if code := exitCode(results); code != exitPartial {
+		t.Errorf("expected exit code %d, got %d", exitPartial, code)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", got)
+	}
+}
+
+func TestLogListSummaryCollectsResults(t *testing.T) {
+	results := make(chan syncResult, 2)
+	results <- syncResult{Source: "mailchimp", Entity: "members:ok", Fetched: 5, Written: 5}
+	results <- syncResult{Source: "mailchimp", Entity: "members:bad", Err: &MailchimpError{Status: 404, Title: "Resource Not Found"}}
+	close(results)
+
+	collected := logListSummary(results)
+	if len(collected) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(collected))
+	}
+	if code := exitCode(collected); code != exitPartial {
+		t.Errorf("expected exit code %d, got %d", exitPartial, code)
+	}
+}
@@ -1,243 +1,469 @@
-package main
-
-import (
-	"database/sql"
-	"os"
-	"time"
-
-	_ "github.com/go-sql-driver/mysql" // import MySQL driver
-	"github.com/sirupsen/logrus"
-)
-
-// Cratejoy Structs
-type CratejoyResponse struct {
-	Count   int            `json:"count"`
-	Next    string         `json:"next"`
-	Prev    interface{}    `json:"prev"`
-	Results []Subscription `json:"results"`
-}
-
-type Subscription struct {
-	Address          Address         `json:"address"`
-	Autorenew        bool            `json:"autorenew"`
-	Billing          Billing         `json:"billing"`
-	BillingName      string          `json:"billing_name"`
-	Credit           interface{}     `json:"credit"`
-	Customer         Customer        `json:"customer"`
-	EndDate          string          `json:"end_date"`
-	ID               int             `json:"id"`
-	IsTest           bool            `json:"is_test"`
-	Note             string          `json:"note"`
-	Product          Product         `json:"product"`
-	ProductBillingID int             `json:"product_billing_id"`
-	ProductInstance  ProductInstance `json:"product_instance"`
-	SkippedDate      interface{}     `json:"skipped_date"`
-	Source           int             `json:"source"`
-	StartDate        string          `json:"start_date"`
-	Status           string          `json:"status"`
-	StoreID          int             `json:"store_id"`
-	Term             Term            `json:"term"`
-	Type             string          `json:"type"`
-	URL              string          `json:"url"`
-}
-
-type Address struct {
-	City          string      `json:"city"`
-	Company       string      `json:"company"`
-	Country       string      `json:"country"`
-	Icon          string      `json:"icon"`
-	ID            int         `json:"id"`
-	PhoneNumber   string      `json:"phone_number"`
-	State         string      `json:"state"`
-	Status        int         `json:"status"`
-	StatusMessage interface{} `json:"status_message"`
-	Street        string      `json:"street"`
-	To            string      `json:"to"`
-	Type          string      `json:"type"`
-	Unit          string      `json:"unit"`
-	ZipCode       string      `json:"zip_code"`
-}
-
-type Billing struct {
-	ID           int         `json:"id"`
-	RebillDay    int         `json:"rebill_day"`
-	RebillMonths int         `json:"rebill_months"`
-	RebillWeeks  interface{} `json:"rebill_weeks"`
-	RebillWindow int         `json:"rebill_window"`
-	StoreID      int         `json:"store_id"`
-	Type         string      `json:"type"`
-}
-
-type Customer struct {
-	Country   string      `json:"country"`
-	Email     string      `json:"email"`
-	FirstName string      `json:"first_name"`
-	ID        int         `json:"id"`
-	LastName  interface{} `json:"last_name"`
-	Location  string      `json:"location"`
-	Name      string      `json:"name"`
-	Status    interface{} `json:"status"`
-	Type      string      `json:"type"`
-}
-
-type Product struct {
-	Deleted           bool        `json:"deleted"`
-	Description       string      `json:"description"`
-	DisplayOrder      int         `json:"display_order"`
-	FlatShipPrice     float64     `json:"flat_ship_price"`
-	GiftShipping      int         `json:"gift_shipping"`
-	Giftable          bool        `json:"giftable"`
-	ID                int         `json:"id"`
-	Listed            bool        `json:"listed"`
-	MaxSubs           interface{} `json:"max_subs"`
-	Meta              interface{} `json:"meta"`
-	MpVisible         bool        `json:"mp_visible"`
-	Name              string      `json:"name"`
-	ProductBillingID  int         `json:"product_billing_id"`
-	ProductType       int         `json:"product_type"`
-	Reviewable        bool        `json:"reviewable"`
-	ShipOption        int         `json:"ship_option"`
-	ShipWeight        float64     `json:"ship_weight"`
-	SinglePurchasable bool        `json:"single_purchasable"`
-	Sku               string      `json:"sku"`
-	Slug              string      `json:"slug"`
-	StoreID           int         `json:"store_id"`
-	SubscribeFlow     bool        `json:"subscribe_flow"`
-	SubscribeFlowData interface{} `json:"subscribe_flow_data"`
-	Visible           bool        `json:"visible"`
-}
-
-type ProductInstance struct {
-	ID        int     `json:"id"`
-	Name      string  `json:"name"`
-	Price     float64 `json:"price"`
-	ProductID int     `json:"product_id"`
-	Sku       string  `json:"sku"`
-}
-
-type Term struct {
-	Description string      `json:"description"`
-	Enabled     bool        `json:"enabled"`
-	ID          int         `json:"id"`
-	Images      []TermImage `json:"images"` // Assuming images is an array of image objects
-	Name        string      `json:"name"`
-	NumCycles   int         `json:"num_cycles"`
-	Type        string      `json:"type"`
-}
-
-type TermImage struct {
-	ID                     int    `json:"id"`
-	SubscriptionTypeTermID int    `json:"subscription_type_term_id"`
-	Type                   string `json:"type"`
-	URL                    string `json:"url"`
-}
-
-// Structs for Orders
-type OrderGiftInfo struct {
-	GiftMessage        string `json:"gift_message"`
-	GiftRecipientEmail string `json:"gift_recipient_email"`
-	GiftRecipientName  string `json:"gift_recipient_name"`
-}
-
-type Order struct {
-	ID                   int64         `json:"id"`
-	CardRefundedAmount   int           `json:"card_refunded_amount"`
-	CreditApplied        int           `json:"credit_applied"`
-	CustomerID           int64         `json:"customer_id"`
-	FinancialStatus      string        `json:"financial_status"`
-	FulfillmentStatus    string        `json:"fulfillment_status"`
-	GiftCardDiscount     int           `json:"gift_card_discount"`
-	GiftMessage          string        `json:"gift_message"`
-	GiftRenewalNotif     bool          `json:"gift_renewal_notif"`
-	GrossShipping        int           `json:"gross_shipping"`
-	IsGift               bool          `json:"is_gift"`
-	OrderGiftInfo        OrderGiftInfo `json:"order_gift_info"`
-	IsRenewal            bool          `json:"is_renewal"`
-	IsTest               bool          `json:"is_test"`
-	Note                 string        `json:"note"`
-	PlacedAt             string        `json:"placed_at"`
-	ProratedCharge       int           `json:"prorated_charge"`
-	RefundApplied        int           `json:"refund_applied"`
-	RefundedAmount       int           `json:"refunded_amount"`
-	Status               string        `json:"status"`
-	StoreID              int64         `json:"store_id"`
-	SubTotal             int           `json:"sub_total"`
-	Total                int           `json:"total"`
-	TotalAppFees         int           `json:"total_app_fees"`
-	TotalLabelCost       int           `json:"total_label_cost"`
-	TotalPendingFees     int           `json:"total_pending_fees"`
-	TotalPrice           int           `json:"total_price"`
-	TotalShipping        int           `json:"total_shipping"`
-	TotalTax             int           `json:"total_tax"`
-	TransactionFees      int           `json:"transaction_fees"`
-	TransactionFeeStatus int           `json:"transaction_fee_status"`
-	Type                 string        `json:"type"`
-	URL                  string        `json:"url"`
-}
-
-type CratejoyOrderResponse struct {
-	Count   int         `json:"count"`
-	Next    string      `json:"next"`
-	Prev    interface{} `json:"prev"`
-	Results []Order     `json:"results"`
-}
-
-// setup logging
-var log = logrus.New()
-
-// main function
-func main() {
-	log.SetLevel(logrus.DebugLevel)
-
-	//Open DB Connection
-	log.Info("Connecting to database")
-	db := opendb()
-	defer db.Close()
-
-	MailChimp(db)
-	Cratejoy(db)
-}
-
-// return an open database
-func opendb() (db *sql.DB) {
-	var err error
-	user := os.Getenv("USER")
-	pass := os.Getenv("PASS")
-	server := os.Getenv("SERVER")
-	port := os.Getenv("PORT")
-	// Get a database handle.
-	log.Info("Connecting to DB...")
-	log.Debug("user:", user)
-	log.Debug("pass:", pass)
-	log.Debug("server:", server)
-	log.Debug("port:", port)
-	log.Debug("Opening Database...")
-	connectstring := os.Getenv("USER") + ":" + os.Getenv("PASS") + "@tcp(" + os.Getenv("SERVER") + ":" + os.Getenv("PORT") + ")/customers?parseTime=true"
-	log.Debug("Connection: ", connectstring)
-	db, err = sql.Open("mysql",
-		connectstring)
-	if err != nil {
-		log.Error(err)
-	}
-
-	//Test Connection
-	pingErr := db.Ping()
-	if pingErr != nil {
-		log.Error(err)
-	}
-
-	//Success!
-	log.Info("Returning Open DB...")
-	return db
-}
-
-func parseDate(dateStr string) (string, error) {
-	// Parse the input date string
-	t, err := time.Parse(time.RFC3339, dateStr)
-	if err != nil {
-		return "", err
-	}
-
-	// Return in the format MySQL expects
-	return t.Format("2006-01-02 15:04:05"), nil
-}
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // import MySQL driver
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Cratejoy Structs
+type CratejoyResponse struct {
+	Count   int            `json:"count"`
+	Next    string         `json:"next"`
+	Prev    interface{}    `json:"prev"`
+	Results []Subscription `json:"results"`
+}
+
+type Subscription struct {
+	Address          Address         `json:"address"`
+	Autorenew        bool            `json:"autorenew"`
+	Billing          Billing         `json:"billing"`
+	BillingName      string          `json:"billing_name"`
+	Credit           interface{}     `json:"credit"`
+	Customer         Customer        `json:"customer"`
+	EndDate          string          `json:"end_date"`
+	ID               int             `json:"id"`
+	IsTest           bool            `json:"is_test"`
+	Note             string          `json:"note"`
+	Product          Product         `json:"product"`
+	ProductBillingID int             `json:"product_billing_id"`
+	ProductInstance  ProductInstance `json:"product_instance"`
+	SkippedDate      interface{}     `json:"skipped_date"`
+	Source           int             `json:"source"`
+	StartDate        string          `json:"start_date"`
+	Status           string          `json:"status"`
+	StoreID          int             `json:"store_id"`
+	Term             Term            `json:"term"`
+	Type             string          `json:"type"`
+	URL              string          `json:"url"`
+}
+
+type Address struct {
+	City          string      `json:"city"`
+	Company       string      `json:"company"`
+	Country       string      `json:"country"`
+	Icon          string      `json:"icon"`
+	ID            int         `json:"id"`
+	PhoneNumber   string      `json:"phone_number"`
+	State         string      `json:"state"`
+	Status        int         `json:"status"`
+	StatusMessage interface{} `json:"status_message"`
+	Street        string      `json:"street"`
+	To            string      `json:"to"`
+	Type          string      `json:"type"`
+	Unit          string      `json:"unit"`
+	ZipCode       string      `json:"zip_code"`
+}
+
+type Billing struct {
+	ID           int         `json:"id"`
+	RebillDay    int         `json:"rebill_day"`
+	RebillMonths int         `json:"rebill_months"`
+	RebillWeeks  interface{} `json:"rebill_weeks"`
+	RebillWindow int         `json:"rebill_window"`
+	StoreID      int         `json:"store_id"`
+	Type         string      `json:"type"`
+}
+
+type Customer struct {
+	Country   string      `json:"country"`
+	Email     string      `json:"email"`
+	FirstName string      `json:"first_name"`
+	ID        int         `json:"id"`
+	LastName  interface{} `json:"last_name"`
+	Location  string      `json:"location"`
+	Name      string      `json:"name"`
+	Status    interface{} `json:"status"`
+	Type      string      `json:"type"`
+}
+
+type Product struct {
+	Deleted           bool        `json:"deleted"`
+	Description       string      `json:"description"`
+	DisplayOrder      int         `json:"display_order"`
+	FlatShipPrice     float64     `json:"flat_ship_price"`
+	GiftShipping      int         `json:"gift_shipping"`
+	Giftable          bool        `json:"giftable"`
+	ID                int         `json:"id"`
+	Listed            bool        `json:"listed"`
+	MaxSubs           interface{} `json:"max_subs"`
+	Meta              interface{} `json:"meta"`
+	MpVisible         bool        `json:"mp_visible"`
+	Name              string      `json:"name"`
+	ProductBillingID  int         `json:"product_billing_id"`
+	ProductType       int         `json:"product_type"`
+	Reviewable        bool        `json:"reviewable"`
+	ShipOption        int         `json:"ship_option"`
+	ShipWeight        float64     `json:"ship_weight"`
+	SinglePurchasable bool        `json:"single_purchasable"`
+	Sku               string      `json:"sku"`
+	Slug              string      `json:"slug"`
+	StoreID           int         `json:"store_id"`
+	SubscribeFlow     bool        `json:"subscribe_flow"`
+	SubscribeFlowData interface{} `json:"subscribe_flow_data"`
+	Visible           bool        `json:"visible"`
+}
+
+type ProductInstance struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+	ProductID int     `json:"product_id"`
+	Sku       string  `json:"sku"`
+}
+
+type Term struct {
+	Description string      `json:"description"`
+	Enabled     bool        `json:"enabled"`
+	ID          int         `json:"id"`
+	Images      []TermImage `json:"images"` // Assuming images is an array of image objects
+	Name        string      `json:"name"`
+	NumCycles   int         `json:"num_cycles"`
+	Type        string      `json:"type"`
+}
+
+type TermImage struct {
+	ID                     int    `json:"id"`
+	SubscriptionTypeTermID int    `json:"subscription_type_term_id"`
+	Type                   string `json:"type"`
+	URL                    string `json:"url"`
+}
+
+// Structs for Orders
+type OrderGiftInfo struct {
+	GiftMessage        string `json:"gift_message"`
+	GiftRecipientEmail string `json:"gift_recipient_email"`
+	GiftRecipientName  string `json:"gift_recipient_name"`
+}
+
+type Order struct {
+	ID                   int64         `json:"id"`
+	CardRefundedAmount   int           `json:"card_refunded_amount"`
+	CreditApplied        int           `json:"credit_applied"`
+	CustomerID           int64         `json:"customer_id"`
+	FinancialStatus      string        `json:"financial_status"`
+	FulfillmentStatus    string        `json:"fulfillment_status"`
+	GiftCardDiscount     int           `json:"gift_card_discount"`
+	GiftMessage          string        `json:"gift_message"`
+	GiftRenewalNotif     bool          `json:"gift_renewal_notif"`
+	GrossShipping        int           `json:"gross_shipping"`
+	IsGift               bool          `json:"is_gift"`
+	OrderGiftInfo        OrderGiftInfo `json:"order_gift_info"`
+	IsRenewal            bool          `json:"is_renewal"`
+	IsTest               bool          `json:"is_test"`
+	Note                 string        `json:"note"`
+	PlacedAt             string        `json:"placed_at"`
+	ProratedCharge       int           `json:"prorated_charge"`
+	RefundApplied        int           `json:"refund_applied"`
+	RefundedAmount       int           `json:"refunded_amount"`
+	Status               string        `json:"status"`
+	StoreID              int64         `json:"store_id"`
+	SubTotal             int           `json:"sub_total"`
+	Total                int           `json:"total"`
+	TotalAppFees         int           `json:"total_app_fees"`
+	TotalLabelCost       int           `json:"total_label_cost"`
+	TotalPendingFees     int           `json:"total_pending_fees"`
+	TotalPrice           int           `json:"total_price"`
+	TotalShipping        int           `json:"total_shipping"`
+	TotalTax             int           `json:"total_tax"`
+	TransactionFees      int           `json:"transaction_fees"`
+	TransactionFeeStatus int           `json:"transaction_fee_status"`
+	Type                 string        `json:"type"`
+	URL                  string        `json:"url"`
+}
+
+type CratejoyOrderResponse struct {
+	Count   int         `json:"count"`
+	Next    string      `json:"next"`
+	Prev    interface{} `json:"prev"`
+	Results []Order     `json:"results"`
+}
+
+// syncOptions are the per-command settings of a sync run
+type syncOptions struct {
+	BulkLoad bool   // stream members and orders through LOAD DATA LOCAL INFILE
+	Record   string // directory to record scrubbed API fixtures to
+	Replay   string // directory to replay API fixtures from instead of calling the APIs
+}
+
+// main function
+func main() {
+	if err := configureLogging(log, os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	// The first argument selects the command, sync is the default
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// Load credentials from the configured secrets provider; the secrets
+	// command creates the provider's file and must work without it
+	if command != "secrets" {
+		provider, err := newSecretProvider()
+		if err != nil {
+			log.Fatal(err)
+		}
+		secretProvider = provider
+	}
+
+	switch command {
+	case "sync":
+		os.Exit(runSync(args))
+	case "secrets":
+		runSecrets(args)
+	case "serve":
+		runServe(args)
+	case "runs":
+		runRuns(args)
+	case "reprocess":
+		os.Exit(runReprocess(args))
+	default:
+		log.Fatalf("unknown command %q, expected sync, serve, secrets, runs or reprocess", command)
+	}
+}
+
+// runSync implements "sync [-bulk-load]", a one-shot sync of every source.
+// It returns the process exit code: exitOK, exitPartial when some entities
+// failed, or exitFailure when all of them did.
+func runSync(args []string) int {
+	var opts syncOptions
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	addSyncFlags(flags, &opts)
+	flags.Parse(args)
+
+	// RUN_TIMEOUT bounds the whole run, SIGINT/SIGTERM stop it after the current page
+	runTimeout, err := envDuration("RUN_TIMEOUT", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := withShutdown(context.Background())
+	defer stop()
+	if runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+	}
+
+	env, cleanup := prepareSync(ctx, opts)
+	defer cleanup()
+
+	results := env.runRecorded(ctx, "sync", os.Stdout, func(ctx context.Context) []syncResult {
+		results := MailChimp(ctx, env.store, env.client, opts)
+		if stopRequested(ctx) {
+			log.Warn("Skipping Cratejoy, shutdown requested")
+			return append(results,
+				failedResult(ctx, "cratejoy", "orders", interruptedErr(ctx)),
+				failedResult(ctx, "cratejoy", "subscriptions", interruptedErr(ctx)))
+		}
+		return append(results, Cratejoy(ctx, env.store, env.client, opts)...)
+	})
+	pushMetrics()
+	return exitCode(results)
+}
+
+// addSyncFlags registers the flags sync and serve share
+func addSyncFlags(flags *flag.FlagSet, opts *syncOptions) {
+	flags.BoolVar(&opts.BulkLoad, "bulk-load", false, "backfill Mailchimp members and Cratejoy orders with LOAD DATA LOCAL INFILE")
+	flags.StringVar(&opts.Record, "record", "", "record scrubbed API responses as fixtures in this directory")
+	flags.StringVar(&opts.Replay, "replay", "", "replay API responses from fixtures in this directory instead of calling the APIs")
+}
+
+// syncEnv holds what every sync shares, set up once per process
+type syncEnv struct {
+	store   Store
+	client  *apiClient
+	exports *exporter   // nil unless EXPORT_DIR is set
+	archive pageArchive // nil unless ARCHIVE is set
+	opts    syncOptions
+}
+
+// prepareSync opens the store and the shared API client, creates the
+// bookkeeping tables and starts tracing. The returned function releases them.
+func prepareSync(ctx context.Context, opts syncOptions) (*syncEnv, func()) {
+	// Missing API credentials fail here, not mid-sync; replays never call the APIs
+	if opts.Replay == "" {
+		if err := requireSecrets("apiKey", "CRATEJOY_CLIENT", "CRATEJOY_API_KEY"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//Open DB Connection
+	log.Info("Connecting to database")
+	store, err := openStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Shared HTTP client for all API fetchers
+	client, err := newAPIClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := configureAPIURLs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureFixtures(client, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	// Checkpoint and run history tables, and the entity tables for SQLite
+	if err := store.Migrate(ctx); err != nil {
+		log.WithError(err).Fatal("Failed to create tables")
+	}
+	if err := loadLastSuccess(ctx, store.DB()); err != nil {
+		log.WithError(err).Warn("Failed to load last successful syncs")
+	}
+
+	// Isolation and deadlock retries for page transactions
+	if err := configureTransactions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureUpsertCounts(); err != nil {
+		log.Fatal(err)
+	}
+
+	// One instance per entity, held with MySQL named locks
+	if err := configureLocks(); err != nil {
+		log.Fatal(err)
+	}
+
+	// File snapshots of every run, alongside or instead of the entity writes
+	exports, err := configureExport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exports != nil {
+		if opts.BulkLoad {
+			log.Fatal("-bulk-load writes straight to MySQL and cannot be combined with EXPORT_DIR")
+		}
+		store = exports.wrap(store)
+	}
+
+	// Raw page bodies, kept for reprocessing
+	archive, err := configureArchive(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// One trace per run, flushed before the process exits
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	env := &syncEnv{store: store, client: client, exports: exports, archive: archive, opts: opts}
+	return env, func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.WithError(err).Warn("Failed to flush traces")
+		}
+		store.Close()
+	}
+}
+
+// runRecorded runs sync as one run: a fresh run id in sync_runs and one trace.
+// The summary table is written to out, or only logged when out is nil.
+func (e *syncEnv) runRecorded(ctx context.Context, name string, out io.Writer, sync func(ctx context.Context) []syncResult) []syncResult {
+	recorder, err := newRunRecorder(e.store.DB(), e.store.Dialect())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx = withRunRecorder(ctx, recorder)
+	if e.archive != nil {
+		ctx = withPageArchive(ctx, e.archive)
+	}
+	log.WithFields(logrus.Fields{
+		"run_id": recorder.runID,
+		"run":    name,
+	}).Info("Starting sync run")
+
+	ctx, span := startSpan(ctx, name, attribute.String("run_id", recorder.runID))
+	startTime := time.Now()
+	var snapshot *exportSnapshot
+	if e.exports != nil {
+		snapshot = e.exports.begin(recorder.runID, startTime)
+		ctx = withExportSnapshot(ctx, snapshot)
+	}
+	results := sync(ctx)
+	if snapshot != nil {
+		if err := snapshot.finish(results); err != nil {
+			log.WithError(err).Error("Failed to finish the export snapshot")
+		}
+	}
+
+	code := exitCode(results)
+	span.SetAttributes(attribute.Int("exit_code", code))
+	if code != exitOK {
+		span.SetStatus(codes.Error, "sync failed")
+	}
+	span.End()
+
+	printRunSummary(out, recorder.runID, results, time.Since(startTime))
+	return results
+}
+
+// runSecrets implements "secrets encrypt <in.json> <out>"
+func runSecrets(args []string) {
+	if len(args) != 3 || args[0] != "encrypt" {
+		log.Fatal("usage: secrets encrypt <in.json> <out>")
+	}
+	if err := encryptSecretsFile(args[1], args[2]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// return an open database
+func opendb() (*sql.DB, error) {
+	user := loadCredential("USER")
+	pass := loadSecret("PASS")
+	server := os.Getenv("SERVER")
+	port := os.Getenv("PORT")
+	// Get a database handle.
+	log.Info("Connecting to DB...")
+	log.Debug("user:", user)
+	log.Debug("server:", server)
+	log.Debug("port:", port)
+	log.Debug("Opening Database...")
+	connectstring := user + ":" + pass + "@tcp(" + server + ":" + port + ")/customers?parseTime=true"
+	db, err := sql.Open("mysql",
+		connectstring)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	//Test Connection
+	pingErr := db.Ping()
+	if pingErr != nil {
+		log.Error(pingErr)
+		db.Close()
+		return nil, pingErr
+	}
+
+	//Success!
+	log.Info("Returning Open DB...")
+	return db, nil
+}
+
+func parseDate(dateStr string) (string, error) {
+	// Parse the input date string
+	t, err := time.Parse(time.RFC3339, dateStr)
+	if err != nil {
+		return "", err
+	}
+
+	// Return in the format MySQL expects
+	return t.Format("2006-01-02 15:04:05"), nil
+}
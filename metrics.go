@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Sync metrics live on their own registry so a Pushgateway push only carries
+// what this process measured
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_api_requests_total",
+		Help: "API requests sent, by host and response status (\"error\" when no response arrived).",
+	}, []string{"host", "status"})
+
+	apiRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_api_retries_total",
+		Help: "API requests retried after a transient failure, by host.",
+	}, []string{"host"})
+
+	pageDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_page_duration_seconds",
+		Help:    "Time to fetch, decode and write one page, by source and entity.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"source", "entity"})
+
+	rowsUpsertedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_rows_upserted_total",
+		Help: "Rows written, by table and result (inserted, updated or unchanged).",
+	}, []string{"table", "result"})
+
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_last_success_timestamp_seconds",
+		Help: "Unix time the entity last finished syncing without an error.",
+	}, []string{"source", "entity"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		apiRequestsTotal,
+		apiRetriesTotal,
+		pageDurationSeconds,
+		rowsUpsertedTotal,
+		lastSuccessTimestamp,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// observeAPIRequest counts one attempt of an API request
+func observeAPIRequest(host string, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequestsTotal.WithLabelValues(host, status).Inc()
+}
+
+// observeRows counts the rows a write did to table
+func observeRows(table string, counts rowCounts) {
+	rowsUpsertedTotal.WithLabelValues(table, "inserted").Add(float64(counts.Inserted))
+	rowsUpsertedTotal.WithLabelValues(table, "updated").Add(float64(counts.Updated))
+	rowsUpsertedTotal.WithLabelValues(table, "unchanged").Add(float64(counts.Unchanged))
+}
+
+// metricsHandler serves the registry in the Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// loadLastSuccess seeds the last success gauges from sync_runs, so an entity
+// that fails this run still reports when it last worked
+func loadLastSuccess(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT source, entity, MAX(finished_at)
+		FROM sync_runs
+		WHERE finished_at IS NOT NULL AND error IS NULL
+		GROUP BY source, entity`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var source, entity string
+		var finishedAt dbTime
+		if err := rows.Scan(&source, &entity, &finishedAt); err != nil {
+			return err
+		}
+		lastSuccessTimestamp.WithLabelValues(source, entity).Set(float64(finishedAt.Time.Unix()))
+	}
+	return rows.Err()
+}
+
+// pushMetrics sends the registry to the Pushgateway at PUSHGATEWAY_URL, if
+// set, under the job PUSHGATEWAY_JOB (default customer_sync). One-shot runs
+// end too quickly to be scraped.
+func pushMetrics() {
+	url := envString("PUSHGATEWAY_URL", "")
+	if url == "" {
+		return
+	}
+	job := envString("PUSHGATEWAY_JOB", "customer_sync")
+
+	err := push.New(url, job).
+		Gatherer(metricsRegistry).
+		Client(&http.Client{Timeout: 10 * time.Second}).
+		Push()
+	if err != nil {
+		log.WithError(err).Warn("Failed to push metrics to the Pushgateway")
+		return
+	}
+	log.WithField("job", job).Debug("Pushed metrics to the Pushgateway")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAPIClientCountsRequestsAndRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	host := mustHost(t, server.URL)
+
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+	resp, err := newTestAPIClient(2).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := testutil.ToFloat64(apiRequestsTotal.WithLabelValues(host, "503")); got != 1 {
+		t.Errorf("503 requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(apiRequestsTotal.WithLabelValues(host, "200")); got != 1 {
+		t.Errorf("200 requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(apiRetriesTotal.WithLabelValues(host)); got != 1 {
+		t.Errorf("retries = %v, want 1", got)
+	}
+}
+
+func TestMetricsHandlerExposesSyncMetrics(t *testing.T) {
+	observeRows("cj_test_table", rowCounts{Inserted: 2, Updated: 1})
+	result := newSyncResult(context.Background(), "cratejoy", "test_entity")
+	result.finish(nil)
+
+	server := httptest.NewServer(metricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		`sync_rows_upserted_total{result="inserted",table="cj_test_table"} 2`,
+		`sync_rows_upserted_total{result="updated",table="cj_test_table"} 1`,
+		`sync_last_success_timestamp_seconds{entity="test_entity",source="cratejoy"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output is missing %s", want)
+		}
+	}
+}
+
+func mustHost(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// mysqlStore is the production store. Members are written with REPLACE,
+// Cratejoy pages with INSERT ... ON DUPLICATE KEY UPDATE, orders live in the
+// orders database and entity locks are MySQL named locks, so every instance
+// sharing the server sees them.
+type mysqlStore struct {
+	sqlStore
+}
+
+// newMySQLStore wraps an open MySQL connection pool, sizing upsert batches to
+// the server's max_allowed_packet
+func newMySQLStore(ctx context.Context, db *sql.DB) *mysqlStore {
+	loadMaxAllowedPacket(ctx, db)
+	return &mysqlStore{sqlStore{db: db, dialect: mysqlDialect{}, ordersTable: "orders.cj_orders"}}
+}
+
+// Migrate creates the bookkeeping tables, and raw_pages when ARCHIVE=table;
+// the entity tables are managed outside this program
+func (s *mysqlStore) Migrate(ctx context.Context) error {
+	// Pagination checkpoints for resumable syncs
+	if err := ensureSyncState(ctx, s.db); err != nil {
+		return err
+	}
+	// Run history, every entity synced records itself in sync_runs
+	if err := ensureSyncRuns(ctx, s.db); err != nil {
+		return err
+	}
+	// Raw page archive, only created when pages are archived to it
+	if envString("ARCHIVE", "off") != "table" {
+		return nil
+	}
+	return ensureRawPages(ctx, s.db)
+}
+
+func (s *mysqlStore) UpsertMembers(ctx context.Context, listID string, members []Member) (rowCounts, error) {
+	return insertMembers(ctx, s.db, listID, members)
+}
+
+func (s *mysqlStore) Lock(ctx context.Context, source, entity string, wait time.Duration) (func(), error) {
+	lock, err := acquireEntityLock(ctx, s.db, source, entity, wait)
+	if err != nil {
+		return nil, err
+	}
+	return lock.release, nil
+}
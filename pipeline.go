@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pageWriter receives the records of one page as they are decoded and writes
+// them all when the page is committed, reporting what happened to the rows
+type pageWriter[T any] interface {
+	add(record T) error
+	commit(ctx context.Context) (rowCounts, error)
+}
+
+// cratejoyLinks holds the pagination fields of a Cratejoy page
+type cratejoyLinks struct {
+	Next string `json:"next"`
+}
+
+// pipelineItem is either a decoded record or the end of a page
+type pipelineItem[T any] struct {
+	record  T
+	pageEnd bool
+	next    string // URL of the following page, "" on the last page
+}
+
+// cratejoyPipeline streams a paginated Cratejoy endpoint into the database.
+//
+// Records are decoded straight off the response body and handed to the writer
+// through a channel of CRATEJOY_PIPELINE_BUFFER records (default 1000), so the
+// network keeps working while a page is written and a slow database applies
+// backpressure. The writer still holds a whole page until it is committed, so
+// memory grows with the page size plus the buffer.
+// Pages are written strictly in order by a single writer, one page at a time,
+// which keeps the dependent-table ordering inside each write intact and makes
+// the saved checkpoint always point just past the last committed page.
+type cratejoyPipeline[T any] struct {
+	client   *apiClient
+	store    Store
+	entity   string // checkpoint entity, e.g. "orders"
+	baseURL  string // endpoint that next-page query strings are relative to
+	username string
+	password string
+
+	// skipCheckpoints disables checkpointing, used by bulk loads that only commit at the end
+	skipCheckpoints bool
+
+	// newPage returns the writer for the next page
+	newPage func() pageWriter[T]
+}
+
+// run syncs every page starting at url
+func (p *cratejoyPipeline[T]) run(ctx context.Context, url string) syncResult {
+	result := newSyncResult(ctx, "cratejoy", p.entity)
+	buffer, err := envInt("CRATEJOY_PIPELINE_BUFFER", 1000)
+	if err != nil {
+		return result.finish(err)
+	}
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	ctx, span := startSpan(ctx, "cratejoy "+p.entity)
+	defer func() {
+		span.SetAttributes(attribute.Int("pages", result.Pages), attribute.Int("records", result.Written))
+		endSpan(span, result.Err)
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		fetched  int64
+		stopped  bool // fetching stopped early for a graceful shutdown
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	items := make(chan pipelineItem[T], buffer)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(items)
+		err := p.fetchStage(ctx, url, items, &fetched)
+		if errors.Is(err, errInterrupted) {
+			// The pages already fetched are still written
+			stopped = true
+		} else if err != nil {
+			fail(err)
+		}
+	}()
+
+	if err := p.writeStage(ctx, items, &result); err != nil {
+		fail(err)
+	}
+	wg.Wait()
+	result.Fetched = int(atomic.LoadInt64(&fetched))
+
+	if firstErr != nil && !errors.Is(firstErr, context.Canceled) {
+		return result.finish(firstErr)
+	}
+	if stopped {
+		return result.finish(interruptedErr(ctx))
+	}
+	return result.finish(ctx.Err())
+}
+
+// fetchStage follows next-page links, decoding each body as it arrives and
+// counting the records decoded in fetched. It returns errInterrupted when a
+// graceful shutdown stopped it before the last page.
+func (p *cratejoyPipeline[T]) fetchStage(ctx context.Context, url string, out chan<- pipelineItem[T], fetched *int64) error {
+	send := func(item pipelineItem[T]) error {
+		select {
+		case out <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	archive := newArchiveSession(ctx, "cratejoy", p.entity)
+	defer archive.logDone()
+
+	for {
+		links, err := p.fetchPage(ctx, url, archive, send, fetched)
+		if err != nil {
+			return err
+		}
+
+		next := ""
+		if links.Next != "" {
+			next = p.baseURL + links.Next
+		}
+		if err := send(pipelineItem[T]{pageEnd: true, next: next}); err != nil {
+			return err
+		}
+
+		// Check if there is a next page. If not, stop
+		if next == "" {
+			return nil
+		}
+		url = next
+
+		// Stop fetching between pages; the page already fetched is still written
+		if stopRequested(ctx) {
+			log.WithField("entity", p.entity).Warn("Shutdown requested, stopping Cratejoy pagination")
+			return errInterrupted
+		}
+	}
+}
+
+// fetchPage fetches one page and sends its records as they are decoded,
+// returning the page's links. The raw body goes to archive once decoded.
+func (p *cratejoyPipeline[T]) fetchPage(ctx context.Context, url string, archive *archiveSession, send func(pipelineItem[T]) error, fetched *int64) (links cratejoyLinks, err error) {
+	ctx, span := startSpan(ctx, "cratejoy.fetch_page", attribute.String("entity", p.entity))
+	records := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("records", records))
+		endSpan(span, err)
+	}()
+
+	resp, err := sendCratejoyRequest(ctx, p.client, url, p.username, p.password)
+	if err != nil {
+		return links, err
+	}
+	defer resp.Body.Close()
+
+	log.Info("Received response from Cratejoy API")
+	log.Debugf("Status Code: %d", resp.StatusCode)
+
+	// Decode records straight off the wire; next may come after the results
+	body, save := archive.capture(resp.Body)
+	err = streamPage(body, "results", &links, func(record T) error {
+		records++
+		atomic.AddInt64(fetched, 1)
+		return send(pipelineItem[T]{record: record})
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Error("Failed to decode Cratejoy response")
+		}
+		return links, err
+	}
+	save(ctx)
+	return links, nil
+}
+
+// writeStage writes pages in order and checkpoints after each one, counting
+// committed pages and records in result
+func (p *cratejoyPipeline[T]) writeStage(ctx context.Context, in <-chan pipelineItem[T], result *syncResult) error {
+	complete := false
+	records := 0
+	page := p.newPage()
+	pageStart := time.Now()
+	for item := range in {
+		if !item.pageEnd {
+			if err := page.add(item.record); err != nil {
+				return err
+			}
+			records++
+			continue
+		}
+
+		counts, err := p.commitPage(ctx, page, records)
+		if err != nil {
+			return err
+		}
+		result.rowCounts.add(counts)
+		pageDurationSeconds.WithLabelValues("cratejoy", p.entity).Observe(time.Since(pageStart).Seconds())
+		pageStart = time.Now()
+		page = p.newPage()
+		result.Pages++
+		result.Written += records
+		records = 0
+
+		if item.next == "" {
+			complete = true
+			continue
+		}
+		if p.skipCheckpoints {
+			continue
+		}
+		if err := p.store.SaveCheckpoint(ctx, "cratejoy", p.entity, item.next); err != nil {
+			log.WithError(err).Errorf("Failed to save %s checkpoint", p.entity)
+			return err
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"entity":   p.entity,
+		"pages":    result.Pages,
+		"records":  result.Written,
+		"complete": complete,
+	}).Info("Finished writing Cratejoy pages")
+
+	if !complete || p.skipCheckpoints {
+		return nil
+	}
+	return p.store.ClearCheckpoint(ctx, "cratejoy", p.entity)
+}
+
+// commitPage writes one page inside its own span
+func (p *cratejoyPipeline[T]) commitPage(ctx context.Context, page pageWriter[T], records int) (counts rowCounts, err error) {
+	ctx, span := startSpan(ctx, "cratejoy.write_page",
+		attribute.String("entity", p.entity),
+		attribute.Int("records", records),
+	)
+	defer func() {
+		span.SetAttributes(rowCountAttributes(counts)...)
+		endSpan(span, err)
+	}()
+	return page.commit(ctx)
+}
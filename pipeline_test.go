@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mailchimp/internal/fake"
+)
+
+// funcPage collects a page and hands it to write on commit
+type funcPage[T any] struct {
+	pending []T
+	write   func(ctx context.Context, records []T) error
+}
+
+func (p *funcPage[T]) add(record T) error {
+	p.pending = append(p.pending, record)
+	return nil
+}
+
+func (p *funcPage[T]) commit(ctx context.Context) (rowCounts, error) {
+	if err := p.write(ctx, p.pending); err != nil {
+		return rowCounts{}, err
+	}
+	return rowCounts{Inserted: len(p.pending)}, nil
+}
+
+// newOrdersPipeline pages through n fake orders, two per page, committing each
+// page with commit
+func newOrdersPipeline(t *testing.T, n int, commit func(ctx context.Context, orders []Order) error) (*cratejoyPipeline[Order], *fake.Cratejoy) {
+	t.Helper()
+	c := fake.NewCratejoy("user", "pass")
+	t.Cleanup(c.Close)
+	for i := 1; i <= n; i++ {
+		c.AddOrders(map[string]interface{}{"id": i, "status": "paid", "placed_at": "2024-05-01T00:00:00Z"})
+	}
+	var unused []Order
+	p := newMemoryPipeline(newTestAPIClient(0), c, "orders", &unused)
+	p.newPage = func() pageWriter[Order] { return &funcPage[Order]{write: commit} }
+	return p, c
+}
+
+func TestPipelineCommitsPagesInOrder(t *testing.T) {
+	var pages [][]int64
+	p, _ := newOrdersPipeline(t, 5, func(ctx context.Context, orders []Order) error {
+		var ids []int64
+		for _, order := range orders {
+			ids = append(ids, order.ID)
+		}
+		pages = append(pages, ids)
+		return nil
+	})
+
+	result := p.run(context.Background(), p.baseURL+"?limit=2")
+	if result.Err != nil || result.Pages != 3 || result.Written != 5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	want := [][]int64{{1, 2}, {3, 4}, {5}}
+	for i := range want {
+		if i >= len(pages) || len(pages[i]) != len(want[i]) {
+			t.Fatalf("pages %v, want %v", pages, want)
+		}
+		for j := range want[i] {
+			if pages[i][j] != want[i][j] {
+				t.Fatalf("pages %v, want %v", pages, want)
+			}
+		}
+	}
+}
+
+func TestPipelineBackpressureStopsFetching(t *testing.T) {
+	t.Setenv("CRATEJOY_PIPELINE_BUFFER", "1")
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	p, c := newOrdersPipeline(t, 10, func(ctx context.Context, orders []Order) error {
+		select {
+		case blocked <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+
+	done := make(chan syncResult)
+	go func() { done <- p.run(context.Background(), p.baseURL+"?limit=2") }()
+
+	<-blocked
+	time.Sleep(50 * time.Millisecond)
+	// The first page is being written and one record of the second fills the
+	// buffer, so nothing past the second page may have been requested
+	if requests := c.Requests(); requests > 2 {
+		t.Errorf("fetched %d pages while the first was still being written", requests)
+	}
+	close(release)
+
+	result := <-done
+	if result.Err != nil || result.Pages != 5 || result.Written != 10 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestPipelineWriterErrorStopsFetching(t *testing.T) {
+	t.Setenv("CRATEJOY_PIPELINE_BUFFER", "1")
+	errWrite := errors.New("write failed")
+	p, c := newOrdersPipeline(t, 10, func(ctx context.Context, orders []Order) error {
+		return errWrite
+	})
+
+	result := p.run(context.Background(), p.baseURL+"?limit=2")
+	if !errors.Is(result.Err, errWrite) {
+		t.Fatalf("expected the write error, got %v", result.Err)
+	}
+	if result.Pages != 0 || result.Written != 0 {
+		t.Errorf("expected nothing written, got %+v", result)
+	}
+	if requests := c.Requests(); requests >= 5 {
+		t.Errorf("expected fetching to stop early, got %d requests", requests)
+	}
+}
+
+func TestPipelineCancelStopsWriting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, _ := newOrdersPipeline(t, 10, func(ctx context.Context, orders []Order) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	result := p.run(ctx, p.baseURL+"?limit=2")
+	if !errors.Is(result.Err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", result.Err)
+	}
+	if result.Pages != 0 || result.Written != 0 {
+		t.Errorf("expected nothing written, got %+v", result)
+	}
+}
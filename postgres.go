@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/sirupsen/logrus"
+)
+
+// postgresMigrations are applied in order, each exactly once, and recorded in
+// schema_migrations. Applied steps must never change; alter the schema by
+// appending a new one.
+var postgresMigrations = []string{
+	// 1: checkpoints and run history
+	`CREATE TABLE sync_state (
+		source TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		cursor_value TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (source, entity)
+	);
+	CREATE TABLE sync_runs (
+		id BIGSERIAL PRIMARY KEY,
+		run_id TEXT NOT NULL,
+		source TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL,
+		finished_at TIMESTAMPTZ NULL,
+		pages INTEGER NOT NULL DEFAULT 0,
+		fetched INTEGER NOT NULL DEFAULT 0,
+		inserted INTEGER NOT NULL DEFAULT 0,
+		updated INTEGER NOT NULL DEFAULT 0,
+		unchanged INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		error TEXT NULL
+	);
+	CREATE INDEX sync_runs_run_id ON sync_runs (run_id);
+	CREATE INDEX sync_runs_started_at ON sync_runs (started_at)`,
+
+	// 2: Mailchimp members and Cratejoy entities
+	`CREATE TABLE mailchimp (
+		list_id TEXT NOT NULL,
+		contact_id TEXT NOT NULL,
+		email TEXT,
+		status TEXT,
+		full_name TEXT,
+		PRIMARY KEY (list_id, contact_id)
+	);
+	CREATE TABLE cj_orders (
+		id BIGINT PRIMARY KEY,
+		card_refunded_amount INTEGER, credit_applied INTEGER, customer_id BIGINT,
+		financial_status TEXT, fulfillment_status TEXT, gift_card_discount INTEGER,
+		gift_message TEXT, gift_renewal_notif BOOLEAN, gross_shipping INTEGER, is_gift BOOLEAN,
+		order_gift_info JSONB, is_renewal BOOLEAN, is_test BOOLEAN, note TEXT,
+		placed_at TIMESTAMPTZ, prorated_charge INTEGER, refund_applied INTEGER, refunded_amount INTEGER,
+		status TEXT, store_id BIGINT, sub_total INTEGER, total INTEGER, total_app_fees INTEGER,
+		total_label_cost INTEGER, total_pending_fees INTEGER, total_price INTEGER, total_shipping INTEGER,
+		total_tax INTEGER, transaction_fees INTEGER, transaction_fee_status INTEGER, type TEXT, url TEXT
+	);
+	CREATE INDEX cj_orders_placed_at ON cj_orders (placed_at);
+	CREATE TABLE cj_addresses (
+		id BIGINT PRIMARY KEY,
+		city TEXT, company TEXT, country TEXT, icon TEXT, phone_number TEXT, state TEXT,
+		status INTEGER, status_message TEXT, street TEXT, to_name TEXT, type TEXT, unit TEXT, zip_code TEXT
+	);
+	CREATE TABLE cj_billings (
+		id BIGINT PRIMARY KEY,
+		rebill_day INTEGER, rebill_months INTEGER, rebill_weeks TEXT, rebill_window INTEGER,
+		store_id BIGINT, type TEXT
+	);
+	CREATE TABLE cj_customers (
+		id BIGINT PRIMARY KEY,
+		country TEXT, email TEXT, first_name TEXT, last_name TEXT, location TEXT, name TEXT,
+		status TEXT, type TEXT
+	);
+	CREATE TABLE cj_products (
+		id BIGINT PRIMARY KEY,
+		deleted BOOLEAN, description TEXT, display_order INTEGER, flat_ship_price DOUBLE PRECISION,
+		gift_shipping DOUBLE PRECISION, giftable BOOLEAN, listed BOOLEAN, max_subs TEXT, meta JSONB,
+		mp_visible BOOLEAN, name TEXT, product_billing_id BIGINT, product_type INTEGER,
+		reviewable BOOLEAN, ship_option INTEGER, ship_weight DOUBLE PRECISION, single_purchasable BOOLEAN,
+		sku TEXT, slug TEXT, store_id BIGINT, subscribe_flow BOOLEAN, subscribe_flow_data JSONB,
+		visible BOOLEAN
+	);
+	CREATE TABLE cj_product_instances (
+		id BIGINT PRIMARY KEY,
+		name TEXT, price DOUBLE PRECISION, product_id BIGINT, sku TEXT
+	);
+	CREATE TABLE cj_terms (
+		id BIGINT PRIMARY KEY,
+		description TEXT, enabled BOOLEAN, name TEXT, num_cycles INTEGER, type TEXT, images JSONB
+	);
+	CREATE TABLE cj_subscriptions (
+		id BIGINT PRIMARY KEY,
+		address_id BIGINT, billing_id BIGINT, customer_id BIGINT, product_id BIGINT,
+		product_instance_id BIGINT, term_id BIGINT, autorenew BOOLEAN, billing_name TEXT,
+		credit TEXT, end_date TIMESTAMPTZ, is_test BOOLEAN, note TEXT, skipped_date TEXT,
+		source INTEGER, start_date TIMESTAMPTZ, status TEXT, store_id BIGINT, type TEXT, url TEXT
+	)`,
+
+	// 3: raw page archive
+	`CREATE TABLE raw_pages (
+		id BIGSERIAL PRIMARY KEY,
+		source TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		synced_at TIMESTAMPTZ NOT NULL,
+		page INTEGER NOT NULL,
+		body BYTEA NOT NULL
+	);
+	CREATE INDEX raw_pages_entity ON raw_pages (source, entity, synced_at, page)`,
+}
+
+// How often a busy advisory lock is tried again while waiting for it
+const postgresLockPoll = 250 * time.Millisecond
+
+// postgresStore writes to PostgreSQL with INSERT ... ON CONFLICT DO UPDATE.
+// The JSON the MySQL tables keep as text is stored as JSONB and dates as
+// timestamptz. Entity locks are session advisory locks, so every instance
+// sharing the server sees them.
+type postgresStore struct {
+	sqlStore
+}
+
+// postgresDSN builds the connection URL from the USER and PASS secrets, SERVER,
+// PORT (default 5432), POSTGRES_DATABASE (default customers) and
+// POSTGRES_SSLMODE (default prefer)
+func postgresDSN() string {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(loadCredential("USER"), loadSecret("PASS")),
+		Host:     net.JoinHostPort(envString("SERVER", "localhost"), envString("PORT", "5432")),
+		Path:     "/" + envString("POSTGRES_DATABASE", "customers"),
+		RawQuery: url.Values{"sslmode": {envString("POSTGRES_SSLMODE", "prefer")}}.Encode(),
+	}
+	return dsn.String()
+}
+
+// openPostgresStore connects to the database at dsn
+func openPostgresStore(ctx context.Context, dsn string) (*postgresStore, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the PostgreSQL connection URL: %w", err)
+	}
+	// Sessions run in UTC whatever the server default, like the other stores
+	config.RuntimeParams["timezone"] = "UTC"
+
+	db := stdlib.OpenDB(*config)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to PostgreSQL at %s: %w", config.Host, err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"host":     config.Host,
+		"database": config.Database,
+	}).Info("Opened PostgreSQL store")
+	return &postgresStore{sqlStore{db: db, dialect: postgresDialect{}, ordersTable: "cj_orders"}}, nil
+}
+
+// Migrate applies the migrations the database has not seen yet, all in one
+// transaction. Instances starting together take turns on an advisory lock.
+func (s *postgresStore) Migrate(ctx context.Context) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('customer-sync:migrate'))"); err != nil {
+			return fmt.Errorf("locking migrations: %w", err)
+		}
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+		if err != nil {
+			return fmt.Errorf("creating schema_migrations: %w", err)
+		}
+
+		var current int
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+			return err
+		}
+		if current > len(postgresMigrations) {
+			return fmt.Errorf("database schema version %d is newer than this program's %d", current, len(postgresMigrations))
+		}
+
+		for version := current + 1; version <= len(postgresMigrations); version++ {
+			if _, err := tx.ExecContext(ctx, postgresMigrations[version-1]); err != nil {
+				return fmt.Errorf("applying migration %d: %w", version, err)
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+				return err
+			}
+			log.WithField("version", version).Info("Applied PostgreSQL migration")
+		}
+		return nil
+	})
+}
+
+// Lock takes a session advisory lock on its own connection, polling while
+// someone else holds it. The lock goes away with the session if the process
+// dies without unlocking.
+func (s *postgresStore) Lock(ctx context.Context, source, entity string, wait time.Duration) (func(), error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := lockName(source, entity)
+	deadline := time.Now().Add(wait)
+	for {
+		var acquired bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&acquired); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("acquiring lock %s: %w", name, err)
+		}
+		if acquired {
+			break
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			conn.Close()
+			return nil, errLockHeld
+		}
+		if err := sleepContext(ctx, min(remaining, postgresLockPoll)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", name); err != nil {
+			log.WithError(err).Warnf("Failed to release lock %s", name)
+		}
+		conn.Close()
+	}
+	return unlock, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runReprocess implements "reprocess [-source s] [-entity e] [-since t] [-until t] [-list]",
+// which writes archived pages to the store again without calling the APIs, so
+// fields added to the structs can be backfilled from history. Runs are not
+// recorded in sync_runs since nothing new was fetched. It returns the process
+// exit code like runSync.
+func runReprocess(args []string) int {
+	var filter archiveFilter
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	flags.StringVar(&filter.Source, "source", "", "only reprocess this source, mailchimp or cratejoy")
+	flags.StringVar(&filter.Entity, "entity", "", "only reprocess this entity, e.g. orders or members:<list id>")
+	since := flags.String("since", "", "only reprocess syncs started at or after this time, RFC 3339 or YYYY-MM-DD")
+	until := flags.String("until", "", "only reprocess syncs started before this time, RFC 3339 or YYYY-MM-DD")
+	list := flags.Bool("list", false, "list the archived syncs instead of reprocessing them")
+	flags.Parse(args)
+
+	var err error
+	if filter.Since, err = parseArchiveTime(*since); err != nil {
+		log.Fatal(err)
+	}
+	if filter.Until, err = parseArchiveTime(*until); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := withShutdown(context.Background())
+	defer stop()
+
+	store, err := openStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Migrate(ctx); err != nil {
+		log.WithError(err).Fatal("Failed to create tables")
+	}
+	if err := configureTransactions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureUpsertCounts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureLocks(); err != nil {
+		log.Fatal(err)
+	}
+	exports, err := configureExport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if exports != nil {
+		store = exports.wrap(store)
+	}
+	archive, err := configureArchive(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if archive == nil {
+		log.Fatal("reprocess reads the raw archive, set ARCHIVE to file or table")
+	}
+
+	pages, err := archive.list(ctx, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *list {
+		printArchivedSyncs(os.Stdout, pages)
+		return exitOK
+	}
+
+	startTime := time.Now()
+	var snapshot *exportSnapshot
+	if exports != nil {
+		runID, err := newRunID()
+		if err != nil {
+			log.Fatal(err)
+		}
+		snapshot = exports.begin(runID, startTime)
+		ctx = withExportSnapshot(ctx, snapshot)
+	}
+	results := reprocessPages(ctx, store, archive, pages)
+	if snapshot != nil {
+		if err := snapshot.finish(results); err != nil {
+			log.WithError(err).Error("Failed to finish the export snapshot")
+		}
+	}
+	printRunSummary(os.Stdout, "", results, time.Since(startTime))
+	return exitCode(results)
+}
+
+// parseArchiveTime parses a -since or -until flag, zero when empty
+func parseArchiveTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// reprocessPages writes pages, as ordered by pageArchive.list, entity by
+// entity under the entity's lock. Older syncs are written first so the newest
+// archived state of every record wins.
+func reprocessPages(ctx context.Context, store Store, archive pageArchive, pages []archivedPage) []syncResult {
+	var results []syncResult
+	for start := 0; start < len(pages); {
+		end := start + 1
+		for end < len(pages) && pages[end].Source == pages[start].Source && pages[end].Entity == pages[start].Entity {
+			end++
+		}
+		source, entity, entityPages := pages[start].Source, pages[start].Entity, pages[start:end]
+		start = end
+
+		if stopRequested(ctx) {
+			log.Warn("Shutdown requested, stopping reprocessing")
+			break
+		}
+		results = append(results, syncLocked(ctx, store, source, entity, func(ctx context.Context) syncResult {
+			return reprocessEntity(ctx, store, archive, source, entity, entityPages)
+		}))
+	}
+	return results
+}
+
+// reprocessEntity writes the archived pages of one entity, stopping at the
+// first page that fails
+func reprocessEntity(ctx context.Context, store Store, archive pageArchive, source, entity string, pages []archivedPage) syncResult {
+	result := newSyncResult(ctx, source, entity)
+	log.WithFields(logrus.Fields{
+		"source": source,
+		"entity": entity,
+		"pages":  len(pages),
+	}).Info("Reprocessing archived pages")
+
+	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return result.finish(err)
+		}
+		gz, err := archive.get(ctx, page)
+		if err != nil {
+			return result.finish(err)
+		}
+		records, counts, err := reprocessPage(ctx, store, page, gz)
+		result.Fetched += records
+		if err != nil {
+			return result.finish(fmt.Errorf("page %s: %w", page, err))
+		}
+		result.Pages++
+		result.Written += records
+		result.rowCounts.add(counts)
+	}
+	return result.finish(nil)
+}
+
+// reprocessPage decodes one gzipped page body and writes its records the way
+// the sync that fetched it would have
+func reprocessPage(ctx context.Context, store Store, page archivedPage, gz []byte) (int, rowCounts, error) {
+	switch {
+	case page.Source == "cratejoy" && page.Entity == "orders":
+		orders, err := decodeArchivedPage[Order](gz, "results")
+		if err != nil {
+			return 0, rowCounts{}, err
+		}
+		counts, err := store.UpsertOrders(ctx, orders)
+		return len(orders), counts, err
+	case page.Source == "cratejoy" && page.Entity == "subscriptions":
+		subscriptions, err := decodeArchivedPage[Subscription](gz, "results")
+		if err != nil {
+			return 0, rowCounts{}, err
+		}
+		counts, err := store.UpsertSubscriptions(ctx, subscriptions)
+		return len(subscriptions), counts, err
+	case page.Source == "mailchimp" && strings.HasPrefix(page.Entity, "members:"):
+		members, err := decodeArchivedPage[Member](gz, "members")
+		if err != nil {
+			return 0, rowCounts{}, err
+		}
+		counts, err := store.UpsertMembers(ctx, strings.TrimPrefix(page.Entity, "members:"), members)
+		return len(members), counts, err
+	}
+	return 0, rowCounts{}, fmt.Errorf("cannot reprocess %s %s", page.Source, page.Entity)
+}
+
+// decodeArchivedPage decodes the records under arrayKey of a gzipped page body
+func decodeArchivedPage[T any](gz []byte, arrayKey string) ([]T, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var records []T
+	var rest struct{}
+	err = streamPage(zr, arrayKey, &rest, func(record T) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// printArchivedSyncs writes one line per archived entity sync to out
+func printArchivedSyncs(out io.Writer, pages []archivedPage) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tENTITY\tSYNCED AT\tPAGES")
+	for start := 0; start < len(pages); {
+		end := start + 1
+		for end < len(pages) && pages[end].Source == pages[start].Source &&
+			pages[end].Entity == pages[start].Entity && pages[end].SyncedAt.Equal(pages[start].SyncedAt) {
+			end++
+		}
+		page := pages[start]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", page.Source, page.Entity, page.SyncedAt.UTC().Format(time.RFC3339), end-start)
+		start = end
+	}
+	w.Flush()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Every entity synced by a run gets a sync_runs row when it starts, updated when
+// it finishes. A row left without finished_at belongs to a run that crashed.
+const syncRunsSchema = `
+	CREATE TABLE IF NOT EXISTS sync_runs (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		run_id CHAR(32) NOT NULL,
+		source VARCHAR(32) NOT NULL,
+		entity VARCHAR(191) NOT NULL,
+		started_at DATETIME(3) NOT NULL,
+		finished_at DATETIME(3) NULL,
+		pages INT NOT NULL DEFAULT 0,
+		fetched INT NOT NULL DEFAULT 0,
+		inserted INT NOT NULL DEFAULT 0,
+		updated INT NOT NULL DEFAULT 0,
+		unchanged INT NOT NULL DEFAULT 0,
+		failed INT NOT NULL DEFAULT 0,
+		error TEXT NULL,
+		PRIMARY KEY (id),
+		KEY sync_runs_run_id (run_id),
+		KEY sync_runs_started_at (started_at)
+	)`
+
+// ensureSyncRuns creates the sync_runs table if it is missing
+func ensureSyncRuns(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, syncRunsSchema)
+	return err
+}
+
+// runRecorder writes the sync_runs rows of one run
+type runRecorder struct {
+	db      *sql.DB
+	dialect sqlDialect
+	runID   string
+}
+
+type runRecorderKey struct{}
+
+// newRunRecorder starts a run with a fresh random id
+func newRunRecorder(db *sql.DB, dialect sqlDialect) (*runRecorder, error) {
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+	return &runRecorder{db: db, dialect: dialect, runID: runID}, nil
+}
+
+// newRunID returns a random 32 character hex run id
+func newRunID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// withRunRecorder makes every syncResult started under ctx record itself
+func withRunRecorder(ctx context.Context, recorder *runRecorder) context.Context {
+	return context.WithValue(ctx, runRecorderKey{}, recorder)
+}
+
+// runRecorderFrom returns the recorder of ctx, nil when runs are not recorded
+func runRecorderFrom(ctx context.Context) *runRecorder {
+	recorder, _ := ctx.Value(runRecorderKey{}).(*runRecorder)
+	return recorder
+}
+
+// start inserts the row for an entity and returns its id
+func (r *runRecorder) start(ctx context.Context, source, entity string, startedAt time.Time) (int64, error) {
+	return r.dialect.insertID(ctx, r.db,
+		r.dialect.rebind("INSERT INTO sync_runs (run_id, source, entity, started_at) VALUES (?, ?, ?, ?)"),
+		r.runID, source, entity, startedAt.UTC())
+}
+
+// finish stores the outcome of an entity. It runs on its own context so that
+// entities stopped by a cancelled run are still recorded.
+func (r *runRecorder) finish(rowID int64, result syncResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var errText interface{}
+	if result.Err != nil {
+		errText = redact(result.Err.Error())
+	}
+	_, err := r.db.ExecContext(ctx,
+		r.dialect.rebind(`UPDATE sync_runs SET finished_at = ?, pages = ?, fetched = ?, inserted = ?, updated = ?,
+			unchanged = ?, failed = ?, error = ? WHERE id = ?`),
+		time.Now().UTC(), result.Pages, result.Fetched, result.Inserted, result.Updated,
+		result.Unchanged, result.Failed, errText, rowID)
+	return err
+}
+
+// runRuns implements "runs list [-limit n]" and "runs show <run id>"
+func runRuns(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: runs list [-limit n] | runs show <run id>")
+	}
+
+	ctx := context.Background()
+	store, err := openStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("runs list", flag.ExitOnError)
+		limit := flags.Int("limit", 20, "number of runs to show")
+		flags.Parse(args[1:])
+		err = listRuns(ctx, store, os.Stdout, *limit)
+	case "show":
+		if len(args) != 2 {
+			log.Fatal("usage: runs show <run id>")
+		}
+		err = showRun(ctx, store, os.Stdout, args[1])
+	default:
+		log.Fatalf("unknown runs command %q, expected list or show", args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listRuns prints the most recent runs, one line per run. A run is shown as
+// running until every one of its entities has finished.
+func listRuns(ctx context.Context, store Store, out io.Writer, limit int) error {
+	rows, err := store.DB().QueryContext(ctx, store.Dialect().rebind(`
+		SELECT run_id, MIN(started_at), MAX(finished_at), COUNT(*),
+			SUM(CASE WHEN finished_at IS NULL THEN 1 ELSE 0 END), SUM(CASE WHEN error IS NULL THEN 0 ELSE 1 END),
+			SUM(fetched), SUM(inserted), SUM(updated), SUM(unchanged), SUM(failed)
+		FROM sync_runs
+		GROUP BY run_id
+		ORDER BY MIN(started_at) DESC
+		LIMIT ?`), limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tSTARTED\tDURATION\tENTITIES\tRUNNING\tFAILED\tFETCHED\tINSERTED\tUPDATED\tUNCHANGED\tFAILED RECORDS")
+	for rows.Next() {
+		var (
+			runID                                                string
+			startedAt, finishedAt                                dbTime
+			entities, running, failed                            int
+			fetched, inserted, updated, unchanged, failedRecords int
+		)
+		if err := rows.Scan(&runID, &startedAt, &finishedAt, &entities, &running, &failed,
+			&fetched, &inserted, &updated, &unchanged, &failedRecords); err != nil {
+			return err
+		}
+		if running > 0 {
+			finishedAt.Valid = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			runID, startedAt.Time.Format(time.RFC3339), runDuration(startedAt.Time, sql.NullTime(finishedAt)),
+			entities, running, failed, fetched, inserted, updated, unchanged, failedRecords)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// showRun prints every entity of one run
+func showRun(ctx context.Context, store Store, out io.Writer, runID string) error {
+	rows, err := store.DB().QueryContext(ctx, store.Dialect().rebind(`
+		SELECT source, entity, started_at, finished_at, pages, fetched, inserted, updated, unchanged, failed, error
+		FROM sync_runs
+		WHERE run_id = ?
+		ORDER BY id`), runID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tENTITY\tSTARTED\tDURATION\tPAGES\tFETCHED\tINSERTED\tUPDATED\tUNCHANGED\tFAILED\tERROR")
+	found := false
+	for rows.Next() {
+		found = true
+		var (
+			source, entity                                       string
+			startedAt, finishedAt                                dbTime
+			pages, fetched, inserted, updated, unchanged, failed int
+			errText                                              sql.NullString
+		)
+		if err := rows.Scan(&source, &entity, &startedAt, &finishedAt, &pages, &fetched,
+			&inserted, &updated, &unchanged, &failed, &errText); err != nil {
+			return err
+		}
+		status := "-"
+		if errText.Valid {
+			status = errText.String
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			source, entity, startedAt.Time.Format(time.RFC3339), runDuration(startedAt.Time, sql.NullTime(finishedAt)),
+			pages, fetched, inserted, updated, unchanged, failed, status)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("run " + runID + " not found")
+	}
+	return w.Flush()
+}
+
+// runDuration formats how long a run or entity took, "running" when unfinished
+func runDuration(startedAt time.Time, finishedAt sql.NullTime) string {
+	if !finishedAt.Valid {
+		return "running"
+	}
+	return finishedAt.Time.Sub(startedAt).Round(time.Millisecond).String()
+}
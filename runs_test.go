@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRecorderContext(t *testing.T) {
+	if runRecorderFrom(context.Background()) != nil {
+		t.Fatal("expected no recorder on a plain context")
+	}
+	recorder, err := newRunRecorder(nil, mysqlDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.runID) != 32 {
+		t.Errorf("expected a 32 character run id, got %q", recorder.runID)
+	}
+	ctx := withRunRecorder(context.Background(), recorder)
+	if runRecorderFrom(ctx) != recorder {
+		t.Error("expected the recorder back from the context")
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := runDuration(started, sql.NullTime{}); got != "running" {
+		t.Errorf("unfinished run = %q, want running", got)
+	}
+	finished := sql.NullTime{Time: started.Add(90 * time.Second), Valid: true}
+	if got := runDuration(started, finished); got != "1m30s" {
+		t.Errorf("finished run = %q, want 1m30s", got)
+	}
+}
+
+func TestListAndShowRuns(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	recorder, err := newRunRecorder(store.DB(), store.Dialect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withRunRecorder(context.Background(), recorder)
+	orders := newSyncResult(ctx, "cratejoy", "orders")
+	orders.Fetched, orders.Inserted = 3, 3
+	orders.finish(nil)
+	members := newSyncResult(ctx, "mailchimp", "members:list1")
+
+	listed := func() []string {
+		t.Helper()
+		var out strings.Builder
+		if err := listRuns(context.Background(), store, &out, 10); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], recorder.runID) {
+			t.Fatalf("expected a header and one run, got\n%s", out.String())
+		}
+		return strings.Fields(lines[1])
+	}
+	// RUN ID, STARTED, DURATION, ENTITIES, RUNNING, FAILED, FETCHED, INSERTED, ...
+	if run := listed(); run[2] != "running" || run[3] != "2" || run[4] != "1" || run[5] != "0" || run[7] != "3" {
+		t.Errorf("run with an unfinished entity listed as %v", run)
+	}
+
+	members.finish(errors.New("API Key Invalid"))
+	if run := listed(); run[2] == "running" || run[4] != "0" || run[5] != "1" {
+		t.Errorf("finished run listed as %v", run)
+	}
+
+	var shown strings.Builder
+	if err := showRun(context.Background(), store, &shown, recorder.runID); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(shown.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "cratejoy") || !strings.HasSuffix(lines[1], " -") ||
+		!strings.HasPrefix(lines[2], "mailchimp") || !strings.HasSuffix(lines[2], "API Key Invalid") {
+		t.Errorf("unexpected run details\n%s", shown.String())
+	}
+	if err := showRun(context.Background(), store, &shown, "missing"); err == nil {
+		t.Error("expected an error for an unknown run")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// syncEntity is a unit serve can schedule and trigger on its own
+type syncEntity struct {
+	name string
+	sync func(ctx context.Context, env *syncEnv) []syncResult
+	// runs lists the "source entity" names its syncs record in sync_runs
+	runs func() []string
+}
+
+// syncEntities lists every entity this binary knows how to sync. Each is
+// scheduled by the cron expression in SCHEDULE_<NAME>, e.g. SCHEDULE_ORDERS.
+var syncEntities = []syncEntity{
+	{name: "members", sync: func(ctx context.Context, env *syncEnv) []syncResult {
+		return MailChimp(ctx, env.store, env.client, env.opts)
+	}, runs: func() []string {
+		var runs []string
+		for _, listID := range strings.Split(os.Getenv("listID"), ",") {
+			if listID != "" {
+				runs = append(runs, "mailchimp members:"+listID)
+			}
+		}
+		return runs
+	}},
+	{name: "orders", sync: func(ctx context.Context, env *syncEnv) []syncResult {
+		return CratejoyOrders(ctx, env.store, env.client, env.opts)
+	}, runs: func() []string { return []string{"cratejoy orders"} }},
+	{name: "subscriptions", sync: func(ctx context.Context, env *syncEnv) []syncResult {
+		return CratejoySubscriptions(ctx, env.store, env.client, env.opts)
+	}, runs: func() []string { return []string{"cratejoy subscriptions"} }},
+}
+
+var (
+	errUnknownEntity  = errors.New("unknown entity")
+	errAlreadyRunning = errors.New("sync already running")
+	errShuttingDown   = errors.New("shutting down")
+)
+
+// scheduledEntity is an entity with its schedule and overlap guard
+type scheduledEntity struct {
+	name     string
+	schedule cron.Schedule // nil when the entity only runs on demand
+	sync     func(ctx context.Context) []syncResult
+	runs     []string // sync_runs names, see syncEntity
+	running  atomic.Bool
+}
+
+// scheduler runs each entity on its own cron schedule. An entity never runs
+// twice at once: a tick or trigger that arrives while it is still running is
+// skipped. Every tick is delayed by a random jitter so several instances, or
+// several entities on the same schedule, do not all hit the APIs at once.
+type scheduler struct {
+	ctx      context.Context
+	entities []*scheduledEntity
+	jitter   time.Duration
+	loops    sync.WaitGroup
+	runs     sync.WaitGroup
+}
+
+// newScheduler reads SCHEDULE_<NAME> for every entity (a standard 5-field
+// cron expression or a descriptor such as @hourly, default @hourly; "off"
+// leaves the entity to manual triggers) and SCHEDULE_JITTER (default 30s)
+func newScheduler(ctx context.Context, env *syncEnv) (*scheduler, error) {
+	jitter, err := envDuration("SCHEDULE_JITTER", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s := &scheduler{ctx: ctx, jitter: jitter}
+
+	for _, entity := range syncEntities {
+		entity := entity
+		variable := "SCHEDULE_" + strings.ToUpper(entity.name)
+		scheduled := &scheduledEntity{
+			name: entity.name,
+			runs: entity.runs(),
+			sync: func(ctx context.Context) []syncResult {
+				return env.runRecorded(ctx, "sync "+entity.name, nil, func(ctx context.Context) []syncResult {
+					return entity.sync(ctx, env)
+				})
+			},
+		}
+		if spec := envString(variable, "@hourly"); spec != "off" {
+			schedule, err := cron.ParseStandard(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", variable, spec, err)
+			}
+			scheduled.schedule = schedule
+		}
+		s.entities = append(s.entities, scheduled)
+	}
+	return s, nil
+}
+
+// scheduledRuns lists the sync_runs names of every entity on a schedule,
+// the ones expected to stay fresh
+func (s *scheduler) scheduledRuns() []string {
+	var runs []string
+	for _, entity := range s.entities {
+		if entity.schedule != nil {
+			runs = append(runs, entity.runs...)
+		}
+	}
+	return runs
+}
+
+// start launches a loop per scheduled entity; they stop when a shutdown is requested
+func (s *scheduler) start() {
+	for _, entity := range s.entities {
+		if entity.schedule == nil {
+			log.WithField("entity", entity.name).Info("Entity is not scheduled, manual triggers only")
+			continue
+		}
+		s.loops.Add(1)
+		go s.loop(entity)
+	}
+}
+
+// loop fires an entity on its schedule
+func (s *scheduler) loop(entity *scheduledEntity) {
+	defer s.loops.Done()
+	for {
+		next := entity.schedule.Next(time.Now())
+		if s.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+		}
+		log.WithFields(logrus.Fields{
+			"entity": entity.name,
+			"next":   next,
+		}).Debug("Scheduled next sync")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			if err := s.trigger(entity.name); errors.Is(err, errAlreadyRunning) {
+				log.WithField("entity", entity.name).Warn("Skipping scheduled sync, previous run still going")
+			}
+		case <-stopSignal(s.ctx):
+			timer.Stop()
+			return
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// trigger starts a sync of the named entity in the background
+func (s *scheduler) trigger(name string) error {
+	if stopRequested(s.ctx) {
+		return errShuttingDown
+	}
+	var entity *scheduledEntity
+	for _, candidate := range s.entities {
+		if candidate.name == name {
+			entity = candidate
+		}
+	}
+	if entity == nil {
+		return errUnknownEntity
+	}
+	if !entity.running.CompareAndSwap(false, true) {
+		return errAlreadyRunning
+	}
+
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		defer entity.running.Store(false)
+		entity.sync(s.ctx)
+	}()
+	return nil
+}
+
+// wait blocks until the loops have stopped and running syncs have finished
+func (s *scheduler) wait() {
+	s.loops.Wait()
+	s.runs.Wait()
+}
+
+// ServeHTTP handles POST /trigger/<entity>
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/trigger/"), "/")
+
+	err := s.trigger(name)
+	switch {
+	case err == nil:
+		log.WithField("entity", name).Info("Sync triggered manually")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "sync of %s started\n", name)
+	case errors.Is(err, errUnknownEntity):
+		http.Error(w, fmt.Sprintf("unknown entity %q", name), http.StatusNotFound)
+	case errors.Is(err, errAlreadyRunning):
+		http.Error(w, fmt.Sprintf("sync of %s already running", name), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
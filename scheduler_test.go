@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// newTestScheduler schedules a single entity whose sync blocks until release is closed
+func newTestScheduler(ctx context.Context, release <-chan struct{}, runs chan<- string) *scheduler {
+	return &scheduler{
+		ctx: ctx,
+		entities: []*scheduledEntity{{
+			name: "orders",
+			sync: func(ctx context.Context) []syncResult {
+				runs <- "orders"
+				<-release
+				return nil
+			},
+		}},
+	}
+}
+
+func TestSchedulerPreventsOverlap(t *testing.T) {
+	release := make(chan struct{})
+	runs := make(chan string, 4)
+	s := newTestScheduler(context.Background(), release, runs)
+
+	if err := s.trigger("orders"); err != nil {
+		t.Fatal(err)
+	}
+	<-runs
+	if err := s.trigger("orders"); !errors.Is(err, errAlreadyRunning) {
+		t.Fatalf("expected errAlreadyRunning, got %v", err)
+	}
+	if err := s.trigger("campaigns"); !errors.Is(err, errUnknownEntity) {
+		t.Fatalf("expected errUnknownEntity, got %v", err)
+	}
+
+	close(release)
+	s.wait()
+	if err := s.trigger("orders"); err != nil {
+		t.Fatalf("expected a new run once the first finished, got %v", err)
+	}
+	s.wait()
+}
+
+func TestSchedulerRunsOnSchedule(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	runs := make(chan string, 4)
+	ctx, stop := withShutdown(context.Background())
+	defer stop()
+
+	s := newTestScheduler(ctx, release, runs)
+	s.entities[0].schedule = cron.Every(time.Second)
+	s.start()
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled sync did not run")
+	}
+	stop()
+	s.wait()
+}
+
+func TestTriggerEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	runs := make(chan string, 4)
+	s := newTestScheduler(context.Background(), release, runs)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post(server.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/trigger/orders"); code != http.StatusAccepted {
+		t.Errorf("first trigger = %d, want 202", code)
+	}
+	<-runs
+	if code := post("/trigger/orders"); code != http.StatusConflict {
+		t.Errorf("overlapping trigger = %d, want 409", code)
+	}
+	if code := post("/trigger/shipments"); code != http.StatusNotFound {
+		t.Errorf("unknown entity = %d, want 404", code)
+	}
+	resp, err := http.Get(server.URL + "/trigger/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", resp.StatusCode)
+	}
+
+	close(release)
+	s.wait()
+}
+
+func TestNewSchedulerParsesSchedules(t *testing.T) {
+	t.Setenv("SCHEDULE_ORDERS", "*/15 * * * *")
+	t.Setenv("SCHEDULE_SUBSCRIPTIONS", "off")
+	t.Setenv("listID", "list1,list2")
+	s, err := newScheduler(context.Background(), &syncEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entity := range s.entities {
+		switch entity.name {
+		case "subscriptions":
+			if entity.schedule != nil {
+				t.Error("subscriptions should only run on demand")
+			}
+		default:
+			if entity.schedule == nil {
+				t.Errorf("%s should be scheduled", entity.name)
+			}
+		}
+	}
+	want := []string{"mailchimp members:list1", "mailchimp members:list2", "cratejoy orders"}
+	if runs := s.scheduledRuns(); !reflect.DeepEqual(runs, want) {
+		t.Errorf("scheduledRuns() = %v, want %v", runs, want)
+	}
+
+	t.Setenv("SCHEDULE_ORDERS", "every tuesday")
+	if _, err := newScheduler(context.Background(), &syncEnv{}); err == nil {
+		t.Error("expected an error for an invalid cron expression")
+	}
+}
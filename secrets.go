@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSecretNotFound is returned when a provider has no value for a secret
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider looks up credentials by name
+type SecretProvider interface {
+	Get(name string) (string, error)
+}
+
+// Provider used by loadSecret, chosen by newSecretProvider at startup
+var secretProvider SecretProvider = envSecretProvider{}
+
+// envSecretProvider reads secrets from environment variables
+type envSecretProvider struct{}
+
+func (envSecretProvider) Get(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: environment variable %s", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// fileSecretProvider reads one secret per file from a directory, the layout
+// used by Docker and Kubernetes secret mounts
+type fileSecretProvider struct {
+	dir string
+}
+
+func (p fileSecretProvider) Get(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(p.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s in %s", ErrSecretNotFound, name, p.dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// encryptedSecretProvider reads secrets from a local AES-GCM encrypted JSON file
+type encryptedSecretProvider struct {
+	values map[string]string
+}
+
+func (p encryptedSecretProvider) Get(name string) (string, error) {
+	value, ok := p.values[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s in encrypted secrets file", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// newEncryptedSecretProvider decrypts the secrets file once and keeps the values in memory
+func newEncryptedSecretProvider(path string, key []byte) (encryptedSecretProvider, error) {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return encryptedSecretProvider{}, err
+	}
+	values, err := openSecrets(key, sealed)
+	if err != nil {
+		return encryptedSecretProvider{}, fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	return encryptedSecretProvider{values: values}, nil
+}
+
+// newSecretProvider builds the provider selected by SECRETS_PROVIDER
+//
+// env (default) reads environment variables, file reads files from SECRETS_DIR
+// (default /run/secrets) and encrypted reads SECRETS_FILE (default secrets.enc)
+// using the base64 key in SECRETS_KEY_FILE or SECRETS_KEY.
+func newSecretProvider() (SecretProvider, error) {
+	switch provider := strings.ToLower(os.Getenv("SECRETS_PROVIDER")); provider {
+	case "", "env":
+		return envSecretProvider{}, nil
+	case "file":
+		dir := os.Getenv("SECRETS_DIR")
+		if dir == "" {
+			dir = "/run/secrets"
+		}
+		return fileSecretProvider{dir: dir}, nil
+	case "encrypted":
+		key, err := loadSecretsKey()
+		if err != nil {
+			return nil, err
+		}
+		path := os.Getenv("SECRETS_FILE")
+		if path == "" {
+			path = "secrets.enc"
+		}
+		return newEncryptedSecretProvider(path, key)
+	default:
+		return nil, fmt.Errorf("invalid SECRETS_PROVIDER %q: expected env, file or encrypted", provider)
+	}
+}
+
+// loadSecretsKey reads the encryption key for the encrypted provider
+func loadSecretsKey() ([]byte, error) {
+	encoded := os.Getenv("SECRETS_KEY")
+	if path := os.Getenv("SECRETS_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, errors.New("encrypted secrets need SECRETS_KEY_FILE or SECRETS_KEY")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding secrets key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// loadSecret fetches a credential from the configured provider and registers it for log redaction
+func loadSecret(name string) string {
+	value := loadCredential(name)
+	registerSecret(value)
+	return value
+}
+
+// loadCredential fetches a credential that is not itself secret, such as the
+// database user, from the configured provider without registering it for log
+// redaction, which would scrub common values like "root" from every line
+func loadCredential(name string) string {
+	value, err := secretProvider.Get(name)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to load secret %s", name)
+		return ""
+	}
+	return value
+}
+
+// requireSecrets checks that the provider has every named secret, so a missing
+// credential stops the program at startup instead of surfacing as an
+// authentication error halfway through a sync
+func requireSecrets(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if _, err := secretProvider.Get(name); err != nil {
+			if !errors.Is(err, ErrSecretNotFound) {
+				return err
+			}
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// sealSecrets encrypts a set of secrets as nonce || AES-256-GCM ciphertext
+func sealSecrets(key []byte, values map[string]string) ([]byte, error) {
+	plaintext, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openSecrets reverses sealSecrets
+func openSecrets(key, sealed []byte) (map[string]string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secrets file is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// encryptSecretsFile implements the "secrets encrypt <in.json> <out>" command
+func encryptSecretsFile(in, out string) error {
+	key, err := loadSecretsKey()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing %s: %w", in, err)
+	}
+	sealed, err := sealSecrets(key, values)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, sealed, 0600)
+}
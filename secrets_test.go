@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSecretProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "PASS"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider := fileSecretProvider{dir: dir}
+
+	value, err := provider.Get("PASS")
+	if err != nil || value != "s3cret" {
+		t.Fatalf("Get(PASS) = %q, %v", value, err)
+	}
+	if _, err := provider.Get("apiKey"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected ErrSecretNotFound, got %v", err)
+	}
+}
+
+func TestEncryptedSecretProvider(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "secrets.json")
+	out := filepath.Join(dir, "secrets.enc")
+	if err := os.WriteFile(in, []byte(`{"apiKey":"mc-key-us6","PASS":"dbpass"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SECRETS_PROVIDER", "encrypted")
+	t.Setenv("SECRETS_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("SECRETS_FILE", out)
+	if err := encryptSecretsFile(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := newSecretProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := provider.Get("apiKey"); err != nil || value != "mc-key-us6" {
+		t.Errorf("Get(apiKey) = %q, %v", value, err)
+	}
+
+	// A different key must not decrypt the file
+	wrong := make([]byte, 32)
+	if _, err := newEncryptedSecretProvider(out, wrong); err == nil {
+		t.Error("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestRequireSecretsNamesTheMissingOnes(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "USER"), []byte("sync"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(provider SecretProvider) { secretProvider = provider }(secretProvider)
+	secretProvider = fileSecretProvider{dir: dir}
+
+	if err := requireSecrets("USER"); err != nil {
+		t.Errorf("USER is present: %v", err)
+	}
+	err := requireSecrets("USER", "PASS", "apiKey")
+	if !errors.Is(err, ErrSecretNotFound) || err.Error() != "secret not found: PASS, apiKey" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoadCredentialIsNotRedacted(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"USER": "syncuser", "PASS": "hunter2-pass"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(provider SecretProvider) { secretProvider = provider }(secretProvider)
+	secretProvider = fileSecretProvider{dir: dir}
+
+	if user := loadCredential("USER"); user != "syncuser" || redact("user syncuser") != "user syncuser" {
+		t.Errorf("USER %q must load without being redacted", user)
+	}
+	if pass := loadSecret("PASS"); pass != "hunter2-pass" || redact("pass hunter2-pass") == "pass hunter2-pass" {
+		t.Errorf("PASS %q must be redacted", pass)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+)
+
+// runServe implements "serve [-addr :8080]" plus the flags of sync, a
+// long-running daemon that syncs every entity on its own schedule and serves
+// /healthz, /readyz, /metrics and /trigger/<entity>.
+//
+// The first SIGINT/SIGTERM stops scheduling and lets running syncs finish the
+// page they are on; a second signal aborts them.
+func runServe(args []string) {
+	var opts syncOptions
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", envString("SERVE_ADDR", ":8080"), "address for the health, metrics and trigger endpoints")
+	addSyncFlags(flags, &opts)
+	flags.Parse(args)
+
+	ctx, stop := withShutdown(context.Background())
+	defer stop()
+
+	env, cleanup := prepareSync(ctx, opts)
+	defer cleanup()
+
+	sched, err := newScheduler(ctx, env)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	healthz, readyz, err := newHealthHandlers(env, sched.scheduledRuns())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthz)
+	mux.Handle("/readyz", readyz)
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/trigger/", sched)
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("HTTP server failed")
+		}
+	}()
+	log.WithField("addr", *addr).Info("Serving health checks, metrics and triggers")
+
+	sched.start()
+	<-stopSignal(ctx)
+	log.Info("Waiting for running syncs to finish")
+	sched.wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Warn("Failed to stop HTTP server")
+	}
+	log.Info("Stopped")
+}
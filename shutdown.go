@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type stopKey struct{}
+
+// errInterrupted is the outcome of an entity a graceful shutdown stopped
+// between pages, or skipped before it started. Committed pages are kept and
+// the next run resumes from the checkpoint.
+var errInterrupted = errors.New("interrupted by shutdown")
+
+// interruptedErr is the error of a sync stopped by stopRequested: the
+// context's error after a hard stop, errInterrupted after a graceful one
+func interruptedErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errInterrupted
+}
+
+// withShutdown returns a context that carries a stop signal for SIGINT/SIGTERM.
+//
+// The first signal asks the fetchers to finish and commit the page they are
+// working on and then stop; a second signal cancels the context outright.
+// The returned function releases the signal handler.
+func withShutdown(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := make(chan struct{})
+	ctx = context.WithValue(ctx, stopKey{}, stop)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.WithField("signal", sig.String()).Warn("Shutdown requested, finishing current page")
+			close(stop)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case sig := <-signals:
+			log.WithField("signal", sig.String()).Warn("Second signal received, aborting")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// stopRequested reports whether a graceful shutdown was requested or the context is done.
+// Fetchers check it between pages so a page is never abandoned halfway through.
+func stopRequested(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	stop, ok := ctx.Value(stopKey{}).(chan struct{})
+	if !ok {
+		return false
+	}
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopSignal returns a channel that is closed once a graceful shutdown is
+// requested or the context is done
+func stopSignal(ctx context.Context) <-chan struct{} {
+	if stop, ok := ctx.Value(stopKey{}).(chan struct{}); ok {
+		return stop
+	}
+	return ctx.Done()
+}
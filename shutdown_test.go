@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"mailchimp/internal/fake"
+)
+
+func TestShutdownFirstSignalStopsSecondCancels(t *testing.T) {
+	ctx, stop := withShutdown(context.Background())
+	defer stop()
+
+	if stopRequested(ctx) {
+		t.Fatal("stop requested before any signal")
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	waitFor(t, func() bool { return stopRequested(ctx) })
+	if ctx.Err() != nil {
+		t.Fatal("first signal must not cancel in-flight work")
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	waitFor(t, func() bool { return ctx.Err() != nil })
+}
+
+func TestStopRequestedWithoutShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if stopRequested(ctx) {
+		t.Fatal("plain context reported a stop")
+	}
+	cancel()
+	if !stopRequested(ctx) {
+		t.Fatal("cancelled context should report a stop")
+	}
+}
+
+func TestGracefulStopIsNotASuccess(t *testing.T) {
+	c := fake.NewCratejoy("client", "secret")
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		c.AddOrders(Order{ID: int64(i), PlacedAt: "2024-01-01T00:00:00Z"})
+	}
+
+	// Stop already requested: the first page is still written, then the run ends
+	stop := make(chan struct{})
+	close(stop)
+	ctx := context.WithValue(context.Background(), stopKey{}, stop)
+
+	var orders []Order
+	p := newMemoryPipeline(newTestAPIClient(3), c, "orders", &orders)
+	result := p.run(ctx, p.baseURL+"?limit=2")
+	if !errors.Is(result.Err, errInterrupted) {
+		t.Fatalf("expected errInterrupted, got %v", result.Err)
+	}
+	if result.Pages != 1 || len(orders) != 2 {
+		t.Errorf("expected the first page written, got %+v", result)
+	}
+	if code := exitCode([]syncResult{result}); code == exitOK {
+		t.Error("an interrupted sync must not exit OK")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema holds every table the sync writes, created by Migrate. Column
+// names match the MySQL tables; orders live in cj_orders as SQLite has no
+// separate orders database.
+var sqliteSchema = []string{
+	syncStateSchema,
+	`CREATE TABLE IF NOT EXISTS sync_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT NOT NULL,
+		source TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NULL,
+		pages INTEGER NOT NULL DEFAULT 0,
+		fetched INTEGER NOT NULL DEFAULT 0,
+		inserted INTEGER NOT NULL DEFAULT 0,
+		updated INTEGER NOT NULL DEFAULT 0,
+		unchanged INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		error TEXT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sync_runs_run_id ON sync_runs (run_id)`,
+	`CREATE INDEX IF NOT EXISTS sync_runs_started_at ON sync_runs (started_at)`,
+	`CREATE TABLE IF NOT EXISTS mailchimp (
+		list_id TEXT NOT NULL,
+		contact_id TEXT NOT NULL,
+		email TEXT,
+		status TEXT,
+		full_name TEXT,
+		PRIMARY KEY (list_id, contact_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_orders (
+		id INTEGER PRIMARY KEY,
+		card_refunded_amount INTEGER, credit_applied INTEGER, customer_id INTEGER,
+		financial_status TEXT, fulfillment_status TEXT, gift_card_discount INTEGER,
+		gift_message TEXT, gift_renewal_notif BOOLEAN, gross_shipping INTEGER, is_gift BOOLEAN,
+		order_gift_info TEXT, is_renewal BOOLEAN, is_test BOOLEAN, note TEXT,
+		placed_at DATETIME, prorated_charge INTEGER, refund_applied INTEGER, refunded_amount INTEGER,
+		status TEXT, store_id INTEGER, sub_total INTEGER, total INTEGER, total_app_fees INTEGER,
+		total_label_cost INTEGER, total_pending_fees INTEGER, total_price INTEGER, total_shipping INTEGER,
+		total_tax INTEGER, transaction_fees INTEGER, transaction_fee_status INTEGER, type TEXT, url TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS cj_orders_placed_at ON cj_orders (placed_at)`,
+	`CREATE TABLE IF NOT EXISTS cj_addresses (
+		id INTEGER PRIMARY KEY,
+		city TEXT, company TEXT, country TEXT, icon TEXT, phone_number TEXT, state TEXT,
+		status INTEGER, status_message TEXT, street TEXT, to_name TEXT, type TEXT, unit TEXT, zip_code TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_billings (
+		id INTEGER PRIMARY KEY,
+		rebill_day INTEGER, rebill_months INTEGER, rebill_weeks TEXT, rebill_window INTEGER,
+		store_id INTEGER, type TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_customers (
+		id INTEGER PRIMARY KEY,
+		country TEXT, email TEXT, first_name TEXT, last_name TEXT, location TEXT, name TEXT,
+		status TEXT, type TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_products (
+		id INTEGER PRIMARY KEY,
+		deleted BOOLEAN, description TEXT, display_order INTEGER, flat_ship_price REAL,
+		gift_shipping REAL, giftable BOOLEAN, listed BOOLEAN, max_subs TEXT, meta TEXT,
+		mp_visible BOOLEAN, name TEXT, product_billing_id INTEGER, product_type INTEGER,
+		reviewable BOOLEAN, ship_option INTEGER, ship_weight REAL, single_purchasable BOOLEAN,
+		sku TEXT, slug TEXT, store_id INTEGER, subscribe_flow BOOLEAN, subscribe_flow_data TEXT,
+		visible BOOLEAN
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_product_instances (
+		id INTEGER PRIMARY KEY,
+		name TEXT, price REAL, product_id INTEGER, sku TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_terms (
+		id INTEGER PRIMARY KEY,
+		description TEXT, enabled BOOLEAN, name TEXT, num_cycles INTEGER, type TEXT, images TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS cj_subscriptions (
+		id INTEGER PRIMARY KEY,
+		address_id INTEGER, billing_id INTEGER, customer_id INTEGER, product_id INTEGER,
+		product_instance_id INTEGER, term_id INTEGER, autorenew BOOLEAN, billing_name TEXT,
+		credit TEXT, end_date DATETIME, is_test BOOLEAN, note TEXT, skipped_date TEXT,
+		source INTEGER, start_date DATETIME, status TEXT, store_id INTEGER, type TEXT, url TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS raw_pages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		source TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		synced_at DATETIME NOT NULL,
+		page INTEGER NOT NULL,
+		body BLOB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS raw_pages_entity ON raw_pages (source, entity, synced_at, page)`,
+}
+
+// sqliteStore keeps everything in one SQLite file, for tests, local
+// development and small single-instance deployments. Writes go through a
+// single connection, and entity locks only cover this process.
+type sqliteStore struct {
+	sqlStore
+	locks localLocks
+}
+
+// openSQLiteStore opens, or creates, the database file at path
+func openSQLiteStore(ctx context.Context, path string) (*sqliteStore, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma":      {"busy_timeout(10000)", "journal_mode(WAL)"},
+		"_time_format": {"sqlite"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; sharing one connection queues
+	// writers in the pool instead of failing them with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	log.WithField("path", path).Info("Opened SQLite store")
+	return &sqliteStore{sqlStore: sqlStore{db: db, dialect: sqliteDialect{}, ordersTable: "cj_orders"}}, nil
+}
+
+// Migrate creates the bookkeeping and entity tables
+func (s *sqliteStore) Migrate(ctx context.Context) error {
+	for _, stmt := range sqliteSchema {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("creating SQLite schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Lock(ctx context.Context, source, entity string, wait time.Duration) (func(), error) {
+	return s.locks.acquire(ctx, lockName(source, entity), wait)
+}
+
+// localLocks are named locks held within this process
+type localLocks struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// acquire takes the named lock, waiting up to wait, and returns errLockHeld
+// when it is still held
+func (l *localLocks) acquire(ctx context.Context, name string, wait time.Duration) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]chan struct{})
+	}
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[name] = lock
+	}
+	l.mu.Unlock()
+
+	unlock := func() { <-lock }
+	select {
+	case lock <- struct{}{}:
+		return unlock, nil
+	default:
+	}
+	if wait <= 0 {
+		return nil, errLockHeld
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case lock <- struct{}{}:
+		return unlock, nil
+	case <-timer.C:
+		return nil, errLockHeld
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
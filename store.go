@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// errBulkLoadUnsupported is returned by bulk loads on stores without LOAD DATA
+var errBulkLoadUnsupported = errors.New("bulk loads need the MySQL store")
+
+// Store is where synced entities are written, along with the pagination
+// checkpoints and entity locks that go with them.
+//
+// Upserts take a whole page and return what it did to the entity's main
+// table. The same page may be written again after a retry or a resumed sync,
+// so every write must be idempotent.
+type Store interface {
+	// Migrate creates the tables the store manages when they are missing
+	Migrate(ctx context.Context) error
+
+	UpsertMembers(ctx context.Context, listID string, members []Member) (rowCounts, error)
+	UpsertOrders(ctx context.Context, orders []Order) (rowCounts, error)
+	UpsertSubscriptions(ctx context.Context, subscriptions []Subscription) (rowCounts, error)
+
+	// LatestOrderPlacedAt is the newest placed_at stored, zero without orders
+	LatestOrderPlacedAt(ctx context.Context) (time.Time, error)
+
+	LoadCheckpoint(ctx context.Context, source, entity string) (string, error)
+	SaveCheckpoint(ctx context.Context, source, entity, cursor string) error
+	ClearCheckpoint(ctx context.Context, source, entity string) error
+
+	// Lock takes the lock for source/entity, waiting up to wait, and returns
+	// errLockHeld when someone else still holds it
+	Lock(ctx context.Context, source, entity string, wait time.Duration) (unlock func(), err error)
+
+	// DB is the underlying database, used for sync_runs and health checks,
+	// and Dialect the SQL it speaks
+	DB() *sql.DB
+	Dialect() sqlDialect
+	Close() error
+}
+
+// openStore opens the store selected by DB_DRIVER: "mysql" (default) with the
+// USER and PASS secrets and SERVER and PORT, "postgres" with the same
+// credentials and POSTGRES_DATABASE, or "sqlite" with the database file at
+// SQLITE_PATH (default customer-sync.db)
+func openStore(ctx context.Context) (Store, error) {
+	driver := envString("DB_DRIVER", "mysql")
+	if driver == "mysql" || driver == "postgres" {
+		if err := requireSecrets("USER", "PASS"); err != nil {
+			return nil, fmt.Errorf("database credentials: %w", err)
+		}
+	}
+	switch driver {
+	case "mysql":
+		db, err := opendb()
+		if err != nil {
+			return nil, err
+		}
+		return newMySQLStore(ctx, db), nil
+	case "postgres":
+		return openPostgresStore(ctx, postgresDSN())
+	case "sqlite":
+		return openSQLiteStore(ctx, envString("SQLITE_PATH", "customer-sync.db"))
+	default:
+		return nil, fmt.Errorf("invalid DB_DRIVER %q, expected mysql, postgres or sqlite", driver)
+	}
+}
+
+// sqlStore is the part of a Store shared by the SQL databases: Cratejoy pages
+// written with multi-row upserts in the store's dialect, and checkpoints
+type sqlStore struct {
+	db          *sql.DB
+	dialect     sqlDialect
+	ordersTable string
+}
+
+// UpsertMembers writes a chunk of members keyed by list and contact id
+func (s *sqlStore) UpsertMembers(ctx context.Context, listID string, members []Member) (counts rowCounts, err error) {
+	batch := newUpsertBatch(s.dialect, "mailchimp", memberColumns...).keyedBy(2)
+	for _, member := range members {
+		batch.add(memberRow(listID, member)...)
+	}
+	if batch.len() == 0 {
+		return counts, nil
+	}
+
+	ctx, span := startSpan(ctx, "upsert mailchimp",
+		attribute.String("db.sql.table", "mailchimp"),
+		attribute.Int("db.rows", len(members)),
+	)
+	defer func() {
+		span.SetAttributes(rowCountAttributes(counts)...)
+		endSpan(span, err)
+	}()
+
+	err = withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		counts, err = batch.exec(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return counts, err
+	}
+	observeRows("mailchimp", counts)
+
+	log.WithFields(logrus.Fields{
+		"list_id":   listID,
+		"members":   len(members),
+		"inserted":  counts.Inserted,
+		"updated":   counts.Updated,
+		"unchanged": counts.Unchanged,
+	}).Debug("Upserted members")
+	return counts, nil
+}
+
+func (s *sqlStore) UpsertOrders(ctx context.Context, orders []Order) (rowCounts, error) {
+	page := newOrderPage(s)
+	for _, order := range orders {
+		if err := page.add(order); err != nil {
+			return rowCounts{}, err
+		}
+	}
+	return page.commit(ctx)
+}
+
+func (s *sqlStore) UpsertSubscriptions(ctx context.Context, subscriptions []Subscription) (rowCounts, error) {
+	page := newSubscriptionPage(s)
+	for _, subscription := range subscriptions {
+		if err := page.add(subscription); err != nil {
+			return rowCounts{}, err
+		}
+	}
+	return page.commit(ctx)
+}
+
+func (s *sqlStore) LatestOrderPlacedAt(ctx context.Context) (time.Time, error) {
+	var placedAt dbTime
+	err := s.db.QueryRowContext(ctx, "SELECT MAX(placed_at) FROM "+s.ordersTable).Scan(&placedAt)
+	return placedAt.Time.UTC(), err
+}
+
+func (s *sqlStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *sqlStore) Dialect() sqlDialect {
+	return s.dialect
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// storePage buffers one page of records for a single Store write
+type storePage[T any] struct {
+	records []T
+	write   func(ctx context.Context, records []T) (rowCounts, error)
+}
+
+func newStorePage[T any](write func(ctx context.Context, records []T) (rowCounts, error)) *storePage[T] {
+	return &storePage[T]{write: write}
+}
+
+func (p *storePage[T]) add(record T) error {
+	p.records = append(p.records, record)
+	return nil
+}
+
+func (p *storePage[T]) commit(ctx context.Context) (rowCounts, error) {
+	if len(p.records) == 0 {
+		return rowCounts{}, nil
+	}
+	return p.write(ctx, p.records)
+}
+
+// Layouts SQLite returns timestamps in when it cannot tell a column's type,
+// as for MIN and MAX
+var dbTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// dbTime scans a nullable timestamp that arrives either as a time.Time or as
+// text. It converts to sql.NullTime.
+type dbTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (t *dbTime) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		*t = dbTime{}
+		return nil
+	case time.Time:
+		*t = dbTime{Time: v, Valid: true}
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", value)
+	}
+
+	for _, layout := range dbTimeLayouts {
+		if parsed, err := time.Parse(layout, text); err == nil {
+			*t = dbTime{Time: parsed, Valid: true}
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse timestamp %q", text)
+}
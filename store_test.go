@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	t.Helper()
+	store, err := openSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLiteUpsertCounts(t *testing.T) {
+	exactUpsertCounts(t)
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	orders := []Order{
+		{ID: 1, Status: "paid", PlacedAt: "2024-01-01T00:00:00Z"},
+		{ID: 2, Status: "paid", PlacedAt: "2024-02-01T00:00:00Z"},
+	}
+
+	steps := []struct {
+		name string
+		edit func()
+		want rowCounts
+	}{
+		{"insert", func() {}, rowCounts{Inserted: 2}},
+		{"same values", func() {}, rowCounts{Unchanged: 2}},
+		{"one changed", func() { orders[1].Status = "refunded" }, rowCounts{Updated: 1, Unchanged: 1}},
+	}
+	for _, step := range steps {
+		step.edit()
+		counts, err := store.UpsertOrders(ctx, orders)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if counts != step.want {
+			t.Errorf("%s: got %+v, want %+v", step.name, counts, step.want)
+		}
+	}
+
+	latest, err := store.LatestOrderPlacedAt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !latest.Equal(want) {
+		t.Errorf("latest placed_at = %v, want %v", latest, want)
+	}
+}
+
+func TestSQLiteUpsertMembersByListAndContact(t *testing.T) {
+	exactUpsertCounts(t)
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	members := []Member{{ContactID: "a", Email: "a@example.com"}, {ContactID: "b", Email: "b@example.com"}}
+
+	if _, err := store.UpsertMembers(ctx, "list1", members); err != nil {
+		t.Fatal(err)
+	}
+	// The same contacts on another list are separate rows
+	counts, err := store.UpsertMembers(ctx, "list2", members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (rowCounts{Inserted: 2}) {
+		t.Errorf("second list: got %+v", counts)
+	}
+
+	members[0].Status = "unsubscribed"
+	counts, err = store.UpsertMembers(ctx, "list1", members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (rowCounts{Updated: 1, Unchanged: 1}) {
+		t.Errorf("resync: got %+v", counts)
+	}
+}
+
+// cj_subscriptions is upserted rather than replaced, so columns the sync does
+// not write, such as ones added for reporting, survive a resync
+func TestSQLiteSubscriptionUpsertKeepsOtherColumns(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	db := store.DB()
+	if _, err := db.ExecContext(ctx, "ALTER TABLE cj_subscriptions ADD COLUMN churn_reason TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	subscription := Subscription{ID: 1, Status: "active", StartDate: "2024-01-01T00:00:00Z", EndDate: "2024-02-01T00:00:00Z"}
+	if _, err := store.UpsertSubscriptions(ctx, []Subscription{subscription}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE cj_subscriptions SET churn_reason = 'price' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	subscription.Status = "cancelled"
+	if _, err := store.UpsertSubscriptions(ctx, []Subscription{subscription}); err != nil {
+		t.Fatal(err)
+	}
+	var status, reason string
+	if err := db.QueryRowContext(ctx, "SELECT status, churn_reason FROM cj_subscriptions WHERE id = 1").Scan(&status, &reason); err != nil {
+		t.Fatal(err)
+	}
+	if status != "cancelled" || reason != "price" {
+		t.Errorf("got status %q and churn_reason %q, want cancelled and price", status, reason)
+	}
+}
+
+func TestSQLiteCheckpoints(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	for _, cursor := range []string{"?page=2", "?page=3"} {
+		if err := store.SaveCheckpoint(ctx, "cratejoy", "orders", cursor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cursor, err := store.LoadCheckpoint(ctx, "cratejoy", "orders"); err != nil || cursor != "?page=3" {
+		t.Errorf("got %q, %v", cursor, err)
+	}
+	if err := store.ClearCheckpoint(ctx, "cratejoy", "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, err := store.LoadCheckpoint(ctx, "cratejoy", "orders"); err != nil || cursor != "" {
+		t.Errorf("after clear got %q, %v", cursor, err)
+	}
+}
+
+func TestSQLiteRunsAndFreshness(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	recorder, err := newRunRecorder(store.DB(), store.Dialect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withRunRecorder(context.Background(), recorder)
+	result := newSyncResult(ctx, "cratejoy", "orders")
+	result.finish(nil)
+
+	var runs, shown strings.Builder
+	if err := listRuns(context.Background(), store, &runs, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := showRun(context.Background(), store, &shown, recorder.runID); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(runs.String(), recorder.runID) || !strings.Contains(shown.String(), "orders") {
+		t.Errorf("unexpected output:\n%s\n%s", runs.String(), shown.String())
+	}
+	if err := checkFreshness(context.Background(), store.DB(), []string{"cratejoy orders"}, time.Now(), time.Hour); err != nil {
+		t.Errorf("expected a fresh sync, got %v", err)
+	}
+}
+
+func TestFreshnessChecksOnlyScheduledSyncs(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	recorder, err := newRunRecorder(store.DB(), store.Dialect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withRunRecorder(context.Background(), recorder)
+	// A list that has since been deleted failed its last sync
+	failedResult(ctx, "mailchimp", "members:deleted", errors.New("Resource Not Found"))
+
+	defer func(wait time.Duration, skip bool) { lockWait, lockBusySkip = wait, skip }(lockWait, lockBusySkip)
+	lockWait, lockBusySkip = 0, true
+	unlock, err := store.Lock(ctx, "cratejoy", "orders", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	result := syncLocked(ctx, store, "cratejoy", "orders", func(ctx context.Context) syncResult {
+		t.Fatal("sync ran while another instance held the lock")
+		return syncResult{}
+	})
+	if !result.Skipped {
+		t.Fatalf("expected a skipped result, got %+v", result)
+	}
+
+	started := time.Now().Add(-2 * time.Hour)
+	if err := checkFreshness(context.Background(), store.DB(), nil, started, time.Hour); err != nil {
+		t.Errorf("unscheduled entities should not be checked: %v", err)
+	}
+	err = checkFreshness(context.Background(), store.DB(), []string{"cratejoy orders"}, started, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "cratejoy orders") {
+		t.Errorf("a skipped sync should not count as fresh, got %v", err)
+	}
+}
+
+func TestLocalLocks(t *testing.T) {
+	var locks localLocks
+	ctx := context.Background()
+
+	unlock, err := locks.acquire(ctx, "sync:cratejoy:orders", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := locks.acquire(ctx, "sync:cratejoy:orders", 0); !errors.Is(err, errLockHeld) {
+		t.Errorf("expected errLockHeld, got %v", err)
+	}
+	if _, err := locks.acquire(ctx, "sync:cratejoy:subscriptions", 0); err != nil {
+		t.Errorf("other entities should not be blocked: %v", err)
+	}
+
+	time.AfterFunc(10*time.Millisecond, unlock)
+	if _, err := locks.acquire(ctx, "sync:cratejoy:orders", time.Second); err != nil {
+		t.Errorf("expected the lock after waiting, got %v", err)
+	}
+}
+
+func TestSQLiteUpsertClause(t *testing.T) {
+	got := sqliteDialect{}.upsertClause("mailchimp", []string{"list_id", "contact_id"}, []string{"email", "status"})
+	want := " ON CONFLICT (list_id, contact_id) DO UPDATE SET email = excluded.email, status = excluded.status" +
+		" WHERE (email, status) IS NOT (excluded.email, excluded.status)"
+	if got != want {
+		t.Errorf("clause = %q\nwant     %q", got, want)
+	}
+}
+
+func TestDBTimeScan(t *testing.T) {
+	want := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, value := range []interface{}{want, "2024-03-04 05:06:07", "2024-03-04 05:06:07+00:00", []byte("2024-03-04T05:06:07Z")} {
+		var got dbTime
+		if err := got.Scan(value); err != nil || !got.Valid || !got.Time.Equal(want) {
+			t.Errorf("Scan(%v) = %+v, %v", value, got, err)
+		}
+	}
+	var null dbTime
+	if err := null.Scan(nil); err != nil || null.Valid {
+		t.Errorf("Scan(nil) = %+v, %v", null, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// streamPage decodes a paginated API response straight from r without
+// buffering the body. Each element of the array under arrayKey is decoded on
+// its own and passed to yield, so memory stays flat regardless of page size.
+// The remaining top-level fields (next, total_items, ...) are decoded into page
+// once the object has been read; the array field of page is left empty.
+func streamPage[T any](r io.Reader, arrayKey string, page interface{}, yield func(T) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	// Small top-level fields are kept and decoded into page at the end
+	var rest bytes.Buffer
+	rest.WriteByte('{')
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("expected object key, got %v", token)
+		}
+
+		if key != arrayKey {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+			if rest.Len() > 1 {
+				rest.WriteByte(',')
+			}
+			encodedKey, _ := json.Marshal(key)
+			rest.Write(encodedKey)
+			rest.WriteByte(':')
+			rest.Write(value)
+			continue
+		}
+
+		token, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			// A null array means an empty page
+			continue
+		}
+		if token != json.Delim('[') {
+			return fmt.Errorf("expected array for %q, got %v", arrayKey, token)
+		}
+		for dec.More() {
+			var item T
+			if err := dec.Decode(&item); err != nil {
+				return err
+			}
+			if err := yield(item); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+
+	rest.WriteByte('}')
+	return json.Unmarshal(rest.Bytes(), page)
+}
+
+// expectDelim reads the next token and checks it is the given delimiter
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q, got %v", delim, token)
+	}
+	return nil
+}
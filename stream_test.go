@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestStreamPageMembers(t *testing.T) {
+	body := `{"members":[{"email_address":"a@example.com","status":"subscribed"},{"email_address":"b@example.com","status":"cleaned"}],"total_items":2}`
+
+	var page Response
+	var emails []string
+	err := streamPage(strings.NewReader(body), "members", &page, func(member Member) error {
+		emails = append(emails, member.Email)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalItems != 2 || len(page.Members) != 0 {
+		t.Errorf("page = %+v, want total 2 and no buffered members", page)
+	}
+	if strings.Join(emails, ",") != "a@example.com,b@example.com" {
+		t.Errorf("streamed %v", emails)
+	}
+}
+
+func TestStreamPageNextAfterResults(t *testing.T) {
+	body := `{"count":1,"results":[{"id":7,"placed_at":"2024-01-02T03:04:05Z"}],"prev":null,"next":"?page=2"}`
+
+	var links struct {
+		Next string `json:"next"`
+	}
+	var ids []int64
+	err := streamPage(strings.NewReader(body), "results", &links, func(order Order) error {
+		ids = append(ids, order.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links.Next != "?page=2" || len(ids) != 1 || ids[0] != 7 {
+		t.Errorf("next = %q, ids = %v", links.Next, ids)
+	}
+}
+
+func TestStreamPageNullResults(t *testing.T) {
+	var page CratejoyResponse
+	err := streamPage(strings.NewReader(`{"results":null,"next":""}`), "results", &page, func(Subscription) error {
+		t.Error("no records expected")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamPageStopsOnYieldError(t *testing.T) {
+	body := `{"members":[{"email_address":"a@example.com"},{"email_address":"b@example.com"}]}`
+	stop := fmt.Errorf("stop")
+
+	calls := 0
+	err := streamPage(strings.NewReader(body), "members", &Response{}, func(Member) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("err = %v after %d calls", err, calls)
+	}
+}
+
+// memberPage builds a Mailchimp members page of n members with merge fields
+func memberPage(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"members":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"email_address":"member%d@example.com","status":"subscribed","full_name":"Member %d","contact_id":"c%d","merge_fields":{"FNAME":"Member","LNAME":"%d","Subscription Status":"Active"}}`, i, i, i, i)
+	}
+	fmt.Fprintf(&buf, `],"total_items":%d}`, n)
+	return buf.Bytes()
+}
+
+// The streaming decoder should allocate the same per member regardless of page
+// size, and never hold a whole page, while Unmarshal grows with the page.
+func BenchmarkMemberPage(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		body := memberPage(n)
+
+		b.Run(fmt.Sprintf("stream/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				var page Response
+				err := streamPage(bytes.NewReader(body), "members", &page, func(Member) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("unmarshal/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				var page Response
+				if err := json.Unmarshal(body, &page); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// liveHeap returns the bytes of live heap after a full collection
+func liveHeap() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// BenchmarkMemberPageLiveHeap reports the heap held halfway through a page
+// (live-B/op) on top of the request body, which stays flat when streaming and
+// grows with the page when the body is read and unmarshalled whole.
+func BenchmarkMemberPageLiveHeap(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		body := memberPage(n)
+
+		b.Run(fmt.Sprintf("stream/%d", n), func(b *testing.B) {
+			var live uint64
+			for i := 0; i < b.N; i++ {
+				base := liveHeap()
+				seen := 0
+				err := streamPage(bytes.NewReader(body), "members", &Response{}, func(Member) error {
+					if seen++; seen == n/2 {
+						live += liveHeap() - base
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(live)/float64(b.N), "live-B/op")
+		})
+
+		b.Run(fmt.Sprintf("unmarshal/%d", n), func(b *testing.B) {
+			var live uint64
+			for i := 0; i < b.N; i++ {
+				base := liveHeap()
+				data, _ := io.ReadAll(bytes.NewReader(body))
+				var page Response
+				if err := json.Unmarshal(data, &page); err != nil {
+					b.Fatal(err)
+				}
+				live += liveHeap() - base
+				runtime.KeepAlive(data)
+				runtime.KeepAlive(page)
+			}
+			b.ReportMetric(float64(live)/float64(b.N), "live-B/op")
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Process exit codes of a sync run
+const (
+	exitOK      = 0 // every entity synced
+	exitFailure = 1 // nothing synced, or the run could not start
+	exitPartial = 2 // some entities synced and some failed
+)
+
+// syncResult is the outcome of syncing one entity of one source, e.g. the
+// members of one Mailchimp list or Cratejoy orders
+type syncResult struct {
+	Source   string
+	Entity   string
+	Pages    int
+	Fetched  int // records decoded from the API
+	Written  int // records committed to the database
+	Failed   int // records fetched but not written
+	Duration time.Duration
+	Err      error
+	Skipped  bool // another instance held the entity's lock
+
+	// What the writes did to the entity's own table
+	rowCounts
+
+	started  time.Time
+	recorder *runRecorder
+	runRowID int64
+}
+
+// newSyncResult starts timing a result and, when ctx carries a run recorder,
+// records the start in sync_runs
+func newSyncResult(ctx context.Context, source, entity string) syncResult {
+	result := syncResult{Source: source, Entity: entity, started: time.Now()}
+	if recorder := runRecorderFrom(ctx); recorder != nil {
+		rowID, err := recorder.start(ctx, source, entity, result.started)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to record start of %s %s", source, entity)
+		} else {
+			result.recorder, result.runRowID = recorder, rowID
+		}
+	}
+	return result
+}
+
+// finish records the duration and error; records that were fetched but never
+// written are counted as failed
+func (r *syncResult) finish(err error) syncResult {
+	r.Duration = time.Since(r.started)
+	r.Err = err
+	r.Failed = 0
+	if r.Fetched > r.Written {
+		r.Failed = r.Fetched - r.Written
+	}
+	if err == nil {
+		lastSuccessTimestamp.WithLabelValues(r.Source, r.Entity).SetToCurrentTime()
+	}
+	if r.recorder != nil {
+		if err := r.recorder.finish(r.runRowID, *r); err != nil {
+			log.WithError(err).Warnf("Failed to record outcome of %s %s", r.Source, r.Entity)
+		}
+	}
+	return *r
+}
+
+// failedResult is the result of a source that failed before syncing anything
+func failedResult(ctx context.Context, source, entity string, err error) syncResult {
+	result := newSyncResult(ctx, source, entity)
+	return result.finish(err)
+}
+
+// exitCode maps the results of a run to the process exit code
+func exitCode(results []syncResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed == len(results):
+		return exitFailure
+	default:
+		return exitPartial
+	}
+}
+
+// printRunSummary writes a table of every result to out, unless out is nil,
+// and logs the totals
+func printRunSummary(out io.Writer, runID string, results []syncResult, duration time.Duration) {
+	if out == nil {
+		out = io.Discard
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tENTITY\tPAGES\tFETCHED\tWRITTEN\tINSERTED\tUPDATED\tUNCHANGED\tFAILED\tDURATION\tERROR")
+
+	var fetched, written, failed, failedEntities int
+	for _, result := range results {
+		status := "-"
+		if result.Skipped {
+			status = "skipped, locked by another instance"
+		}
+		if result.Err != nil {
+			status = redact(result.Err.Error())
+			failedEntities++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			result.Source, result.Entity, result.Pages, result.Fetched, result.Written,
+			result.Inserted, result.Updated, result.Unchanged, result.Failed,
+			result.Duration.Round(time.Millisecond), status)
+		fetched += result.Fetched
+		written += result.Written
+		failed += result.Failed
+	}
+	w.Flush()
+
+	entry := log.WithFields(logrus.Fields{
+		"run_id":          runID,
+		"entities":        len(results),
+		"failed_entities": failedEntities,
+		"fetched":         fetched,
+		"written":         written,
+		"failed":          failed,
+		"duration":        duration,
+		"exit_code":       exitCode(results),
+	})
+	if failedEntities > 0 {
+		entry.Error("Sync run finished with failures")
+		return
+	}
+	entry.Info("Sync run finished")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	ok := syncResult{Source: "cratejoy", Entity: "orders"}
+	failed := syncResult{Source: "cratejoy", Entity: "subscriptions", Err: errors.New("boom")}
+
+	tests := []struct {
+		name    string
+		results []syncResult
+		want    int
+	}{
+		{"empty", nil, exitOK},
+		{"all ok", []syncResult{ok, ok}, exitOK},
+		{"partial", []syncResult{ok, failed}, exitPartial},
+		{"all failed", []syncResult{failed, failed}, exitFailure},
+		{"skipped", []syncResult{ok, {Source: "cratejoy", Entity: "orders", Skipped: true}}, exitOK},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.results); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyncResultFinishCountsUnwrittenRecords(t *testing.T) {
+	result := newSyncResult(context.Background(), "mailchimp", "members:abc")
+	result.Fetched = 10
+	result.Written = 4
+	result.finish(errors.New("insert failed"))
+	if result.Failed != 6 {
+		t.Errorf("expected 6 failed records, got %d", result.Failed)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("expected a duration, got %v", result.Duration)
+	}
+
+	// Finishing again after the rest was written clears the failure count
+	result.Written = 10
+	result.finish(nil)
+	if result.Failed != 0 || result.Err != nil {
+		t.Errorf("expected a clean result, got %+v", result)
+	}
+}
+
+func TestPrintRunSummary(t *testing.T) {
+	var out bytes.Buffer
+	printRunSummary(&out, "abc", []syncResult{
+		{Source: "mailchimp", Entity: "members:abc", Pages: 2, Fetched: 1500, Written: 1500, Duration: time.Second},
+		{Source: "cratejoy", Entity: "orders", Fetched: 150, Written: 0, Failed: 150, Err: errors.New("Cratejoy API error: 500")},
+	}, 2*time.Second)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 rows, got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[0], "SOURCE") {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	if !strings.Contains(lines[2], "Cratejoy API error: 500") {
+		t.Errorf("expected error in row, got %q", lines[2])
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Pagination checkpoints let an interrupted sync resume from the last committed page.
+// The cursor is whatever the source needs to continue: the Cratejoy next-page URL or
+// the Mailchimp member offset.
+const syncStateSchema = `
+	CREATE TABLE IF NOT EXISTS sync_state (
+		source VARCHAR(32) NOT NULL,
+		entity VARCHAR(191) NOT NULL,
+		cursor_value TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (source, entity)
+	)`
+
+// ensureSyncState creates the sync_state table if it is missing
+func ensureSyncState(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, syncStateSchema)
+	return err
+}
+
+// LoadCheckpoint returns the saved cursor for a source/entity, or "" when there is none
+func (s *sqlStore) LoadCheckpoint(ctx context.Context, source, entity string) (string, error) {
+	var cursor string
+	err := s.db.QueryRowContext(ctx,
+		s.dialect.rebind("SELECT cursor_value FROM sync_state WHERE source = ? AND entity = ?"),
+		source, entity).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{
+		"source": source,
+		"entity": entity,
+		"cursor": cursor,
+	}).Info("Resuming from checkpoint")
+	return cursor, nil
+}
+
+// SaveCheckpoint records the cursor of the next page to fetch
+func (s *sqlStore) SaveCheckpoint(ctx context.Context, source, entity, cursor string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`
+		INSERT INTO sync_state (source, entity, cursor_value, updated_at)
+		VALUES (?, ?, ?, ?)`+
+		s.dialect.upsertClause("sync_state", []string{"source", "entity"}, []string{"cursor_value", "updated_at"})),
+		source, entity, cursor, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"source": source,
+		"entity": entity,
+		"cursor": cursor,
+	}).Debug("Saved checkpoint")
+	return nil
+}
+
+// ClearCheckpoint removes the cursor once a sync has completed
+func (s *sqlStore) ClearCheckpoint(ctx context.Context, source, entity string) error {
+	_, err := s.db.ExecContext(ctx,
+		s.dialect.rebind("DELETE FROM sync_state WHERE source = ? AND entity = ?"),
+		source, entity)
+	return err
+}
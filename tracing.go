@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation scope every span is created under
+const tracerName = "customer-sync"
+
+// setupTracing installs the exporter selected by TRACES_EXPORTER:
+//
+//	none  no tracing (default)
+//	otlp  OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables
+//	file  JSON spans appended to TRACES_FILE (default traces.json) for offline analysis
+//
+// The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+
+	switch kind := envString("TRACES_EXPORTER", "none"); kind {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		otlp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	case "file":
+		path := envString("TRACES_FILE", "traces.json")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		exporter, closeFile = stdout, file.Close
+	default:
+		return nil, fmt.Errorf("invalid TRACES_EXPORTER %q, expected none, otlp or file", kind)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName("customer-sync")),
+		resource.Default(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			if closeErr := closeFile(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// startSpan starts a child span of whatever span ctx carries. Spans go through
+// the global tracer provider, a no-op until setupTracing installs an exporter.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it. Errors are redacted like
+// log messages since they can quote URLs and response bodies.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		message := redact(err.Error())
+		span.RecordError(errors.New(message))
+		span.SetStatus(codes.Error, message)
+	}
+	span.End()
+}
+
+// rowCountAttributes describes what a table write did
+func rowCountAttributes(counts rowCounts) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("db.rows.inserted", counts.Inserted),
+		attribute.Int("db.rows.updated", counts.Updated),
+		attribute.Int("db.rows.unchanged", counts.Unchanged),
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs an in-memory tracer provider for the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestAPIClientTracesRequests(t *testing.T) {
+	spans := recordSpans(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	ctx, parent := startSpan(context.Background(), "page")
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/v1/orders/", nil)
+	resp, err := newTestAPIClient(0).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	call := ended[0]
+	if !strings.HasPrefix(call.Name(), "GET ") {
+		t.Errorf("unexpected span name %q", call.Name())
+	}
+	if call.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("API call span is not a child of the page span")
+	}
+	found := false
+	for _, attr := range call.Attributes() {
+		if attr.Key == "http.response.status_code" && attr.Value.AsInt64() == 404 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("status code attribute missing from %v", call.Attributes())
+	}
+}
+
+func TestSetupTracingFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	t.Setenv("TRACES_EXPORTER", "file")
+	t.Setenv("TRACES_FILE", path)
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	shutdown, err := setupTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := startSpan(context.Background(), "sync")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"sync"`) {
+		t.Errorf("span missing from trace file: %s", data)
+	}
+}
+
+func TestSetupTracingRejectsUnknownExporter(t *testing.T) {
+	t.Setenv("TRACES_EXPORTER", "zipkin")
+	if _, err := setupTracing(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+)
+
+// MySQL errors that mean the transaction lost a lock race and can simply be re-run
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// PostgreSQL SQLSTATEs for the same conflicts
+const (
+	pgErrSerializationFailure = "40001"
+	pgErrDeadlockDetected     = "40P01"
+	pgErrLockNotAvailable     = "55P03"
+)
+
+// Transaction settings shared by every page write
+var (
+	txIsolation  = sql.LevelDefault
+	txMaxRetries = 3
+	txRetryDelay = 200 * time.Millisecond
+)
+
+// configureTransactions reads DB_TX_ISOLATION (read-uncommitted, read-committed,
+// repeatable-read or serializable; default is the server's) and DB_TX_RETRIES
+// (default 3), the number of times a deadlocked page write is retried
+func configureTransactions() error {
+	isolation, err := parseIsolation(envString("DB_TX_ISOLATION", ""))
+	if err != nil {
+		return err
+	}
+	retries, err := envInt("DB_TX_RETRIES", txMaxRetries)
+	if err != nil {
+		return err
+	}
+	txIsolation = isolation
+	txMaxRetries = retries
+	return nil
+}
+
+// parseIsolation maps a configuration value to an isolation level
+func parseIsolation(value string) (sql.IsolationLevel, error) {
+	switch strings.ToLower(strings.ReplaceAll(value, "_", "-")) {
+	case "", "default":
+		return sql.LevelDefault, nil
+	case "read-uncommitted":
+		return sql.LevelReadUncommitted, nil
+	case "read-committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable-read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return sql.LevelDefault, fmt.Errorf("invalid DB_TX_ISOLATION %q", value)
+}
+
+// withTx runs fn inside a transaction and commits it. The whole transaction is
+// retried when the database reports a deadlock or lock wait timeout, so fn
+// must be safe to run more than once.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, db, fn)
+		if err == nil || !isRetryableTxError(err) || attempt >= txMaxRetries {
+			return err
+		}
+
+		delay := txRetryDelay * time.Duration(attempt+1)
+		log.WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"delay":   delay,
+			"error":   err,
+		}).Warn("Transaction hit a lock conflict, retrying")
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// runTx is a single transaction attempt
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: txIsolation})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isRetryableTxError reports whether err is a deadlock, lock wait timeout or
+// serialization failure
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgErrSerializationFailure, pgErrDeadlockDetected, pgErrLockNotAvailable:
+			return true
+		}
+	}
+	return false
+}
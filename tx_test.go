@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsRetryableTxError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: mysqlErrDeadlock}, true},
+		{fmt.Errorf("upsert into cj_orders: %w", &mysql.MySQLError{Number: mysqlErrLockWaitTimeout}), true},
+		{&mysql.MySQLError{Number: 1062}, false}, // duplicate entry
+		{&pgconn.PgError{Code: pgErrDeadlockDetected}, true},
+		{fmt.Errorf("upsert into cj_orders: %w", &pgconn.PgError{Code: pgErrSerializationFailure}), true},
+		{&pgconn.PgError{Code: "23505"}, false}, // unique violation
+		{errors.New("connection refused"), false},
+	}
+	for _, c := range cases {
+		if got := isRetryableTxError(c.err); got != c.want {
+			t.Errorf("isRetryableTxError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestParseIsolation(t *testing.T) {
+	if level, err := parseIsolation("READ_COMMITTED"); err != nil || level != sql.LevelReadCommitted {
+		t.Errorf("parseIsolation(READ_COMMITTED) = %v, %v", level, err)
+	}
+	if level, err := parseIsolation(""); err != nil || level != sql.LevelDefault {
+		t.Errorf("parseIsolation(\"\") = %v, %v", level, err)
+	}
+	if _, err := parseIsolation("snapshot"); err == nil {
+		t.Error("expected an error for an unknown isolation level")
+	}
+}
+
+func TestWithTxRetriesLockConflicts(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	db := store.DB()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE tx_test (attempt INTEGER NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(retries int, delay time.Duration) { txMaxRetries, txRetryDelay = retries, delay }(txMaxRetries, txRetryDelay)
+	txMaxRetries, txRetryDelay = 2, time.Millisecond
+
+	// failFirst writes a row for every attempt and fails the first n of them
+	failFirst := func(n int, failure error) (*int, func(tx *sql.Tx) error) {
+		attempts := 0
+		return &attempts, func(tx *sql.Tx) error {
+			attempts++
+			if _, err := tx.ExecContext(ctx, "INSERT INTO tx_test (attempt) VALUES (?)", attempts); err != nil {
+				return err
+			}
+			if attempts <= n {
+				return failure
+			}
+			return nil
+		}
+	}
+	committed := func() []int {
+		t.Helper()
+		rows, err := db.QueryContext(ctx, "SELECT attempt FROM tx_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var attempts []int
+		for rows.Next() {
+			var attempt int
+			if err := rows.Scan(&attempt); err != nil {
+				t.Fatal(err)
+			}
+			attempts = append(attempts, attempt)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM tx_test"); err != nil {
+			t.Fatal(err)
+		}
+		return attempts
+	}
+
+	for _, number := range []uint16{mysqlErrDeadlock, mysqlErrLockWaitTimeout} {
+		attempts, fn := failFirst(2, &mysql.MySQLError{Number: number})
+		if err := withTx(ctx, db, fn); err != nil {
+			t.Errorf("error %d: expected the third attempt to commit, got %v", number, err)
+		}
+		if got := committed(); *attempts != 3 || len(got) != 1 || got[0] != 3 {
+			t.Errorf("error %d: %d attempts committed %v, want only the third", number, *attempts, got)
+		}
+	}
+
+	attempts, fn := failFirst(10, &mysql.MySQLError{Number: mysqlErrDeadlock})
+	if err := withTx(ctx, db, fn); !isRetryableTxError(err) {
+		t.Errorf("expected the deadlock once retries ran out, got %v", err)
+	}
+	if got := committed(); *attempts != 3 || len(got) != 0 {
+		t.Errorf("%d attempts committed %v, want 3 rolled back attempts", *attempts, got)
+	}
+
+	attempts, fn = failFirst(10, &mysql.MySQLError{Number: 1062})
+	if err := withTx(ctx, db, fn); err == nil || *attempts != 1 {
+		t.Errorf("a duplicate entry should not be retried, got %v after %d attempts", err, *attempts)
+	}
+	committed()
+}
+
+func TestWithTxStopsRetryingWhenCancelled(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	defer func(delay time.Duration) { txRetryDelay = delay }(txRetryDelay)
+	txRetryDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := withTx(ctx, store.DB(), func(tx *sql.Tx) error {
+		attempts++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return &mysql.MySQLError{Number: mysqlErrDeadlock}
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("expected context.Canceled after one attempt, got %v after %d", err, attempts)
+	}
+}
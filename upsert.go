@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// execer is satisfied by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryRower is satisfied by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rowCounts tallies what a write did to its target table
+type rowCounts struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+}
+
+func (c *rowCounts) add(other rowCounts) {
+	c.Inserted += other.Inserted
+	c.Updated += other.Updated
+	c.Unchanged += other.Unchanged
+}
+
+// upsertCounts splits the rows of an INSERT ... ON DUPLICATE KEY UPDATE, for
+// which MySQL reports one affected row per insert, two per update and none for
+// a row that already held the same values. existing is the number of rows
+// whose key was already in the table.
+func upsertCounts(rows, existing int, affected int64) rowCounts {
+	inserted := rows - existing
+	updated := (int(affected) - inserted) / 2
+	if updated < 0 {
+		updated = 0
+	}
+	if updated > existing {
+		updated = existing
+	}
+	return rowCounts{Inserted: inserted, Updated: updated, Unchanged: existing - updated}
+}
+
+// affectedUpsertCounts estimates the split of a MySQL upsert from its
+// affected rows alone: updates are the rows affected twice, and a statement
+// that affected fewer rows than it wrote is taken to hold only inserts and
+// unchanged rows
+func affectedUpsertCounts(rows int, affected int64) rowCounts {
+	updated := int(affected) - rows
+	if updated < 0 {
+		updated = 0
+	}
+	if updated > rows {
+		updated = rows
+	}
+	inserted := int(affected) - 2*updated
+	if inserted > rows-updated {
+		inserted = rows - updated
+	}
+	return rowCounts{Inserted: inserted, Updated: updated, Unchanged: rows - inserted - updated}
+}
+
+// replaceCounts splits the rows of a REPLACE, for which MySQL reports one
+// affected row per insert and two per replaced row
+func replaceCounts(rows int, affected int64) rowCounts {
+	updated := int(affected) - rows
+	if updated < 0 {
+		updated = 0
+	}
+	if updated > rows {
+		updated = rows
+	}
+	return rowCounts{Inserted: rows - updated, Updated: updated}
+}
+
+// rowsAffected reads the affected row count, treating a missing result as zero
+func rowsAffected(result sql.Result) int64 {
+	if result == nil {
+		return 0
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return affected
+}
+
+// timestamper converts RFC 3339 API dates into column values
+type timestamper interface {
+	timestamp(value string) (interface{}, error)
+}
+
+// sqlDialect is the database-specific part of an upsert
+type sqlDialect interface {
+	// upsertClause follows INSERT INTO table ... VALUES and overwrites the
+	// update columns of rows whose key columns already exist
+	upsertClause(table string, keys, updates []string) string
+	// upsertCounts splits the rows of one upsert statement, existing being the
+	// number of rows whose key was already in the table
+	upsertCounts(rows, existing int, affected int64) rowCounts
+	// affectedCounts estimates the split of one upsert statement from its
+	// affected rows alone, when existing rows are not counted
+	affectedCounts(rows int, affected int64) rowCounts
+	// maxParams is the most placeholders one statement may hold
+	maxParams() int
+	// rebind rewrites the ? placeholders of query into the dialect's own
+	rebind(query string) string
+	timestamper
+	// insertID runs an INSERT into a table with an auto-incrementing id
+	// column and returns the id of the new row
+	insertID(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error)
+}
+
+// execInsertID returns the id of an inserted row from LastInsertId
+func execInsertID(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error) {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// mysqlDialect writes INSERT ... ON DUPLICATE KEY UPDATE
+type mysqlDialect struct{}
+
+func (mysqlDialect) upsertClause(table string, keys, updates []string) string {
+	if len(updates) == 0 {
+		// Nothing to update, keep the existing row
+		return " ON DUPLICATE KEY UPDATE " + keys[0] + " = " + keys[0]
+	}
+	assignments := make([]string, len(updates))
+	for i, column := range updates {
+		assignments[i] = column + " = VALUES(" + column + ")"
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+func (mysqlDialect) upsertCounts(rows, existing int, affected int64) rowCounts {
+	return upsertCounts(rows, existing, affected)
+}
+
+func (mysqlDialect) affectedCounts(rows int, affected int64) rowCounts {
+	return affectedUpsertCounts(rows, affected)
+}
+
+func (mysqlDialect) maxParams() int {
+	return maxPlaceholders
+}
+
+func (mysqlDialect) rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) timestamp(value string) (interface{}, error) {
+	return parseDate(value)
+}
+
+func (mysqlDialect) insertID(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error) {
+	return execInsertID(ctx, db, query, args...)
+}
+
+// sqliteDialect writes INSERT ... ON CONFLICT DO UPDATE, skipping rows whose
+// values did not change so they are not counted as changes
+type sqliteDialect struct{}
+
+func (sqliteDialect) upsertClause(table string, keys, updates []string) string {
+	conflict := " ON CONFLICT (" + strings.Join(keys, ", ") + ")"
+	if len(updates) == 0 {
+		return conflict + " DO NOTHING"
+	}
+	assignments := make([]string, len(updates))
+	incoming := make([]string, len(updates))
+	for i, column := range updates {
+		assignments[i] = column + " = excluded." + column
+		incoming[i] = "excluded." + column
+	}
+	return conflict + " DO UPDATE SET " + strings.Join(assignments, ", ") +
+		" WHERE (" + strings.Join(updates, ", ") + ") IS NOT (" + strings.Join(incoming, ", ") + ")"
+}
+
+// SQLite counts one change per inserted or actually updated row
+func (sqliteDialect) upsertCounts(rows, existing int, affected int64) rowCounts {
+	inserted := rows - existing
+	updated := int(affected) - inserted
+	if updated < 0 {
+		updated = 0
+	}
+	if updated > existing {
+		updated = existing
+	}
+	return rowCounts{Inserted: inserted, Updated: updated, Unchanged: existing - updated}
+}
+
+// Without the existing rows every change counts as an insert
+func (sqliteDialect) affectedCounts(rows int, affected int64) rowCounts {
+	return sqliteDialect{}.upsertCounts(rows, rows-int(affected), affected)
+}
+
+// SQLite's default SQLITE_MAX_VARIABLE_NUMBER
+func (sqliteDialect) maxParams() int {
+	return 32766
+}
+
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) timestamp(value string) (interface{}, error) {
+	return parseDate(value)
+}
+
+func (sqliteDialect) insertID(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error) {
+	return execInsertID(ctx, db, query, args...)
+}
+
+// postgresDialect writes INSERT ... ON CONFLICT DO UPDATE with numbered
+// placeholders, skipping rows whose values did not change
+type postgresDialect struct{}
+
+func (postgresDialect) upsertClause(table string, keys, updates []string) string {
+	conflict := " ON CONFLICT (" + strings.Join(keys, ", ") + ")"
+	if len(updates) == 0 {
+		return conflict + " DO NOTHING"
+	}
+	// Existing values must be qualified, unqualified columns are ambiguous
+	// with those of EXCLUDED
+	table = table[strings.LastIndex(table, ".")+1:]
+	assignments := make([]string, len(updates))
+	current := make([]string, len(updates))
+	incoming := make([]string, len(updates))
+	for i, column := range updates {
+		assignments[i] = column + " = EXCLUDED." + column
+		current[i] = table + "." + column
+		incoming[i] = "EXCLUDED." + column
+	}
+	return conflict + " DO UPDATE SET " + strings.Join(assignments, ", ") +
+		" WHERE (" + strings.Join(current, ", ") + ") IS DISTINCT FROM (" + strings.Join(incoming, ", ") + ")"
+}
+
+// PostgreSQL, like SQLite, only counts rows that were inserted or changed
+func (postgresDialect) upsertCounts(rows, existing int, affected int64) rowCounts {
+	return sqliteDialect{}.upsertCounts(rows, existing, affected)
+}
+
+func (postgresDialect) affectedCounts(rows int, affected int64) rowCounts {
+	return sqliteDialect{}.affectedCounts(rows, affected)
+}
+
+// The wire protocol sends the parameter count as a 16-bit integer
+func (postgresDialect) maxParams() int {
+	return 65535
+}
+
+// rebind numbers the placeholders $1, $2, ..., leaving quoted text alone
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'':
+			quoted = !quoted
+			b.WriteByte(c)
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Dates keep their offset in timestamptz columns
+func (postgresDialect) timestamp(value string) (interface{}, error) {
+	return time.Parse(time.RFC3339, value)
+}
+
+// PostgreSQL drivers have no LastInsertId, the id comes back with RETURNING
+func (postgresDialect) insertID(ctx context.Context, db *sql.DB, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+// Largest statement a batch may produce, refreshed from @@max_allowed_packet at startup
+var maxStatementBytes = 4 << 20
+
+// MySQL caps prepared statements at 65535 placeholders
+const maxPlaceholders = 65535
+
+// loadMaxAllowedPacket sizes upsert chunks from the server's max_allowed_packet,
+// keeping a margin for the statement text and protocol overhead
+func loadMaxAllowedPacket(ctx context.Context, db *sql.DB) {
+	var packet int
+	if err := db.QueryRowContext(ctx, "SELECT @@max_allowed_packet").Scan(&packet); err != nil {
+		log.WithError(err).Warnf("Failed to read max_allowed_packet, using %d bytes", maxStatementBytes)
+		return
+	}
+	maxStatementBytes = packet * 3 / 4
+	log.WithField("max_statement_bytes", maxStatementBytes).Debug("Sized upsert batches")
+}
+
+// Whether upserts count the keys already present before every chunk, one
+// extra query per chunk that makes the inserted, updated and unchanged counts
+// exact, set from UPSERT_COUNTS. Off by default so a chunk stays a single
+// round trip.
+var countExistingRows = false
+
+// configureUpsertCounts reads UPSERT_COUNTS, "affected" (default) to estimate
+// the counts from the rows each upsert affected, or "exact" to also count the
+// existing rows before every upsert chunk
+func configureUpsertCounts() error {
+	switch mode := envString("UPSERT_COUNTS", "affected"); mode {
+	case "exact":
+		countExistingRows = true
+	case "affected":
+		countExistingRows = false
+	default:
+		return fmt.Errorf("invalid UPSERT_COUNTS %q, expected exact or affected", mode)
+	}
+	return nil
+}
+
+// upsertBatch collects rows for one table and writes them as multi-row
+// upserts in the batch's dialect. Rows are deduplicated by primary key, the
+// first column unless keyedBy says otherwise, with the last row added winning.
+type upsertBatch struct {
+	dialect sqlDialect
+	table   string
+	columns []string
+	keys    int
+	rows    [][]interface{}
+	index   map[interface{}]int
+}
+
+// newUpsertBatch creates a batch; columns[0] must be the primary key and every
+// other column is updated on duplicate keys
+func newUpsertBatch(dialect sqlDialect, table string, columns ...string) *upsertBatch {
+	return &upsertBatch{
+		dialect: dialect,
+		table:   table,
+		columns: columns,
+		keys:    1,
+		index:   make(map[interface{}]int),
+	}
+}
+
+// keyedBy makes the first n columns the primary key
+func (b *upsertBatch) keyedBy(n int) *upsertBatch {
+	b.keys = n
+	return b
+}
+
+// add queues a row, replacing any earlier row with the same primary key
+func (b *upsertBatch) add(values ...interface{}) {
+	if len(values) != len(b.columns) {
+		panic(fmt.Sprintf("upsert into %s: got %d values for %d columns", b.table, len(values), len(b.columns)))
+	}
+	key := values[0]
+	if b.keys > 1 {
+		key = fmt.Sprintf("%q", values[:b.keys])
+	}
+	if i, ok := b.index[key]; ok {
+		b.rows[i] = values
+		return
+	}
+	b.index[key] = len(b.rows)
+	b.rows = append(b.rows, values)
+}
+
+// len returns the number of distinct rows queued
+func (b *upsertBatch) len() int {
+	return len(b.rows)
+}
+
+// exec writes all queued rows in chunks that fit within maxStatementBytes.
+// When tx can also run queries and countExistingRows is set the rows are split
+// exactly into inserted, updated and unchanged, otherwise the split is
+// estimated from the affected rows.
+func (b *upsertBatch) exec(ctx context.Context, tx execer) (counts rowCounts, err error) {
+	if len(b.rows) == 0 {
+		return counts, nil
+	}
+	querier, canCount := tx.(queryRower)
+	canCount = canCount && countExistingRows
+
+	ctx, span := startSpan(ctx, "upsert "+b.table,
+		attribute.String("db.sql.table", b.table),
+		attribute.Int("db.rows", len(b.rows)),
+	)
+	defer func() {
+		span.SetAttributes(rowCountAttributes(counts)...)
+		endSpan(span, err)
+	}()
+
+	prefix := "INSERT INTO " + b.table + " (" + strings.Join(b.columns, ", ") + ") VALUES "
+	suffix := b.dialect.upsertClause(b.table, b.columns[:b.keys], b.columns[b.keys:])
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(b.columns)), ", ") + ")"
+	keyPlaceholders := strings.TrimSuffix(strings.Repeat("?, ", b.keys), ", ")
+	keyColumns := strings.Join(b.columns[:b.keys], ", ")
+	if b.keys > 1 {
+		keyPlaceholders = "(" + keyPlaceholders + ")"
+		keyColumns = "(" + keyColumns + ")"
+	}
+
+	chunks := 0
+	start := 0
+	for start < len(b.rows) {
+		size := len(prefix) + len(suffix)
+		end := start
+		for end < len(b.rows) {
+			rowSize := len(placeholders) + 2 + estimateRowBytes(b.rows[end])
+			tooBig := size+rowSize > maxStatementBytes || (end-start+1)*len(b.columns) > b.dialect.maxParams()
+			if tooBig && end > start {
+				break
+			}
+			size += rowSize
+			end++
+		}
+
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(b.columns))
+		keys := make([]interface{}, 0, (end-start)*b.keys)
+		for _, row := range b.rows[start:end] {
+			values = append(values, placeholders)
+			args = append(args, row...)
+			keys = append(keys, row[:b.keys]...)
+		}
+
+		// Count the keys already present so the affected rows can be split up
+		existing := 0
+		if canCount {
+			query := "SELECT COUNT(*) FROM " + b.table + " WHERE " + keyColumns +
+				" IN (" + strings.TrimSuffix(strings.Repeat(keyPlaceholders+", ", end-start), ", ") + ")"
+			if err := querier.QueryRowContext(ctx, b.dialect.rebind(query), keys...).Scan(&existing); err != nil {
+				return counts, fmt.Errorf("counting existing rows in %s: %w", b.table, err)
+			}
+		}
+
+		query := prefix + strings.Join(values, ", ") + suffix
+		result, err := tx.ExecContext(ctx, b.dialect.rebind(query), args...)
+		if err != nil {
+			return counts, fmt.Errorf("upsert into %s: %w", b.table, err)
+		}
+		if canCount {
+			counts.add(b.dialect.upsertCounts(end-start, existing, rowsAffected(result)))
+		} else {
+			counts.add(b.dialect.affectedCounts(end-start, rowsAffected(result)))
+		}
+		chunks++
+		start = end
+	}
+
+	log.WithFields(logrus.Fields{
+		"table":     b.table,
+		"rows":      len(b.rows),
+		"chunks":    chunks,
+		"inserted":  counts.Inserted,
+		"updated":   counts.Updated,
+		"unchanged": counts.Unchanged,
+	}).Debug("Upserted batch")
+	return counts, nil
+}
+
+// estimateRowBytes approximates how many bytes a row adds to the packet
+func estimateRowBytes(row []interface{}) int {
+	size := 0
+	for _, value := range row {
+		switch v := value.(type) {
+		case string:
+			size += len(v) + 2
+		case []byte:
+			size += len(v) + 2
+		default:
+			size += 24
+		}
+	}
+	return size
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// recordingExecer captures statements instead of running them
+type recordingExecer struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (r *recordingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	r.args = append(r.args, args)
+	return nil, nil
+}
+
+func TestUpsertBatchDeduplicatesByPrimaryKey(t *testing.T) {
+	batch := newUpsertBatch(mysqlDialect{}, "cj_terms", "id", "name")
+	batch.add(1, "monthly")
+	batch.add(2, "yearly")
+	batch.add(1, "monthly (renamed)")
+
+	var rec recordingExecer
+	if _, err := batch.exec(context.Background(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.queries) != 1 {
+		t.Fatalf("got %d statements, want 1", len(rec.queries))
+	}
+
+	want := "INSERT INTO cj_terms (id, name) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name)"
+	if rec.queries[0] != want {
+		t.Errorf("query = %q\nwant    %q", rec.queries[0], want)
+	}
+	if rec.args[0][1] != "monthly (renamed)" {
+		t.Errorf("last row for a key should win, got %v", rec.args[0])
+	}
+}
+
+func TestUpsertBatchChunksToPacketSize(t *testing.T) {
+	saved := maxStatementBytes
+	maxStatementBytes = 1024
+	defer func() { maxStatementBytes = saved }()
+
+	batch := newUpsertBatch(mysqlDialect{}, "cj_customers", "id", "email")
+	for i := 0; i < 50; i++ {
+		batch.add(i, strings.Repeat("x", 100))
+	}
+
+	var rec recordingExecer
+	if _, err := batch.exec(context.Background(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.queries) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(rec.queries))
+	}
+
+	rows := 0
+	for i, query := range rec.queries {
+		if len(query)+len(rec.args[i])/2*100 > maxStatementBytes {
+			t.Errorf("chunk %d exceeds the packet limit", i)
+		}
+		rows += len(rec.args[i]) / 2
+	}
+	if rows != 50 {
+		t.Errorf("wrote %d rows, want 50", rows)
+	}
+}
+
+func TestUpsertCounts(t *testing.T) {
+	tests := []struct {
+		rows, existing int
+		affected       int64
+		want           rowCounts
+	}{
+		{rows: 3, existing: 0, affected: 3, want: rowCounts{Inserted: 3}},
+		{rows: 3, existing: 3, affected: 0, want: rowCounts{Unchanged: 3}},
+		{rows: 4, existing: 3, affected: 5, want: rowCounts{Inserted: 1, Updated: 2, Unchanged: 1}},
+	}
+	for _, tt := range tests {
+		if got := upsertCounts(tt.rows, tt.existing, tt.affected); got != tt.want {
+			t.Errorf("upsertCounts(%d, %d, %d) = %+v, want %+v", tt.rows, tt.existing, tt.affected, got, tt.want)
+		}
+	}
+
+	if got := replaceCounts(5, 7); got != (rowCounts{Inserted: 3, Updated: 2}) {
+		t.Errorf("replaceCounts(5, 7) = %+v", got)
+	}
+
+	for _, tt := range []struct {
+		rows     int
+		affected int64
+		want     rowCounts
+	}{
+		{rows: 3, affected: 3, want: rowCounts{Inserted: 3}},
+		{rows: 3, affected: 0, want: rowCounts{Unchanged: 3}},
+		{rows: 3, affected: 5, want: rowCounts{Inserted: 1, Updated: 2}},
+		{rows: 3, affected: 2, want: rowCounts{Inserted: 2, Unchanged: 1}},
+	} {
+		if got := affectedUpsertCounts(tt.rows, tt.affected); got != tt.want {
+			t.Errorf("affectedUpsertCounts(%d, %d) = %+v, want %+v", tt.rows, tt.affected, got, tt.want)
+		}
+	}
+}
+
+// exactUpsertCounts turns on UPSERT_COUNTS=exact for the rest of the test
+func exactUpsertCounts(t *testing.T) {
+	t.Helper()
+	countExistingRows = true
+	t.Cleanup(func() { countExistingRows = false })
+}
+
+func TestConfigureUpsertCounts(t *testing.T) {
+	t.Cleanup(func() { countExistingRows = false })
+	t.Setenv("UPSERT_COUNTS", "")
+	if err := configureUpsertCounts(); err != nil || countExistingRows {
+		t.Errorf("default mode: count existing %v, %v", countExistingRows, err)
+	}
+	t.Setenv("UPSERT_COUNTS", "exact")
+	if err := configureUpsertCounts(); err != nil || !countExistingRows {
+		t.Errorf("exact mode: count existing %v, %v", countExistingRows, err)
+	}
+	t.Setenv("UPSERT_COUNTS", "approximate")
+	if err := configureUpsertCounts(); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}